@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIKeyHeader carries the API key of a service account
+const APIKeyHeader = "X-API-Key"
+
+// ServiceRole is the role of requests made with an API key,
+// whose permissions are those of the key rather than of a role
+const ServiceRole = "service"
+
+// API keys look like evl_<key id>_<secret>
+const apiKeyPrefix = "evl"
+
+// the last use of a key is saved at most this often, not on every request
+const lastUsedPrecision = time.Minute
+
+var (
+	ErrAPIKeyInvalid = errors.New("api key not valid")
+	ErrAPIKeyExpired = errors.New("api key has expired")
+)
+
+// NewAPIKey saves key under a new key ID, and returns it along with the
+// API key itself. The API key can't be recovered later, only its hash is kept
+func NewAPIKey(key config.APIKey) (config.APIKey, string, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return config.APIKey{}, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return config.APIKey{}, "", err
+	}
+
+	key.ID = hex.EncodeToString(id)
+	apiKey := strings.Join([]string{apiKeyPrefix, key.ID, base64.RawURLEncoding.EncodeToString(secret)}, "_")
+	key.Hash = hashAPIKey(apiKey)
+	key.CreatedAt = time.Now()
+	if err := db.APIKeys().Save(key); err != nil {
+		return config.APIKey{}, "", err
+	}
+	return key, apiKey, nil
+}
+
+// AuthenticateAPIKey returns the saved key of apiKey, if it is valid
+func AuthenticateAPIKey(apiKey string) (config.APIKey, error) {
+	parts := strings.SplitN(apiKey, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return config.APIKey{}, ErrAPIKeyInvalid
+	}
+	key, err := db.APIKeys().Get(parts[1])
+	if err == db.ErrNotFound {
+		return config.APIKey{}, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return config.APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKey(apiKey))) != 1 {
+		return config.APIKey{}, ErrAPIKeyInvalid
+	}
+
+	now := time.Now()
+	if key.IsExpired(now) {
+		return config.APIKey{}, ErrAPIKeyExpired
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastUsedPrecision {
+		if err := db.APIKeys().Touch(key.ID, now); err != nil {
+			log.Println("could not save the last use of api key", key.ID, err.Error())
+		}
+		key.LastUsedAt = &now
+	}
+	return key, nil
+}
+
+// ServiceUsername is the name requests made with key act under
+func ServiceUsername(key config.APIKey) string {
+	return "service:" + key.Name
+}
+
+// identifyAPIKey returns the service account of the API key of r,
+// checking that the key has permission unless it is empty
+func identifyAPIKey(permission string, w http.ResponseWriter, r *http.Request) (Principal, bool) {
+	key, err := AuthenticateAPIKey(r.Header.Get(APIKeyHeader))
+	if err != nil {
+		if err == ErrAPIKeyInvalid || err == ErrAPIKeyExpired {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return Principal{}, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return Principal{}, false
+	}
+	if permission != "" && !key.Allows(permission) {
+		http.Error(w, "api key is not allowed "+permission, http.StatusUnauthorized)
+		return Principal{}, false
+	}
+	return Principal{Username: ServiceUsername(key), Role: ServiceRole, APIKeyID: key.ID}, true
+}
+
+// hashAPIKey hashes an API key. API keys are random
+// enough not to need a password hash
+func hashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,78 +2,117 @@ package auth
 
 import (
 	"evl-book-server/config"
+	"evl-book-server/db"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/urfave/negroni"
 )
 
-type Auth struct{}
+// Require returns a middleware that lets a request through only if its
+// access token belongs to a user whose role has permission. The role is
+// read from the saved user, so a new role takes effect right away.
+// Requests with an API key instead need a key that has permission.
+// Who the request is made by is passed on in its context, see PrincipalOf
+func Require(permission string) negroni.Handler {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		t := time.Now()
+		principal, ok := identify(permission, w, r)
+		if !ok {
+			return
+		}
+		next(w, r.WithContext(NewContext(r.Context(), principal)))
+		fmt.Printf("Execution time: %s \n", time.Now().Sub(t).String())
+	})
+}
 
-func (*Auth) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	t := time.Now()
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte("Need Bearer authorization! Generate token using your username and password here: http://localhost:<port>/api/login\n"))
-		return
-	}
-	token, err := jwt.Parse(strings.Split(authHeader, " ")[1], func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.App().Key), nil
+// Identify returns a middleware for public endpoints. Requests without
+// a token or an API key go through anonymously, the others have to be
+// valid, and have their principal passed on like with Require
+func Identify() negroni.Handler {
+	return negroni.HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if BearerToken(r) == "" && r.Header.Get(APIKeyHeader) == "" {
+			next(w, r)
+			return
+		}
+		principal, ok := identify("", w, r)
+		if !ok {
+			return
+		}
+		next(w, r.WithContext(NewContext(r.Context(), principal)))
 	})
+}
+
+// identify returns who r is made by, checking that they have permission
+// unless it is empty. If they can't be let through, it responds and returns false
+func identify(permission string, w http.ResponseWriter, r *http.Request) (Principal, bool) {
+	if r.Header.Get(APIKeyHeader) != "" {
+		return identifyAPIKey(permission, w, r)
+	}
+	claimMap, ok := authenticate(w, r)
+	if !ok {
+		return Principal{}, false
+	}
+
+	username, _ := claimMap[UsernameKey].(string)
+	user, err := db.Users().Get(username)
 	if err != nil {
+		if err == db.ErrNotFound {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("user doesn't exist"))
+			return Principal{}, false
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return Principal{}, false
+	}
+	if user.UserData.Disabled {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(ErrAccountDisabled.Error()))
+		return Principal{}, false
 	}
 
-	if !token.Valid {
+	role := user.Role()
+	principal := Principal{Username: user.Username, Role: role}
+	principal.TokenID, _ = claimMap[TokenIDKey].(string)
+	if permission == "" {
+		return principal, true
+	}
+	if !config.HasPermission(role, permission) {
 		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte("token not valid"))
-		return
+		_, _ = w.Write([]byte(fmt.Sprintf("role %s is not allowed %s", role, permission)))
+		return Principal{}, false
 	}
-	claimMap := token.Claims.(jwt.MapClaims)
-	for key, value := range claimMap {
-		r.Header.Add(key, fmt.Sprintf("%v", value))
+	// roles that have to use two-factor login can only enrol until they do.
+	// The identity provider takes care of it for users who login there
+	if permission != config.PermProfile && config.Auth().RequiresTwoFactor(role) &&
+		!user.HasTwoFactor() && !user.IsExternal() {
+		http.Error(w, fmt.Sprintf("role %s has to turn on two-factor login first", role), http.StatusForbidden)
+		return Principal{}, false
 	}
-	next(w, r)
-	fmt.Printf("Execution time: %s \n", time.Now().Sub(t).String())
+	return principal, true
 }
 
-type Admin struct{}
-
-func (*Admin) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	t := time.Now()
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
+// authenticate returns the claims of the access token of r.
+// If there is no valid one, it responds and returns false
+func authenticate(w http.ResponseWriter, r *http.Request) (jwt.MapClaims, bool) {
+	tokenString := BearerToken(r)
+	if tokenString == "" {
 		w.WriteHeader(http.StatusUnauthorized)
 		_, _ = w.Write([]byte("Need Bearer authorization! Generate token using your username and password here: http://localhost:<port>/api/login\n"))
-		return
+		return nil, false
 	}
-	token, err := jwt.Parse(strings.Split(authHeader, " ")[1], func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.App().Key), nil
-	})
+
+	claimMap, err := ParseToken(tokenString, AccessToken)
 	if err != nil {
+		if _, ok := err.(*jwt.ValidationError); ok || err == ErrTokenRevoked || err == ErrWrongTokenType {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("token not valid: " + err.Error()))
+			return nil, false
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte("token not valid"))
-		return
-	}
-	claimMap := token.Claims.(jwt.MapClaims)
-
-	if claimMap[AdminKey] == false {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte("token not valid for administrative work"))
-		return
-	}
-	for key, value := range claimMap {
-		r.Header.Add(key, fmt.Sprintf("%v", value))
+		return nil, false
 	}
-	next(w, r)
-	fmt.Printf("Execution time: %s \n", time.Now().Sub(t).String())
+	return claimMap, true
 }
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"evl-book-server/config"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+// signingKey is a key tokens are verified with, and signed
+// with if its private half is known
+type signingKey struct {
+	id         string
+	method     jwt.SigningMethod
+	privateKey interface{}
+	publicKey  interface{}
+}
+
+// devKeyDir is where keys for development are kept. The keys in it
+// may be shared with anyone who has the repository, so they are
+// refused outside of development
+const devKeyDir = "keys"
+
+var (
+	keyRing map[string]signingKey
+	// signer signs new tokens, it is nil when the HS256 secret is used
+	signer *signingKey
+)
+
+// JWK is a public key in the JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// LoadKeys reads the signing keys set in the config file
+func LoadKeys() error {
+	authCfg := config.Auth()
+	ring := map[string]signingKey{}
+	for _, keyCfg := range authCfg.Keys {
+		if keyCfg.ID == "" {
+			return fmt.Errorf("key %s has no kid", keyCfg.File)
+		}
+		if _, ok := ring[keyCfg.ID]; ok {
+			return fmt.Errorf("kid %s is used by more than one key", keyCfg.ID)
+		}
+		if config.App().Env != "development" && inDevKeyDir(keyCfg.File) {
+			return fmt.Errorf("key %s is in %s/, which is only for development, not %s", keyCfg.ID, devKeyDir, config.App().Env)
+		}
+		key, err := readKey(keyCfg)
+		if err != nil {
+			return err
+		}
+		ring[keyCfg.ID] = key
+	}
+
+	var signingKeyRef *signingKey
+	if len(ring) > 0 {
+		key, ok := ring[authCfg.SigningKeyID]
+		if !ok {
+			return fmt.Errorf("signing_kid %q is not one of the keys", authCfg.SigningKeyID)
+		}
+		if key.privateKey == nil {
+			return fmt.Errorf("key %s can't sign, it has no private key", key.id)
+		}
+		signingKeyRef = &key
+	}
+	keyRing = ring
+	signer = signingKeyRef
+	return nil
+}
+
+// inDevKeyDir tells if the file is in the development key directory
+func inDevKeyDir(file string) bool {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return true
+	}
+	dir, err := filepath.Abs(devKeyDir)
+	if err != nil {
+		return true
+	}
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+func readKey(keyCfg config.KeyConfig) (signingKey, error) {
+	pemBytes, err := ioutil.ReadFile(keyCfg.File)
+	if err != nil {
+		return signingKey{}, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return signingKey{}, fmt.Errorf("%s is not a PEM file", keyCfg.File)
+	}
+
+	key := signingKey{id: keyCfg.ID}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key.privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key.privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key.publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return signingKey{}, fmt.Errorf("%s: %s", keyCfg.File, err.Error())
+	}
+
+	switch privateKey := key.privateKey.(type) {
+	case *rsa.PrivateKey:
+		key.publicKey = &privateKey.PublicKey
+	case ed25519.PrivateKey:
+		key.publicKey = privateKey.Public()
+	}
+	switch key.publicKey.(type) {
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = SigningMethodEdDSA
+	default:
+		return signingKey{}, fmt.Errorf("%s: only RSA and Ed25519 keys are supported", keyCfg.File)
+	}
+	return key, nil
+}
+
+// newSignedToken returns a token signed with the signing key, with its kid in the header
+func newSignedToken(claims jwt.MapClaims) (string, error) {
+	if signer == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.App().Key))
+	}
+	token := jwt.NewWithClaims(signer.method, claims)
+	token.Header["kid"] = signer.id
+	return token.SignedString(signer.privateKey)
+}
+
+// verificationKey picks the key a token is verified with by its kid
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	if len(keyRing) == 0 {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return []byte(config.App().Key), nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := keyRing[kid]
+	if !ok {
+		return nil, errors.New("token is signed with an unknown key")
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	return key.publicKey, nil
+}
+
+// JWKS returns the public keys tokens are verified with, so that
+// other services can verify tokens without sharing any secret
+func JWKS() []JWK {
+	keys := make([]JWK, 0, len(keyRing))
+	for _, key := range keyRing {
+		keys = append(keys, NewJWK(key.id, key.publicKey))
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].KeyID < keys[j].KeyID })
+	return keys
+}
+
+// NewJWK returns the JWK of an RSA or Ed25519 public key
+func NewJWK(kid string, publicKey interface{}) JWK {
+	jwk := JWK{KeyID: kid, Use: "sig"}
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.Algorithm = jwt.SigningMethodRS256.Alg()
+		jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Algorithm = SigningMethodEdDSA.Alg()
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+	}
+	return jwk
+}
+
+// PublicKey returns the RSA or Ed25519 public key of k,
+// along with the signing method tokens signed by it use
+func (k JWK) PublicKey() (interface{}, jwt.SigningMethod, error) {
+	switch {
+	case k.KeyType == "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, nil, fmt.Errorf("key %s: %s", k.KeyID, err.Error())
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, nil, fmt.Errorf("key %s: %s", k.KeyID, err.Error())
+		}
+		publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return publicKey, jwt.SigningMethodRS256, nil
+	case k.KeyType == "OKP" && k.Curve == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, nil, fmt.Errorf("key %s is not a valid Ed25519 key", k.KeyID)
+		}
+		return ed25519.PublicKey(x), SigningMethodEdDSA, nil
+	default:
+		return nil, nil, fmt.Errorf("key %s: only RSA and Ed25519 keys are supported", k.KeyID)
+	}
+}
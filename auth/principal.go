@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"context"
+	"evl-book-server/config"
+	"net/http"
+)
+
+// Principal is who a request is made by, as authenticated by the middleware.
+// Handlers get it from the request context, never from request headers,
+// which clients can set to anything
+type Principal struct {
+	Username string
+	Role     string
+	// TokenID is the jti of the access token of the request
+	TokenID string
+	// APIKeyID is set instead for the service accounts that use API keys
+	APIKeyID string
+}
+
+type principalKey struct{}
+
+// IsAdmin tells if the principal has the admin role
+func (p Principal) IsAdmin() bool {
+	return p.Role == config.RoleAdmin
+}
+
+// IsService tells if the principal is a service account
+func (p Principal) IsService() bool {
+	return p.APIKeyID != ""
+}
+
+// NewContext returns a copy of ctx carrying principal
+func NewContext(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext returns the principal carried by ctx, if any
+func FromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// PrincipalOf returns who r is made by. Requests that went through
+// no middleware, or were made anonymously, get the zero Principal
+func PrincipalOf(r *http.Request) Principal {
+	principal, _ := FromContext(r.Context())
+	return principal
+}
@@ -1,10 +1,16 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"evl-book-server/config"
+	"evl-book-server/db"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 )
 
@@ -13,29 +19,183 @@ const (
 	UsernameKey   = "username"
 	ExpirationKey = "exp"
 	AdminKey      = "admin"
+	RoleKey       = "role"
+	TokenIDKey    = "jti"
+	IssuedAtKey   = "iat"
+	TokenTypeKey  = "token_type"
 )
 
-func GenerateJWT(user config.UserCredentials) (string, error) {
-	appCfg := config.App()
-	if appCfg.Key == "" {
+// Types of tokens. Access tokens authorize requests,
+// refresh tokens only get new tokens from /api/token/refresh,
+// and password reset tokens set a new password once
+const (
+	AccessToken        = "access"
+	RefreshToken       = "refresh"
+	PasswordResetToken = "password_reset"
+)
+
+var (
+	ErrTokenRevoked    = errors.New("token has been revoked")
+	ErrWrongTokenType  = errors.New("wrong type of token")
+	ErrAccountDisabled = errors.New("account is disabled")
+)
+
+// Tokens is what a user gets on login, and on refresh
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	// ExpiresIn is the number of seconds the access token is valid for
+	ExpiresIn int `json:"expires_in"`
+}
+
+// IssueTokens hands out a new access token and refresh token to user
+func IssueTokens(user config.UserCredentials) (Tokens, error) {
+	authCfg := config.Auth()
+	accessToken, err := generateToken(user, AccessToken, authCfg.AccessTokenTTL)
+	if err != nil {
+		return Tokens{}, err
+	}
+	refreshToken, err := generateToken(user, RefreshToken, authCfg.RefreshTokenTTL)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(authCfg.AccessTokenTTL / time.Second),
+	}, nil
+}
+
+func generateToken(user config.UserCredentials, tokenType string, ttl time.Duration) (string, error) {
+	if signer == nil && config.App().Key == "" {
 		log.Panicln("Server needs a key to generate tokens")
 	}
-	var mySigningKey = []byte(appCfg.Key)
-	token := jwt.New(jwt.SigningMethodHS256)
 
-	claims := token.Claims.(jwt.MapClaims)
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	claims := jwt.MapClaims{}
 
 	claims[AuthorizedKey] = true
 	claims[UsernameKey] = user.Username
 	claims[AdminKey] = user.UserData.IsAdmin
-	claims[ExpirationKey] = time.Now().Add(time.Minute * 30).Unix()
+	claims[RoleKey] = user.Role()
+	claims[TokenIDKey] = tokenID
+	claims[TokenTypeKey] = tokenType
+	claims[IssuedAtKey] = now.Unix()
+	claims[ExpirationKey] = expiresAt.Unix()
 
-	tokenString, err := token.SignedString(mySigningKey)
+	tokenString, err := newSignedToken(claims)
 
 	if err != nil {
 		_ = fmt.Errorf("something went wrong: %s", err.Error())
 		return "", err
 	}
 
+	// remembered, so that every token of the user can be revoked at once
+	if err := db.Tokens().Issue(user.Username, tokenID, expiresAt); err != nil {
+		return "", err
+	}
 	return tokenString, nil
 }
+
+// ParseToken verifies the signature, expiry and type of a token,
+// and checks that it hasn't been revoked
+func ParseToken(tokenString, tokenType string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, verificationKey)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("token not valid")
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if claims[TokenTypeKey] != tokenType {
+		return nil, ErrWrongTokenType
+	}
+	tokenID, _ := claims[TokenIDKey].(string)
+	if tokenID == "" {
+		return nil, ErrTokenRevoked
+	}
+	revoked, err := db.Tokens().IsRevoked(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// IssuePasswordResetToken hands out a token that lets
+// user set a new password without knowing the old one
+func IssuePasswordResetToken(user config.UserCredentials) (string, error) {
+	return generateToken(user, PasswordResetToken, config.Auth().PasswordResetTTL)
+}
+
+// ConsumeToken parses a token that works only once, and revokes it.
+// Of concurrent requests with the same token, only one gets its claims
+func ConsumeToken(tokenString, tokenType string) (jwt.MapClaims, error) {
+	claims, err := ParseToken(tokenString, tokenType)
+	if err != nil {
+		return nil, err
+	}
+	tokenID, _ := claims[TokenIDKey].(string)
+	expiresAt, _ := claims[ExpirationKey].(float64)
+	revoked, err := db.Tokens().RevokeOnce(tokenID, time.Unix(int64(expiresAt), 0))
+	if err != nil {
+		return nil, err
+	}
+	if !revoked {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// RevokeToken puts the token on the denylist until it expires
+func RevokeToken(claims jwt.MapClaims) error {
+	tokenID, _ := claims[TokenIDKey].(string)
+	expiresAt, _ := claims[ExpirationKey].(float64)
+	return db.Tokens().Revoke(tokenID, time.Unix(int64(expiresAt), 0))
+}
+
+// RefreshTokens exchanges a refresh token for a new pair of tokens.
+// The refresh token can only be used once, it is revoked before
+// the user is looked up so concurrent refreshes can't both succeed.
+func RefreshTokens(refreshToken string) (Tokens, error) {
+	claims, err := ConsumeToken(refreshToken, RefreshToken)
+	if err != nil {
+		return Tokens{}, err
+	}
+	username, _ := claims[UsernameKey].(string)
+	user, err := db.Users().Get(username)
+	if err != nil {
+		return Tokens{}, err
+	}
+	if user.UserData.Disabled {
+		return Tokens{}, ErrAccountDisabled
+	}
+	return IssueTokens(user)
+}
+
+// BearerToken returns the token of the Authorization header of r
+func BearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ed25519"
+)
+
+const rsaKeyBits = 2048
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen <file>",
+	Short: "generates a PEM encoded key to sign tokens with",
+	Args:  cobra.ExactArgs(1),
+	RunE:  keygen,
+}
+
+func init() {
+	keygenCmd.Flags().String("alg", "EdDSA", "signing algorithm of the key, EdDSA or RS256")
+	rootCmd.AddCommand(keygenCmd)
+}
+
+func keygen(cmd *cobra.Command, args []string) error {
+	alg, err := cmd.Flags().GetString("alg")
+	if err != nil {
+		return err
+	}
+
+	var privateKey interface{}
+	switch alg {
+	case "EdDSA":
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	case "RS256":
+		privateKey, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(args[0], pemBytes, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s key to %s, add it to the [auth] keys of config.toml\n", alg, args[0])
+	return nil
+}
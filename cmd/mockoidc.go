@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"evl-book-server/config"
+	"evl-book-server/oidc"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/spf13/cobra"
+)
+
+var mockOIDCCmd = &cobra.Command{
+	Use:   "mock-oidc",
+	Short: "runs a mock OpenID Connect provider at the issuer of the config file, for development",
+	RunE:  mockOIDC,
+}
+
+func init() {
+	mockOIDCCmd.Flags().String("username", "staff", "preferred_username of the user that logs in")
+	mockOIDCCmd.Flags().String("email", "staff@example.com", "email of the user that logs in")
+	mockOIDCCmd.Flags().StringSlice("groups", []string{"library-staff"}, "groups of the user that logs in")
+	rootCmd.AddCommand(mockOIDCCmd)
+}
+
+func mockOIDC(cmd *cobra.Command, _ []string) error {
+	oidcCfg := config.OIDC()
+	issuer, err := url.Parse(oidcCfg.Issuer)
+	if err != nil || issuer.Host == "" {
+		return fmt.Errorf("oidc.issuer %q is not a URL", oidcCfg.Issuer)
+	}
+	username, _ := cmd.Flags().GetString("username")
+	email, _ := cmd.Flags().GetString("email")
+	groups, _ := cmd.Flags().GetStringSlice("groups")
+
+	provider, err := oidc.NewMockProvider(oidcCfg.Issuer, oidcCfg.ClientID, oidcCfg.ClientSecret)
+	if err != nil {
+		return err
+	}
+	provider.SetClaims(map[string]interface{}{
+		"preferred_username": username,
+		"email":              email,
+		"groups":             groups,
+	})
+
+	fmt.Printf("mock provider of %s logs in %s, groups %v\n", oidcCfg.Issuer, username, groups)
+	return http.ListenAndServe(issuer.Host, provider)
+}
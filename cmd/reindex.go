@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"evl-book-server/routes"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var reindexCmd = &cobra.Command{
+	Use:   "reindex",
+	Short: "rebuilds the search index of the catalogue from scratch",
+	Args:  cobra.NoArgs,
+	RunE:  reindex,
+}
+
+func init() {
+	rootCmd.AddCommand(reindexCmd)
+}
+
+func reindex(_ *cobra.Command, _ []string) error {
+	indexed, err := routes.RebuildSearchIndex()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("indexed %d books and authors\n", indexed)
+	return nil
+}
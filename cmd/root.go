@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"evl-book-server/db"
+	"evl-book-server/notify"
 	"github.com/spf13/cobra"
 	"log"
 )
@@ -15,7 +16,8 @@ var (
 
 // Execute executes the root command of the evl-book-server
 func Execute() {
-	db.InitRedis()
+	db.InitStore()
+	notify.Init()
 	db.AddDefaultAdmin()
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err.Error())
@@ -52,56 +52,12 @@ var serveCmd = &cobra.Command{
 
 // serves the server
 func serve(_ *cobra.Command, _ []string) {
-	if !db.IsRedisUp() {
-		logger.Println("redis server is down")
+	if !db.IsStoreUp() {
+		logger.Println("storage backend is down")
+	}
+	if err := auth.LoadKeys(); err != nil {
+		logger.Fatalln("failed to load the signing keys:", err)
 	}
-
-	var router = mux.NewRouter().StrictSlash(true)
-	router.Methods("GET").Path("/").HandlerFunc(routes.HomePageHandler)
-
-	api := router.PathPrefix("/api").Subrouter().StrictSlash(true)
-	api.HandleFunc("/login", routes.LoginHandler)
-	api.HandleFunc("/signup", routes.AddUserHandler)
-	api.HandleFunc("/validate/username/{username}", routes.ValidateUser)
-
-	// api endpoints that goes through user auth middleware.
-	// the user auth middleware uses token to authorize requests
-	userAuthMW := negroni.New()
-	userAuthMW.Use(&auth.Auth{})
-	api.Handle("/update-profile", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.UpdateInfoHandler))))
-	api.Handle("/books", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetAllBooksHandler))))
-	api.Handle("/book/{id}", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetBookHandler))))
-	api.Handle("/authors", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetAllAuthorsHandler))))
-	api.Handle("/author/{id}", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetAuthorHandler))))
-	api.Handle("/upload", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.UploadPostedImageHandler))))
-	api.Handle("/upload/finalize", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.ImageUploadHandler))))
-
-	api.Handle("/loan/request/{book_id}", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.CreateLoanRequestHandler))))
-	api.Handle("/loans", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetAllLoansForThisUserHandler))))
-	api.Handle("/loan/{id}", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetLoanByIDForThisUserHandler))))
-	api.Handle("/loans/pending", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetAllPendingLoansForThisUserHandler))))
-	api.Handle("/loans/active", userAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetAllActiveLoansForThisUserHandler))))
-
-	// api endpoints that goes through admin auth middleware.
-	// admin auth middleware uses token to authorize requests
-	adminAuthMW := negroni.New()
-	adminAuthMW.Use(&auth.Admin{})
-	adminApi := router.PathPrefix("/api/admin").Subrouter().StrictSlash(true)
-	adminApi.Handle("/book/create", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.BookCreateHandler))))
-	adminApi.Handle("/book/update", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.BookUpdateHandler))))
-	adminApi.Handle("/book/delete/{id}", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.BookDeleteHandler))))
-
-	adminApi.Handle("/author/create", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.AuthorCreateHandler))))
-	adminApi.Handle("/author/update", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.AuthorUpdateHandler))))
-	adminApi.Handle("/author/delete/{id}", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.AuthorDeleteHandler))))
-
-	adminApi.Handle("/loans", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetAllLoansHandler))))
-	adminApi.Handle("/loan/{id}", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetLoanByIDHandler))))
-	adminApi.Handle("/loans/pending", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetAllPendingLoansHandler))))
-	adminApi.Handle("/loans/active", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.GetAllActiveLoansHandler))))
-	adminApi.Handle("/loans/approve/{id}", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.ApproveLoanRequestHandler))))
-	adminApi.Handle("/loans/decline/{id}", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.DeclineLoanRequestHandler))))
-	adminApi.Handle("/loans/returned/{id}", adminAuthMW.With(negroni.Wrap(http.HandlerFunc(routes.ReturnedBookHandler))))
 
 	appCfg := config.App()
 
@@ -110,7 +66,7 @@ func serve(_ *cobra.Command, _ []string) {
 		WriteTimeout: appCfg.WriteTimeout,
 		IdleTimeout:  appCfg.IdleTimeout,
 		Addr:         fmt.Sprintf(":%d", viper.GetInt("app.port")),
-		Handler:      router,
+		Handler:      NewRouter(),
 	}
 
 	stop := make(chan os.Signal, 1)
@@ -135,3 +91,104 @@ func serve(_ *cobra.Command, _ []string) {
 
 	logger.Info("Server shutdowns gracefully")
 }
+
+// NewRouter sets up the endpoints of the server
+func NewRouter() http.Handler {
+	var router = mux.NewRouter().StrictSlash(true)
+	router.Methods("GET").Path("/").Handler(negroni.New(auth.Identify(), negroni.WrapFunc(routes.HomePageHandler)))
+	router.Methods("GET").Path("/.well-known/jwks.json").HandlerFunc(routes.JWKSHandler)
+
+	api := router.PathPrefix("/api").Subrouter().StrictSlash(true)
+	api.HandleFunc("/login", routes.LoginHandler)
+	api.HandleFunc("/token/refresh", routes.RefreshTokenHandler)
+	api.HandleFunc("/signup", routes.AddUserHandler)
+	api.HandleFunc("/password/forgot", routes.ForgotPasswordHandler)
+	api.HandleFunc("/password/reset", routes.ResetPasswordWithTokenHandler)
+	api.HandleFunc("/oidc/login", routes.OIDCLoginHandler)
+	api.HandleFunc("/oidc/callback", routes.OIDCCallbackHandler)
+	api.HandleFunc("/validate/username/{username}", routes.ValidateUser)
+
+	// api endpoints that need a token. each one is only let through
+	// if the role of the user has the permission it is protected by
+	protect := func(permission string, handler http.HandlerFunc) http.Handler {
+		return negroni.New(auth.Require(permission), negroni.Wrap(handler))
+	}
+	api.Handle("/logout", protect(config.PermProfile, routes.LogoutHandler))
+	api.Handle("/update-profile", protect(config.PermProfile, routes.UpdateInfoHandler))
+	api.Handle("/2fa/enrol", protect(config.PermProfile, routes.EnrolTwoFactorHandler))
+	api.Handle("/2fa/confirm", protect(config.PermProfile, routes.ConfirmTwoFactorHandler))
+	api.Handle("/2fa/recovery-codes", protect(config.PermProfile, routes.RegenerateRecoveryCodesHandler))
+	api.Handle("/2fa/disable", protect(config.PermProfile, routes.DisableTwoFactorHandler))
+	api.Handle("/books", protect(config.PermBrowse, routes.GetAllBooksHandler))
+	api.Handle("/book/{id}", protect(config.PermBrowse, routes.GetBookHandler))
+	api.Handle("/book/{id}/items", protect(config.PermBrowse, routes.GetBookItemsHandler))
+	api.Handle("/item/{barcode}", protect(config.PermBrowse, routes.GetItemByBarcodeHandler))
+	api.Handle("/authors", protect(config.PermBrowse, routes.GetAllAuthorsHandler))
+	api.Handle("/author/{id}", protect(config.PermBrowse, routes.GetAuthorHandler))
+	api.Handle("/author/{id}/works", protect(config.PermBrowse, routes.GetAuthorWorksHandler))
+	api.Handle("/search", protect(config.PermBrowse, routes.SearchHandler))
+	api.Handle("/upload", protect(config.PermProfile, routes.UploadPostedImageHandler))
+	api.Handle("/upload/finalize", protect(config.PermProfile, routes.ImageUploadHandler))
+
+	api.Handle("/loan/request/{book_id}", protect(config.PermBorrow, routes.CreateLoanRequestHandler))
+	api.Handle("/loan/cancel/{id}", protect(config.PermBorrow, routes.CancelLoanRequestHandler))
+	api.Handle("/loan/renew/{id}", protect(config.PermBorrow, routes.RenewLoanHandler))
+	api.Handle("/loans", protect(config.PermBorrow, routes.GetAllLoansForThisUserHandler))
+	api.Handle("/loan/{id}", protect(config.PermBorrow, routes.GetLoanByIDForThisUserHandler))
+	api.Handle("/loans/pending", protect(config.PermBorrow, routes.GetAllPendingLoansForThisUserHandler))
+	api.Handle("/loans/active", protect(config.PermBorrow, routes.GetAllActiveLoansForThisUserHandler))
+	api.Handle("/loans/history", protect(config.PermBorrow, routes.GetLoanHistoryForThisUserHandler))
+
+	api.Handle("/hold/request/{book_id}", protect(config.PermBorrow, routes.PlaceHoldHandler))
+	api.Handle("/hold/cancel/{book_id}", protect(config.PermBorrow, routes.CancelHoldHandler))
+	api.Handle("/holds", protect(config.PermBorrow, routes.GetAllHoldsForThisUserHandler))
+	api.Handle("/fines", protect(config.PermBorrow, routes.GetFinesForThisUserHandler))
+
+	// staff endpoints
+	adminApi := router.PathPrefix("/api/admin").Subrouter().StrictSlash(true)
+	adminApi.Handle("/book/create", protect(config.PermEditCatalogue, routes.BookCreateHandler))
+	adminApi.Handle("/book/update", protect(config.PermEditCatalogue, routes.BookUpdateHandler))
+	adminApi.Handle("/book/delete/{id}", protect(config.PermEditCatalogue, routes.BookDeleteHandler))
+	adminApi.Handle("/book/{id}/history", protect(config.PermViewLoans, routes.GetBookLoanHistoryHandler))
+	adminApi.Handle("/book/{id}/items/add", protect(config.PermEditCatalogue, routes.AddItemHandler))
+	adminApi.Handle("/items/{id}/retire", protect(config.PermEditCatalogue, routes.RetireItemHandler))
+	adminApi.Handle("/items/{id}/relocate", protect(config.PermEditCatalogue, routes.RelocateItemHandler))
+	adminApi.Handle("/items/{id}/condition", protect(config.PermEditCatalogue, routes.SetItemConditionHandler))
+
+	adminApi.Handle("/author/create", protect(config.PermEditCatalogue, routes.AuthorCreateHandler))
+	adminApi.Handle("/author/update", protect(config.PermEditCatalogue, routes.AuthorUpdateHandler))
+	adminApi.Handle("/author/delete/{id}", protect(config.PermEditCatalogue, routes.AuthorDeleteHandler))
+
+	adminApi.Handle("/loans", protect(config.PermViewLoans, routes.GetAllLoansHandler))
+	adminApi.Handle("/loan/{id}", protect(config.PermViewLoans, routes.GetLoanByIDHandler))
+	adminApi.Handle("/loans/pending", protect(config.PermViewLoans, routes.GetAllPendingLoansHandler))
+	adminApi.Handle("/loans/active", protect(config.PermViewLoans, routes.GetAllActiveLoansHandler))
+	adminApi.Handle("/loans/overdue", protect(config.PermViewLoans, routes.GetOverdueLoansHandler))
+	adminApi.Handle("/loans/approve/{id}", protect(config.PermManageLoans, routes.ApproveLoanRequestHandler))
+	adminApi.Handle("/loans/decline/{id}", protect(config.PermManageLoans, routes.DeclineLoanRequestHandler))
+	adminApi.Handle("/loans/checkout/{id}", protect(config.PermManageLoans, routes.CheckOutLoanHandler))
+	adminApi.Handle("/loans/returned/{id}", protect(config.PermManageLoans, routes.ReturnedBookHandler))
+	adminApi.Handle("/loans/lost/{id}", protect(config.PermManageLoans, routes.LostLoanHandler))
+	adminApi.Handle("/holds/{book_id}", protect(config.PermViewLoans, routes.GetBookHoldsHandler))
+	adminApi.Handle("/fines/{username}", protect(config.PermViewFines, routes.GetUserFinesHandler))
+	adminApi.Handle("/fines/{username}/payment", protect(config.PermManageFines, routes.RecordFinePaymentHandler))
+	adminApi.Handle("/fines/{username}/waiver", protect(config.PermManageFines, routes.WaiveFineHandler))
+
+	adminApi.Handle("/roles", protect(config.PermManageUsers, routes.GetRolesHandler))
+	adminApi.Handle("/users", protect(config.PermManageUsers, routes.GetUsersHandler))
+	adminApi.Handle("/users/{username}", protect(config.PermManageUsers, routes.GetUserHandler))
+	adminApi.Handle("/users/{username}/role", protect(config.PermManageUsers, routes.AssignRoleHandler))
+	adminApi.Handle("/users/{username}/promote", protect(config.PermManageUsers, routes.PromoteUserHandler))
+	adminApi.Handle("/users/{username}/disable", protect(config.PermManageUsers, routes.DisableUserHandler))
+	adminApi.Handle("/users/{username}/enable", protect(config.PermManageUsers, routes.EnableUserHandler))
+	adminApi.Handle("/users/{username}/unlock", protect(config.PermManageUsers, routes.UnlockUserHandler))
+	adminApi.Handle("/users/{username}/reset-2fa", protect(config.PermManageUsers, routes.ResetTwoFactorHandler))
+	adminApi.Handle("/users/{username}/reset-password", protect(config.PermManageUsers, routes.ResetPasswordHandler))
+	adminApi.Handle("/users/{username}/delete", protect(config.PermManageUsers, routes.DeleteUserHandler))
+	adminApi.Handle("/audit", protect(config.PermViewAudit, routes.GetAuditLogHandler))
+	adminApi.Handle("/apikeys", protect(config.PermManageUsers, routes.GetAPIKeysHandler))
+	adminApi.Handle("/apikeys/create", protect(config.PermManageUsers, routes.CreateAPIKeyHandler))
+	adminApi.Handle("/apikeys/{id}/revoke", protect(config.PermManageUsers, routes.RevokeAPIKeyHandler))
+
+	return router
+}
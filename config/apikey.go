@@ -0,0 +1,31 @@
+package config
+
+import "time"
+
+// APIKey lets a service account, such as a kiosk or a reporting script,
+// make requests without logging in. Only the hash of the key is kept
+type APIKey struct {
+	ID          string     `json:"key_id"`
+	Name        string     `json:"name"`
+	Hash        string     `json:"hash,omitempty"`
+	Permissions []string   `json:"permissions"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+}
+
+// IsExpired tells if the key no longer works at now
+func (k APIKey) IsExpired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// Allows tells if the key has permission
+func (k APIKey) Allows(permission string) bool {
+	for _, keyPermission := range k.Permissions {
+		if keyPermission == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package config
+
+import "time"
+
+// Kinds of audit log entries
+const (
+	AuditAccountLocked   = "account_locked"
+	AuditAccountUnlocked = "account_unlocked"
+	AuditIPLocked        = "ip_locked"
+	// two-factor login being turned on and off by the user, or reset by admin
+	AuditTwoFactorEnabled  = "two_factor_enabled"
+	AuditTwoFactorDisabled = "two_factor_disabled"
+	AuditTwoFactorReset    = "two_factor_reset"
+	// a forgotten password being reset with a token sent to the user
+	AuditPasswordReset = "password_reset"
+	// API keys being created and revoked by admin
+	AuditAPIKeyCreated = "api_key_created"
+	AuditAPIKeyRevoked = "api_key_revoked"
+)
+
+// AuditEntry records a security relevant event. Actor is
+// the user who caused it, empty when the server did
+type AuditEntry struct {
+	ID        int    `json:"audit_id"`
+	Kind      string `json:"kind"`
+	Username  string `json:"username,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Actor     string `json:"actor,omitempty"`
+	Note      string `json:"note,omitempty"`
+	CreatedAt time.Time
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultAccessTokenMinutes = 30
+	defaultRefreshTokenHours  = 7 * 24
+	defaultTwoFactorIssuer    = "evl-book-server"
+	defaultPasswordResetMins  = 15
+)
+
+// AuthConfig represents how tokens are signed,
+// and how long the ones handed out on login stay valid
+type AuthConfig struct {
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// PasswordResetTTL is how long a password reset token can be used
+	PasswordResetTTL time.Duration
+	// SigningKeyID is the kid of the key new tokens are signed with
+	SigningKeyID string
+	// Keys are the keys tokens are verified with. Without any,
+	// tokens are signed with the HS256 secret app.key
+	Keys []KeyConfig
+	// TwoFactorRoles are the roles that have to enrol in TOTP two-factor
+	// login. Until they do, they only have the profile permission
+	TwoFactorRoles []string
+	// TwoFactorIssuer names the server in authenticator apps
+	TwoFactorIssuer string
+}
+
+// KeyConfig points to a PEM encoded RSA or Ed25519 key. A public key
+// only verifies tokens, e.g. those of a key that has been rotated out.
+type KeyConfig struct {
+	ID   string `mapstructure:"kid"`
+	File string `mapstructure:"file"`
+}
+
+var authCfg AuthConfig
+
+// LoadAuth populates the auth config instance
+func LoadAuth() {
+	accessTokenMinutes := viper.GetInt("auth.access_token_minutes")
+	if accessTokenMinutes <= 0 {
+		accessTokenMinutes = defaultAccessTokenMinutes
+	}
+	refreshTokenHours := viper.GetInt("auth.refresh_token_hours")
+	if refreshTokenHours <= 0 {
+		refreshTokenHours = defaultRefreshTokenHours
+	}
+	keys := []KeyConfig{}
+	if err := viper.UnmarshalKey("auth.keys", &keys); err != nil {
+		log.Fatal("Failed to read the signing keys: ", err.Error())
+	}
+	passwordResetMinutes := viper.GetInt("auth.password_reset_minutes")
+	if passwordResetMinutes <= 0 {
+		passwordResetMinutes = defaultPasswordResetMins
+	}
+	issuer := viper.GetString("auth.two_factor_issuer")
+	if issuer == "" {
+		issuer = defaultTwoFactorIssuer
+	}
+	authCfg = AuthConfig{
+		AccessTokenTTL:   time.Duration(accessTokenMinutes) * time.Minute,
+		RefreshTokenTTL:  time.Duration(refreshTokenHours) * time.Hour,
+		PasswordResetTTL: time.Duration(passwordResetMinutes) * time.Minute,
+		SigningKeyID:     viper.GetString("auth.signing_kid"),
+		Keys:             keys,
+		TwoFactorRoles:   viper.GetStringSlice("auth.two_factor_roles"),
+		TwoFactorIssuer:  issuer,
+	}
+}
+
+// Auth returns the auth config instance
+func Auth() AuthConfig {
+	return authCfg
+}
+
+// RequiresTwoFactor tells if users of role have to enrol in two-factor login
+func (a AuthConfig) RequiresTwoFactor(role string) bool {
+	for _, twoFactorRole := range a.TwoFactorRoles {
+		if twoFactorRole == role {
+			return true
+		}
+	}
+	return false
+}
@@ -1,23 +1,109 @@
 package config
 
+import (
+	"math"
+	"time"
+)
+
 type Book struct {
-	ID          int    `json:"book_id"`
-	BookName    string `json:"book_name"`
-	AuthorID    int    `json:"author_id"`
-	AddCount    int    `json:"add_count"`
-	TotalCount  int
-	OnLoanCount int
+	ID       int    `json:"book_id"`
+	BookName string `json:"book_name"`
+	// AuthorID is the first of the authors among the contributors
+	AuthorID     int            `json:"author_id"`
+	Contributors []Contribution `json:"contributors,omitempty"`
+	// AddCount is the number of copies to add as the book is saved
+	AddCount int `json:"add_count"`
+	// ItemIDs are the copies of the book. The counts are derived from
+	// them: TotalCount the copies in the collection, OnLoanCount those
+	// on loan and LendableCount those that can be lent
+	ItemIDs       []int `json:"item_ids,omitempty"`
+	TotalCount    int
+	OnLoanCount   int
+	LendableCount int
+	BookMetadata
+}
+
+// BookMetadata is the bibliographic record of a book. Fields
+// that are not known are left at their zero value
+type BookMetadata struct {
+	// ISBN is stored as 13 digits, an ISBN-10 is converted
+	ISBN            string `json:"isbn,omitempty"`
+	Publisher       string `json:"publisher,omitempty"`
+	PublicationYear int    `json:"publication_year,omitempty"`
+	Edition         string `json:"edition,omitempty"`
+	// Language is a BCP 47 tag, such as en or pt-BR
+	Language    string   `json:"language,omitempty"`
+	PageCount   int      `json:"page_count,omitempty"`
+	Subjects    []string `json:"subjects,omitempty"`
+	Description string   `json:"description,omitempty"`
+	CoverURL    string   `json:"cover_url,omitempty"`
+}
+
+// Available returns the number of copies of the book that can be lent.
+// Books saved before items existed only count their copies
+func (b Book) Available() int {
+	if len(b.ItemIDs) > 0 {
+		return b.LendableCount
+	}
+	if b.OnLoanCount >= b.TotalCount {
+		return 0
+	}
+	return b.TotalCount - b.OnLoanCount
 }
 
 type Author struct {
-	ID              int    `json:"author_id"`
-	AuthorName      string `json:"author_name"`
+	ID         int    `json:"author_id"`
+	AuthorName string `json:"author_name"`
+	// AuthoredBookIDs are the books of the works in the author role
 	AuthoredBookIDs []int
+	Works           []Work `json:"works,omitempty"`
 }
 
 type Loan struct {
-	ID       int
+	ID           int
+	BookID       int
+	ItemID       int `json:",omitempty"`
+	Username     string
+	Approved     bool
+	Status       string
+	Renewals     int
+	Fine         int `json:",omitempty"`
+	RequestedAt  time.Time
+	ApprovedAt   *time.Time `json:",omitempty"`
+	CheckedOutAt *time.Time `json:",omitempty"`
+	DueAt        *time.Time `json:",omitempty"`
+	DeclinedAt   *time.Time `json:",omitempty"`
+	CancelledAt  *time.Time `json:",omitempty"`
+	ReturnedAt   *time.Time `json:",omitempty"`
+	LostAt       *time.Time `json:",omitempty"`
+}
+
+// Hold is a user's place in the queue of a book that has no copies available
+type Hold struct {
 	BookID   int
 	Username string
-	Approved bool
+	PlacedAt time.Time
+}
+
+// IsOverdue tells if a checked out or renewed loan has passed its due date.
+// A loan that was approved but never picked up can't be overdue
+func (l Loan) IsOverdue(now time.Time) bool {
+	if l.Status != LoanCheckedOut && l.Status != LoanRenewed {
+		return false
+	}
+	return l.DueAt != nil && now.After(*l.DueAt)
+}
+
+// DaysRemaining returns the number of started days left until the loan is due,
+// negative once it is overdue. Loans without a due date have no days remaining.
+func (l Loan) DaysRemaining(now time.Time) int {
+	if l.DueAt == nil {
+		return 0
+	}
+	left := l.DueAt.Sub(now)
+	days := int(math.Ceil(math.Abs(left.Hours()) / 24))
+	if left < 0 {
+		return -days
+	}
+	return days
 }
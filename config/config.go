@@ -10,10 +10,20 @@ func init() {
 	viper.SetConfigName("config")
 	viper.SetConfigType("toml")
 	viper.AddConfigPath(".")
+	// the tests of the packages run in their own directory
+	viper.AddConfigPath("..")
 
 	if err := viper.ReadInConfig(); err != nil {
 		log.Fatal("Failed to read the config file: ", err.Error())
 	}
 
 	LoadApp()
+	LoadAuth()
+	LoadStorage()
+	LoadLending()
+	LoadFines()
+	LoadLoanPolicy()
+	LoadLockout()
+	LoadNotify()
+	LoadOIDC()
 }
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Roles of the contributors of a book. Anyone in the author store can
+// contribute to a book, in one or more of these roles
+const (
+	ContributorAuthor      = "author"
+	ContributorEditor      = "editor"
+	ContributorTranslator  = "translator"
+	ContributorIllustrator = "illustrator"
+)
+
+// ContributorRoles lists the roles in the order they are credited in
+var ContributorRoles = []string{ContributorAuthor, ContributorEditor, ContributorTranslator, ContributorIllustrator}
+
+// Contribution is a contributor of a book, and their role in it
+type Contribution struct {
+	AuthorID int    `json:"author_id"`
+	Role     string `json:"role"`
+}
+
+// Work is a book a contributor worked on, and their role in it
+type Work struct {
+	BookID int    `json:"book_id"`
+	Role   string `json:"role"`
+}
+
+// ContributorRoleError is returned for a role that is not one of ContributorRoles
+type ContributorRoleError struct {
+	Role string
+}
+
+func (e *ContributorRoleError) Error() string {
+	return fmt.Sprintf("contributor role %q is not one of %v", e.Role, ContributorRoles)
+}
+
+// CheckContributorRole returns a *ContributorRoleError if role is not known
+func CheckContributorRole(role string) error {
+	if roleRank(role) == len(ContributorRoles) {
+		return &ContributorRoleError{Role: role}
+	}
+	return nil
+}
+
+// Credits returns the contributors of the book. Books saved
+// before contributors existed only know their author
+func (b Book) Credits() []Contribution {
+	if len(b.Contributors) == 0 && b.AuthorID != 0 {
+		return []Contribution{{AuthorID: b.AuthorID, Role: ContributorAuthor}}
+	}
+	return b.Contributors
+}
+
+// SetContributors replaces the contributors of the book,
+// and makes AuthorID the first of its authors
+func (b *Book) SetContributors(contributors []Contribution) {
+	b.Contributors = contributors
+	b.AuthorID = 0
+	for _, contributor := range contributors {
+		if contributor.Role == ContributorAuthor {
+			b.AuthorID = contributor.AuthorID
+			break
+		}
+	}
+}
+
+// HasContributor reports whether authorID contributed to the book in role
+func (b Book) HasContributor(authorID int, role string) bool {
+	for _, contributor := range b.Credits() {
+		if contributor.AuthorID == authorID && contributor.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Bibliography returns the works of the author, ordered by role
+// and book. Authors saved before works existed only know the
+// books they wrote
+func (a Author) Bibliography() []Work {
+	works := a.Works
+	if len(works) == 0 {
+		for _, bookID := range a.AuthoredBookIDs {
+			works = append(works, Work{BookID: bookID, Role: ContributorAuthor})
+		}
+	}
+	works = append([]Work(nil), works...)
+	sort.Slice(works, func(i, j int) bool {
+		if rankI, rankJ := roleRank(works[i].Role), roleRank(works[j].Role); rankI != rankJ {
+			return rankI < rankJ
+		}
+		return works[i].BookID < works[j].BookID
+	})
+	return works
+}
+
+// AddWork adds a work to the author, unless they already have it
+func (a *Author) AddWork(work Work) {
+	works := a.Bibliography()
+	for _, w := range works {
+		if w == work {
+			return
+		}
+	}
+	a.setWorks(append(works, work))
+}
+
+// RemoveWork removes a work from the author
+func (a *Author) RemoveWork(work Work) {
+	works := []Work{}
+	for _, w := range a.Bibliography() {
+		if w != work {
+			works = append(works, w)
+		}
+	}
+	a.setWorks(works)
+}
+
+// setWorks replaces the works of the author, keeping AuthoredBookIDs in step
+func (a *Author) setWorks(works []Work) {
+	a.Works = nil
+	a.AuthoredBookIDs = nil
+	for _, work := range works {
+		a.Works = append(a.Works, work)
+		if work.Role == ContributorAuthor {
+			a.AuthoredBookIDs = append(a.AuthoredBookIDs, work.BookID)
+		}
+	}
+	a.Works = a.Bibliography()
+	sort.Ints(a.AuthoredBookIDs)
+}
+
+func roleRank(role string) int {
+	for i, r := range ContributorRoles {
+		if r == role {
+			return i
+		}
+	}
+	return len(ContributorRoles)
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Kinds of fines ledger entries. Fines and lost book fees are charged
+// to a user, payments and waivers are credited against them.
+const (
+	LedgerFine    = "fine"
+	LedgerLostFee = "lost_fee"
+	LedgerPayment = "payment"
+	LedgerWaiver  = "waiver"
+)
+
+// FinesConfig represents the fines charged for overdue and lost books.
+// Amounts are in the smallest unit of the currency, e.g. cents.
+type FinesConfig struct {
+	DailyRate      int
+	MaxOverdueFine int
+	LostBookFee    int
+	// BlockLoansOver is the balance above which a user can't request loans,
+	// 0 turns the block off
+	BlockLoansOver int
+}
+
+// BlocksLoans tells if a user who owes balance can't request loans
+func (f FinesConfig) BlocksLoans(balance int) bool {
+	return f.BlockLoansOver > 0 && balance > f.BlockLoansOver
+}
+
+// LedgerEntry is a charge or a credit on a user's fines ledger
+type LedgerEntry struct {
+	ID         int    `json:"entry_id"`
+	Username   string `json:"username"`
+	Kind       string `json:"kind"`
+	Amount     int    `json:"amount"`
+	LoanID     int    `json:"loan_id,omitempty"`
+	Note       string `json:"note,omitempty"`
+	RecordedBy string `json:"recorded_by,omitempty"`
+	CreatedAt  time.Time
+}
+
+var finesCfg FinesConfig
+
+// LoadFines populates the fines config instance
+func LoadFines() {
+	finesCfg = FinesConfig{
+		DailyRate:      viper.GetInt("fines.daily_rate"),
+		MaxOverdueFine: viper.GetInt("fines.max_overdue_fine"),
+		LostBookFee:    viper.GetInt("fines.lost_book_fee"),
+		BlockLoansOver: viper.GetInt("fines.block_loans_over"),
+	}
+}
+
+// Fines returns the fines config instance
+func Fines() FinesConfig {
+	return finesCfg
+}
+
+// OverdueFine returns the fine for a loan closed at closedAt,
+// the daily rate for every started day it is overdue, up to MaxOverdueFine
+func (f FinesConfig) OverdueFine(loan Loan, closedAt time.Time) int {
+	if !loan.IsOverdue(closedAt) {
+		return 0
+	}
+	fine := -loan.DaysRemaining(closedAt) * f.DailyRate
+	if f.MaxOverdueFine > 0 && fine > f.MaxOverdueFine {
+		return f.MaxOverdueFine
+	}
+	return fine
+}
+
+// IsCredit tells if the entry is paid or waived off the balance
+func (e LedgerEntry) IsCredit() bool {
+	return e.Kind == LedgerPayment || e.Kind == LedgerWaiver
+}
+
+// LedgerBalance returns what the owner of ledger owes
+func LedgerBalance(ledger []LedgerEntry) int {
+	balance := 0
+	for _, entry := range ledger {
+		if entry.IsCredit() {
+			balance -= entry.Amount
+		} else {
+			balance += entry.Amount
+		}
+	}
+	return balance
+}
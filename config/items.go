@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// States of an item. An item is available on the shelf or on loan, until
+// it is lost or retired from the collection; those states are final.
+const (
+	ItemAvailable = "available"
+	ItemOnLoan    = "on_loan"
+	ItemLost      = "lost"
+	ItemRetired   = "retired"
+)
+
+// Conditions of an item. Damaged items stay in the collection, but are not lent
+const (
+	ConditionNew     = "new"
+	ConditionGood    = "good"
+	ConditionFair    = "fair"
+	ConditionPoor    = "poor"
+	ConditionDamaged = "damaged"
+)
+
+// ItemConditions lists the conditions from best to worst
+var ItemConditions = []string{ConditionNew, ConditionGood, ConditionFair, ConditionPoor, ConditionDamaged}
+
+// Item is a physical copy of a book
+type Item struct {
+	ID       int    `json:"item_id"`
+	BookID   int    `json:"book_id"`
+	Barcode  string `json:"barcode"`
+	Location string `json:"location,omitempty"`
+	// Condition is one of ItemConditions
+	Condition string `json:"condition"`
+	Status    string `json:"status"`
+	// LoanID is the loan the item is on. Items of loans approved
+	// before items existed are on loan without one
+	LoanID    int        `json:"loan_id,omitempty"`
+	AddedAt   time.Time  `json:"added_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+// IsLendable tells if the item can go out on a loan
+func (i Item) IsLendable() bool {
+	return i.Status == ItemAvailable && i.Condition != ConditionDamaged
+}
+
+// InCollection tells if the item still belongs to the library
+func (i Item) InCollection() bool {
+	return i.Status != ItemLost && i.Status != ItemRetired
+}
+
+// CheckItemCondition returns an error if condition is not one of ItemConditions
+func CheckItemCondition(condition string) error {
+	for _, c := range ItemConditions {
+		if c == condition {
+			return nil
+		}
+	}
+	return fmt.Errorf("condition %q is not one of %v", condition, ItemConditions)
+}
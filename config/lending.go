@@ -0,0 +1,46 @@
+package config
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultLoanPeriodDays = 14
+	defaultMaxRenewals    = 2
+)
+
+// LendingConfig represents the lending rules of the library
+type LendingConfig struct {
+	LoanPeriod  time.Duration
+	MaxRenewals int
+}
+
+var lendingCfg LendingConfig
+
+// LoadLending populates the lending config instance
+func LoadLending() {
+	loanPeriodDays := viper.GetInt("lending.loan_period_days")
+	if loanPeriodDays <= 0 {
+		loanPeriodDays = defaultLoanPeriodDays
+	}
+	maxRenewals := defaultMaxRenewals
+	if viper.IsSet("lending.max_renewals") {
+		maxRenewals = viper.GetInt("lending.max_renewals")
+	}
+	lendingCfg = LendingConfig{
+		LoanPeriod:  time.Duration(loanPeriodDays) * 24 * time.Hour,
+		MaxRenewals: maxRenewals,
+	}
+}
+
+// Lending returns the lending config instance
+func Lending() LendingConfig {
+	return lendingCfg
+}
+
+// LoanPeriodDays returns the loan period in days
+func (l LendingConfig) LoanPeriodDays() int {
+	return int(l.LoanPeriod / (24 * time.Hour))
+}
@@ -0,0 +1,57 @@
+package config
+
+import "github.com/spf13/viper"
+
+// LoanLimits caps the loans a user can have at a time, 0 means no limit
+type LoanLimits struct {
+	MaxActiveLoans     int
+	MaxPendingRequests int
+}
+
+// LoanPolicyConfig represents the rules loan requests are checked against
+type LoanPolicyConfig struct {
+	LoanLimits
+	AllowDuplicateRequests bool
+	// Roles holds the limits of the roles that don't use the default ones
+	Roles map[string]LoanLimits
+}
+
+var loanPolicyCfg LoanPolicyConfig
+
+// LoadLoanPolicy populates the loan policy config instance
+func LoadLoanPolicy() {
+	loanPolicyCfg = LoanPolicyConfig{
+		LoanLimits: LoanLimits{
+			MaxActiveLoans:     viper.GetInt("loan_policy.max_active_loans"),
+			MaxPendingRequests: viper.GetInt("loan_policy.max_pending_requests"),
+		},
+		AllowDuplicateRequests: viper.GetBool("loan_policy.allow_duplicate_requests"),
+		Roles:                  map[string]LoanLimits{},
+	}
+
+	// a role only has to set the limits it changes
+	for role := range viper.GetStringMap("loan_policy.roles") {
+		key := "loan_policy.roles." + role
+		limits := loanPolicyCfg.LoanLimits
+		if viper.IsSet(key + ".max_active_loans") {
+			limits.MaxActiveLoans = viper.GetInt(key + ".max_active_loans")
+		}
+		if viper.IsSet(key + ".max_pending_requests") {
+			limits.MaxPendingRequests = viper.GetInt(key + ".max_pending_requests")
+		}
+		loanPolicyCfg.Roles[role] = limits
+	}
+}
+
+// LoanPolicy returns the loan policy config instance
+func LoanPolicy() LoanPolicyConfig {
+	return loanPolicyCfg
+}
+
+// LimitsFor returns the loan limits of users of role
+func (p LoanPolicyConfig) LimitsFor(role string) LoanLimits {
+	if limits, ok := p.Roles[role]; ok {
+		return limits
+	}
+	return p.LoanLimits
+}
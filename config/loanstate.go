@@ -0,0 +1,65 @@
+package config
+
+import "fmt"
+
+// States of a loan. A loan is requested by a user, approved by admin and
+// checked out when the user picks the book up. It ends up returned, lost,
+// declined by admin or cancelled by the user; those states are final.
+const (
+	LoanRequested  = "requested"
+	LoanApproved   = "approved"
+	LoanCheckedOut = "checked_out"
+	LoanRenewed    = "renewed"
+	LoanReturned   = "returned"
+	LoanLost       = "lost"
+	LoanDeclined   = "declined"
+	LoanCancelled  = "cancelled"
+)
+
+// loanTransitions lists the states a loan can move to from each state
+var loanTransitions = map[string][]string{
+	LoanRequested:  {LoanApproved, LoanDeclined, LoanCancelled},
+	LoanApproved:   {LoanCheckedOut, LoanReturned},
+	LoanCheckedOut: {LoanRenewed, LoanReturned, LoanLost},
+	LoanRenewed:    {LoanRenewed, LoanReturned, LoanLost},
+}
+
+// TransitionError is returned when a loan is asked to make a move
+// that its state machine does not allow
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("loan is %s, it can not be %s", humanLoanState(e.From), humanLoanState(e.To))
+}
+
+// State returns the state of the loan. Loans saved before states
+// existed only know whether they were approved.
+func (l Loan) State() string {
+	if l.Status != "" {
+		return l.Status
+	}
+	if l.Approved {
+		return LoanApproved
+	}
+	return LoanRequested
+}
+
+// CanMoveTo returns a *TransitionError if the loan can not move to state
+func (l Loan) CanMoveTo(state string) error {
+	for _, next := range loanTransitions[l.State()] {
+		if next == state {
+			return nil
+		}
+	}
+	return &TransitionError{From: l.State(), To: state}
+}
+
+func humanLoanState(state string) string {
+	if state == LoanCheckedOut {
+		return "checked out"
+	}
+	return state
+}
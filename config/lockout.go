@@ -0,0 +1,110 @@
+package config
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// LockoutConfig represents the protection of /api/login against guessing
+// passwords. Failed logins are counted per username and per client IP.
+type LockoutConfig struct {
+	// MaxUserFailures and MaxIPFailures are the failed logins in a row
+	// that lock a username or an IP out, 0 turns the lockout off
+	MaxUserFailures int
+	MaxIPFailures   int
+	// FailureWindow is how long a failed login is remembered
+	FailureWindow   time.Duration
+	LockoutDuration time.Duration
+	// after BackoffAfter failed logins in a row, a username has to wait
+	// Backoff before trying again, twice as long after every further
+	// failure, up to MaxBackoff. 0 turns the back-off off
+	BackoffAfter int
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+	// MaxUserResets and MaxIPResets are the password reset requests for
+	// a username and from an IP within FailureWindow, before they are
+	// turned down for LockoutDuration. 0 turns the limit off
+	MaxUserResets int
+	MaxIPResets   int
+}
+
+// LoginAttempts are the recent failed logins of a username or an IP
+type LoginAttempts struct {
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+}
+
+var lockoutCfg LockoutConfig
+
+// lockoutSkew is how far SkipLockoutTime moved the clock of the lockout ahead
+var lockoutSkew int64
+
+// LoadLockout populates the lockout config instance
+func LoadLockout() {
+	lockoutCfg = LockoutConfig{
+		MaxUserFailures: viper.GetInt("lockout.max_user_failures"),
+		MaxIPFailures:   viper.GetInt("lockout.max_ip_failures"),
+		FailureWindow:   time.Duration(viper.GetInt("lockout.failure_window_minutes")) * time.Minute,
+		LockoutDuration: time.Duration(viper.GetInt("lockout.lockout_minutes")) * time.Minute,
+		BackoffAfter:    viper.GetInt("lockout.backoff_after"),
+		Backoff:         time.Duration(viper.GetInt("lockout.backoff_seconds")) * time.Second,
+		MaxBackoff:      time.Duration(viper.GetInt("lockout.max_backoff_seconds")) * time.Second,
+		MaxUserResets:   viper.GetInt("lockout.max_user_resets"),
+		MaxIPResets:     viper.GetInt("lockout.max_ip_resets"),
+	}
+}
+
+// Lockout returns the lockout config instance
+func Lockout() LockoutConfig {
+	return lockoutCfg
+}
+
+// Now returns the time by which failed logins and lockouts are counted
+func (l LockoutConfig) Now() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&lockoutSkew)))
+}
+
+// SkipLockoutTime moves the clock of the lockout d ahead,
+// so that tests don't have to wait out a back-off or a lockout
+func SkipLockoutTime(d time.Duration) {
+	atomic.AddInt64(&lockoutSkew, int64(d))
+}
+
+// IsLocked tells if the attempts are locked out at now
+func (a LoginAttempts) IsLocked(now time.Time) bool {
+	return a.LockedUntil != nil && now.Before(*a.LockedUntil)
+}
+
+// IsStale tells if the attempts no longer count at now:
+// their last failure is out of the window, and no lock is in force
+func (a LoginAttempts) IsStale(now time.Time, window time.Duration) bool {
+	if a.IsLocked(now) {
+		return false
+	}
+	return a.LockedUntil != nil || now.Sub(a.LastFailureAt) >= window
+}
+
+// RetryAfter returns how long the owner of attempts has to wait at now
+// before trying to login again, the back-off counting only if backoff is set
+func (l LockoutConfig) RetryAfter(a LoginAttempts, now time.Time, backoff bool) time.Duration {
+	if a.IsLocked(now) {
+		return a.LockedUntil.Sub(now)
+	}
+	if !backoff || l.BackoffAfter <= 0 || a.Failures < l.BackoffAfter {
+		return 0
+	}
+	delay := l.Backoff
+	for i := l.BackoffAfter; i < a.Failures && delay < l.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if l.MaxBackoff > 0 && delay > l.MaxBackoff {
+		delay = l.MaxBackoff
+	}
+	if wait := a.LastFailureAt.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
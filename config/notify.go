@@ -0,0 +1,47 @@
+package config
+
+import "github.com/spf13/viper"
+
+// Notifiers that deliver messages to users
+const (
+	SMTPNotifier = "smtp"
+	FileNotifier = "file"
+	LogNotifier  = "log"
+)
+
+// NotifyConfig represents how messages, such as
+// password reset tokens, are delivered to users
+type NotifyConfig struct {
+	Notifier string
+	// From is the sender address of the messages
+	From string
+	// File is where the file notifier appends the messages
+	File         string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+}
+
+var notifyCfg NotifyConfig
+
+// LoadNotify populates the notify config instance
+func LoadNotify() {
+	notifyCfg = NotifyConfig{
+		Notifier:     viper.GetString("notify.notifier"),
+		From:         viper.GetString("notify.from"),
+		File:         viper.GetString("notify.file"),
+		SMTPHost:     viper.GetString("notify.smtp_host"),
+		SMTPPort:     viper.GetInt("notify.smtp_port"),
+		SMTPUsername: viper.GetString("notify.smtp_username"),
+		SMTPPassword: viper.GetString("notify.smtp_password"),
+	}
+	if notifyCfg.Notifier == "" {
+		notifyCfg.Notifier = LogNotifier
+	}
+}
+
+// Notify returns the notify config instance
+func Notify() NotifyConfig {
+	return notifyCfg
+}
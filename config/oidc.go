@@ -0,0 +1,90 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultOIDCUsernameClaim = "preferred_username"
+	defaultOIDCRolesClaim    = "groups"
+)
+
+// OIDCConfig represents the OpenID Connect identity provider users can
+// login with, alongside local accounts
+type OIDCConfig struct {
+	Enabled bool
+	// Issuer is the URL of the provider, its configuration
+	// is discovered from Issuer/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to, /api/oidc/callback
+	RedirectURL string
+	Scopes      []string
+	// UsernameClaim names the claim of the ID token that is the local username
+	UsernameClaim string
+	// RolesClaim names the claim listing the groups of the user, which
+	// RoleMap maps to local roles. Users of no mapped group get DefaultRole
+	RolesClaim  string
+	RoleMap     map[string]string
+	DefaultRole string
+}
+
+// OIDCLogin is a login with the provider that has been started, and
+// is waiting for the user to come back with the state it was given
+type OIDCLogin struct {
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var oidcCfg OIDCConfig
+
+// LoadOIDC populates the oidc config instance
+func LoadOIDC() {
+	oidcCfg = OIDCConfig{
+		Enabled:       viper.GetBool("oidc.enabled"),
+		Issuer:        strings.TrimSuffix(viper.GetString("oidc.issuer"), "/"),
+		ClientID:      viper.GetString("oidc.client_id"),
+		ClientSecret:  viper.GetString("oidc.client_secret"),
+		RedirectURL:   viper.GetString("oidc.redirect_url"),
+		Scopes:        viper.GetStringSlice("oidc.scopes"),
+		UsernameClaim: viper.GetString("oidc.username_claim"),
+		RolesClaim:    viper.GetString("oidc.roles_claim"),
+		RoleMap:       viper.GetStringMapString("oidc.role_map"),
+		DefaultRole:   viper.GetString("oidc.default_role"),
+	}
+	if len(oidcCfg.Scopes) == 0 {
+		oidcCfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if oidcCfg.UsernameClaim == "" {
+		oidcCfg.UsernameClaim = defaultOIDCUsernameClaim
+	}
+	if oidcCfg.RolesClaim == "" {
+		oidcCfg.RolesClaim = defaultOIDCRolesClaim
+	}
+	if oidcCfg.DefaultRole == "" {
+		oidcCfg.DefaultRole = RolePatron
+	}
+}
+
+// OIDC returns the oidc config instance
+func OIDC() OIDCConfig {
+	return oidcCfg
+}
+
+// MapRole returns the role of a user in groups: the one with the most
+// permissions of the roles the groups map to, or DefaultRole.
+// Group names are compared ignoring case
+func (o OIDCConfig) MapRole(groups []string) string {
+	role := o.DefaultRole
+	for _, group := range groups {
+		mapped, ok := o.RoleMap[strings.ToLower(group)]
+		if ok && RoleExists(mapped) && len(rolePermissions[mapped]) > len(rolePermissions[role]) {
+			role = mapped
+		}
+	}
+	return role
+}
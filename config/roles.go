@@ -0,0 +1,78 @@
+package config
+
+import "sort"
+
+// Roles of users
+const (
+	RolePatron     = "patron"
+	RoleLibrarian  = "librarian"
+	RoleCataloguer = "cataloguer"
+	RoleAuditor    = "auditor"
+	RoleAdmin      = "admin"
+)
+
+// Permissions a role can have
+const (
+	// PermProfile covers logging out and managing one's own profile
+	PermProfile = "profile"
+	// PermBrowse covers reading the catalogue of books and authors
+	PermBrowse = "catalogue:read"
+	// PermBorrow covers one's own loans, holds and fines
+	PermBorrow        = "loans:borrow"
+	PermEditCatalogue = "catalogue:write"
+	PermViewLoans     = "loans:read"
+	PermManageLoans   = "loans:manage"
+	PermViewFines     = "fines:read"
+	PermManageFines   = "fines:manage"
+	PermManageUsers   = "users:manage"
+	PermViewAudit     = "audit:read"
+)
+
+var patronPermissions = []string{PermProfile, PermBrowse, PermBorrow}
+
+// rolePermissions maps each role to the permissions it has
+var rolePermissions = map[string][]string{
+	RolePatron:     patronPermissions,
+	RoleLibrarian:  append([]string{PermViewLoans, PermManageLoans, PermViewFines, PermManageFines}, patronPermissions...),
+	RoleCataloguer: append([]string{PermEditCatalogue}, patronPermissions...),
+	RoleAuditor:    append([]string{PermViewLoans, PermViewFines, PermViewAudit}, patronPermissions...),
+	RoleAdmin: append([]string{PermEditCatalogue, PermViewLoans, PermManageLoans,
+		PermViewFines, PermManageFines, PermManageUsers, PermViewAudit}, patronPermissions...),
+}
+
+// RoleExists tells if role is one of the known roles
+func RoleExists(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// HasPermission tells if role has permission
+func HasPermission(role, permission string) bool {
+	for _, rolePermission := range rolePermissions[role] {
+		if rolePermission == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// IsServicePermission tells if permission can be given to an API key.
+// Profile and borrowing permissions act on the user making the
+// request, which service accounts aren't
+func IsServicePermission(permission string) bool {
+	if permission == PermProfile || permission == PermBorrow {
+		return false
+	}
+	return HasPermission(RoleAdmin, permission)
+}
+
+// RolePermissions returns a copy of the permission map, permissions sorted
+func RolePermissions() map[string][]string {
+	permissions := make(map[string][]string, len(rolePermissions))
+	for role, rolePerms := range rolePermissions {
+		sorted := append([]string(nil), rolePerms...)
+		sort.Strings(sorted)
+		permissions[role] = sorted
+	}
+	return permissions
+}
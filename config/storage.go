@@ -0,0 +1,30 @@
+package config
+
+import "github.com/spf13/viper"
+
+const (
+	RedisBackend  = "redis"
+	MemoryBackend = "memory"
+)
+
+// StorageConfig represents the storage config info
+type StorageConfig struct {
+	Backend string
+}
+
+var storageCfg StorageConfig
+
+// LoadStorage populates the storage config instance
+func LoadStorage() {
+	storageCfg = StorageConfig{
+		Backend: viper.GetString("storage.backend"),
+	}
+	if storageCfg.Backend == "" {
+		storageCfg.Backend = RedisBackend
+	}
+}
+
+// Storage returns the storage config instance
+func Storage() StorageConfig {
+	return storageCfg
+}
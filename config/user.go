@@ -3,14 +3,35 @@ package config
 type UserCredentials struct {
 	Username    string   `json:"username"`
 	Name        string   `json:"name"`
+	Email       string   `json:"email,omitempty"`
 	Password    string   `json:"password"`
 	UserData    UserData `json:"user_data"`
 	LoanIDArray []int
+	TwoFactor   *TwoFactor `json:"two_factor,omitempty"`
+}
+
+// TwoFactor is the TOTP enrolment of a user. A code is asked
+// on login only once the enrolment has been confirmed
+type TwoFactor struct {
+	Secret    string
+	Confirmed bool
+	// RecoveryCodes are the SHA-256 hashes of the unused recovery codes
+	RecoveryCodes []string
+	// LastStep is the time step of the last code used, codes can't be used twice
+	LastStep int64
 }
 
 type UserData struct {
 	ProfilePicURL string
-	IsAdmin       bool
+	// IsAdmin is kept in step with Role, accounts saved
+	// before roles existed only have IsAdmin
+	IsAdmin bool
+	Role    string `json:",omitempty"`
+	// Disabled users can't login, and their tokens are turned away
+	Disabled bool `json:",omitempty"`
+	// OIDCSubject links the user to the account of the same subject with
+	// the OpenID Connect provider, which they login with instead of a password
+	OIDCSubject string `json:",omitempty"`
 }
 
 type UserLoanData struct {
@@ -21,3 +42,30 @@ type LoanedBookUnit struct {
 	BookID int `json:"book_id"`
 	//AuthorID int `json:"author_id"`
 }
+
+// Role returns the role of the user
+func (u UserCredentials) Role() string {
+	if u.UserData.Role != "" {
+		return u.UserData.Role
+	}
+	if u.UserData.IsAdmin {
+		return RoleAdmin
+	}
+	return RolePatron
+}
+
+// HasTwoFactor tells if a code is asked when the user logs in
+func (u UserCredentials) HasTwoFactor() bool {
+	return u.TwoFactor != nil && u.TwoFactor.Confirmed
+}
+
+// IsExternal tells if the user logs in with the OpenID Connect provider
+func (u UserCredentials) IsExternal() bool {
+	return u.UserData.OIDCSubject != ""
+}
+
+// SetRole gives the user role
+func (u *UserCredentials) SetRole(role string) {
+	u.UserData.Role = role
+	u.UserData.IsAdmin = role == RoleAdmin
+}
@@ -1,43 +1,38 @@
 package db
 
 import (
-	"crypto/md5"
-	"encoding/hex"
-	"encoding/json"
 	"evl-book-server/config"
+	"evl-book-server/passhash"
 	"log"
 )
 
 func AddDefaultAdmin() {
+	hash, err := passhash.Hash("admin")
+	if err != nil {
+		log.Println("error hashing admin password")
+		return
+	}
 	// ensuring default admin account
 	user := config.UserCredentials{
 		Username: "admin",
-		Password: GetMD5Hash("admin"),
+		Password: hash,
 		UserData: config.UserData{
 			IsAdmin:       true,
+			Role:          config.RoleAdmin,
 			ProfilePicURL: "",
 		},
 	}
 
 	// beyond this block, the user's credentials are acceptable.
 	// process and save them in db
-	userBytes, err := json.Marshal(user)
+	ok, err := Users().Exists(user.Username)
 	if err != nil {
-		log.Println("error encoding admin data")
+		log.Println("error getting admin data")
 		return
 	}
-	_, err = GetSingleValue("user_" + user.Username)
-	if err != nil {
-		if err.Error() == RedisNilErr {
-			_ = SetJsonValues("user_"+user.Username, userBytes)
-		} else {
-			log.Println("error getting admin data")
+	if !ok {
+		if err := Users().Save(user); err != nil {
+			log.Println("error saving admin data")
 		}
 	}
-
-}
-
-func GetMD5Hash(text string) string {
-	hash := md5.Sum([]byte(text))
-	return hex.EncodeToString(hash[:])
 }
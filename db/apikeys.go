@@ -0,0 +1,52 @@
+package db
+
+import (
+	"encoding/json"
+	"evl-book-server/config"
+	"sort"
+	"time"
+)
+
+type apiKeyStore struct{ b backend }
+
+func (s apiKeyStore) Get(id string) (config.APIKey, error) {
+	key := config.APIKey{}
+	err := getRecord(s.b, APIKeyPrefix+id, &key)
+	return key, err
+}
+
+func (s apiKeyStore) Save(key config.APIKey) error {
+	return saveRecord(s.b, APIKeyPrefix+key.ID, key)
+}
+
+func (s apiKeyStore) Delete(id string) error {
+	if _, err := s.b.get(APIKeyPrefix + id); err != nil {
+		return err
+	}
+	return s.b.del(APIKeyPrefix + id)
+}
+
+func (s apiKeyStore) All() ([]config.APIKey, error) {
+	keys := []config.APIKey{}
+	err := scanRecords(s.b, APIKeyPrefix, func(recordBytes []byte) error {
+		key := config.APIKey{}
+		if err := json.Unmarshal(recordBytes, &key); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, err
+}
+
+func (s apiKeyStore) Touch(id string, at time.Time) error {
+	return s.b.update(func(tx txn) error {
+		key := config.APIKey{}
+		if err := getTxRecord(tx, APIKeyPrefix+id, &key); err != nil {
+			return err
+		}
+		key.LastUsedAt = &at
+		return saveTxRecord(tx, APIKeyPrefix+id, key)
+	})
+}
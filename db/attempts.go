@@ -0,0 +1,98 @@
+package db
+
+import (
+	"evl-book-server/config"
+	"strings"
+	"time"
+)
+
+// attemptStore counts failed logins per name, the names
+// being usernames or IP addresses depending on prefix
+type attemptStore struct {
+	b      backend
+	prefix string
+}
+
+func (s attemptStore) Get(name string, window time.Duration) (config.LoginAttempts, error) {
+	attempts := config.LoginAttempts{}
+	err := getRecord(s.b, s.key(name), &attempts)
+	if err == ErrNotFound || attempts.IsStale(config.Lockout().Now(), window) {
+		return config.LoginAttempts{}, nil
+	}
+	return attempts, err
+}
+
+func (s attemptStore) Attempt(name string, window time.Duration, lockAfter int, lockFor time.Duration,
+	allow func(attempts config.LoginAttempts, now time.Time) error) (config.LoginAttempts, error) {
+	key := s.key(name)
+	attempts := config.LoginAttempts{}
+	now := config.Lockout().Now()
+	err := s.b.update(func(tx txn) error {
+		attempts = config.LoginAttempts{}
+		err := getTxRecord(tx, key, &attempts)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if err == ErrNotFound || attempts.IsStale(now, window) {
+			attempts = config.LoginAttempts{}
+		}
+		if err := allow(attempts, now); err != nil {
+			return err
+		}
+
+		attempts.Failures++
+		attempts.LastFailureAt = now
+		if lockAfter > 0 && attempts.Failures >= lockAfter && attempts.LockedUntil == nil {
+			lockedUntil := now.Add(lockFor)
+			attempts.LockedUntil = &lockedUntil
+		}
+		return saveTxRecord(tx, key, attempts)
+	})
+	if err != nil {
+		return attempts, err
+	}
+	return attempts, s.expire(key, attempts, window)
+}
+
+func (s attemptStore) Release(name string, window time.Duration) error {
+	key := s.key(name)
+	attempts := config.LoginAttempts{}
+	err := s.b.update(func(tx txn) error {
+		attempts = config.LoginAttempts{}
+		if err := getTxRecord(tx, key, &attempts); err != nil {
+			return err
+		}
+		if attempts.Failures > 0 {
+			attempts.Failures--
+		}
+		return saveTxRecord(tx, key, attempts)
+	})
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.expire(key, attempts, window)
+}
+
+func (s attemptStore) Clear(name string) error {
+	return s.b.del(s.key(name))
+}
+
+// expire lets the backend drop the attempts once they no longer count
+func (s attemptStore) expire(key string, attempts config.LoginAttempts, window time.Duration) error {
+	e, ok := s.b.(expirer)
+	if !ok {
+		return nil
+	}
+	expiresAt := attempts.LastFailureAt.Add(window)
+	if attempts.LockedUntil != nil && attempts.LockedUntil.After(expiresAt) {
+		expiresAt = *attempts.LockedUntil
+	}
+	return e.expireAt(key, expiresAt)
+}
+
+func (s attemptStore) key(name string) string {
+	return s.prefix + strings.ToLower(name)
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"encoding/json"
+	"evl-book-server/config"
+	"sort"
+	"time"
+)
+
+type auditStore struct{ b backend }
+
+func (s auditStore) Record(entry config.AuditEntry) (config.AuditEntry, error) {
+	id, err := nextID(s.b, AuditPrefix)
+	if err != nil {
+		return config.AuditEntry{}, err
+	}
+	entry.ID = id
+	entry.CreatedAt = time.Now()
+	return entry, saveRecord(s.b, intKey(AuditPrefix, id), entry)
+}
+
+func (s auditStore) All() ([]config.AuditEntry, error) {
+	entries := []config.AuditEntry{}
+	err := scanRecords(s.b, AuditPrefix, func(recordBytes []byte) error {
+		entry := config.AuditEntry{}
+		if err := json.Unmarshal(recordBytes, &entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, err
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by every store when the requested record doesn't exist
+	ErrNotFound = errors.New("record not found")
+	// ErrTxConflict is returned when an atomic update keeps losing against concurrent writers
+	ErrTxConflict = errors.New("too many concurrent updates, try again")
+)
+
+// backend is the raw key-value storage used by the typed stores.
+// Values are JSON encoded records stored under prefixed keys.
+type backend interface {
+	ping() error
+	get(key string) ([]byte, error)
+	set(key string, value []byte) error
+	del(key string) error
+	scan(prefix string) ([]string, error)
+	// incr atomically increments the counter stored at key and returns its new value
+	incr(key string) (int64, error)
+	// hgetall returns the fields of the hash stored at key
+	hgetall(key string) (map[string][]byte, error)
+	// indexed returns up to limit keys of index that start with prefix, in
+	// lexical order, without a scan of the keyspace. 0 returns all of them
+	indexed(index, prefix string, limit int) ([]string, error)
+	// update runs fn as a single atomic read-modify-write operation.
+	// Writes made through tx are applied only if fn returns nil.
+	update(fn func(tx txn) error) error
+}
+
+// expirer is implemented by the backends that can drop a key on their own
+// once it is no longer needed. Keys of other backends have to be deleted.
+type expirer interface {
+	expireAt(key string, at time.Time) error
+}
+
+// txn gives access to the records inside an atomic update.
+// Reads see the writes made earlier in the same update.
+type txn interface {
+	get(key string) ([]byte, error)
+	set(key string, value []byte)
+	del(key string)
+	// hset sets field of the hash at key, and adds key to index.
+	// hdel deletes field, and drops key from index once the hash is empty
+	hset(index, key, field string, value []byte)
+	hdel(index, key, field string)
+}
+
+type pendingWrite struct {
+	key     string
+	value   []byte
+	deleted bool
+	// field is set for the writes to a field of a hash, whose key is kept in index
+	index string
+	field string
+}
+
+// writeBuffer queues the writes of an update until it is committed
+type writeBuffer []pendingWrite
+
+func (wb *writeBuffer) set(key string, value []byte) {
+	*wb = append(*wb, pendingWrite{key: key, value: append([]byte(nil), value...)})
+}
+
+func (wb *writeBuffer) del(key string) {
+	*wb = append(*wb, pendingWrite{key: key, deleted: true})
+}
+
+func (wb *writeBuffer) hset(index, key, field string, value []byte) {
+	*wb = append(*wb, pendingWrite{key: key, value: append([]byte(nil), value...), index: index, field: field})
+}
+
+func (wb *writeBuffer) hdel(index, key, field string) {
+	*wb = append(*wb, pendingWrite{key: key, deleted: true, index: index, field: field})
+}
+
+// lookup returns the latest pending write for key, if any.
+// Writes to the fields of a hash are not read back
+func (wb writeBuffer) lookup(key string) (pendingWrite, bool) {
+	for i := len(wb) - 1; i >= 0; i-- {
+		if wb[i].key == key && wb[i].field == "" {
+			return wb[i], true
+		}
+	}
+	return pendingWrite{}, false
+}
+
+// readThrough serves a read from the pending writes before falling back to read
+func (wb writeBuffer) readThrough(key string, read func(string) ([]byte, error)) ([]byte, error) {
+	if write, ok := wb.lookup(key); ok {
+		if write.deleted {
+			return nil, ErrNotFound
+		}
+		return append([]byte(nil), write.value...), nil
+	}
+	return read(key)
+}
@@ -0,0 +1,279 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"evl-book-server/config"
+	"sort"
+)
+
+var ErrBookOnLoan = errors.New("book has open loans, close them first")
+
+type bookStore struct{ b backend }
+
+func (s bookStore) Create(book config.Book) (config.Book, error) {
+	id, err := nextID(s.b, BookPrefix)
+	if err != nil {
+		return config.Book{}, err
+	}
+	book.ID = id
+	return s.save(book)
+}
+
+func (s bookStore) Get(id int) (config.Book, error) {
+	book := config.Book{}
+	err := getRecord(s.b, intKey(BookPrefix, id), &book)
+	return book, err
+}
+
+func (s bookStore) Exists(id int) (bool, error) {
+	return recordExists(s.b, intKey(BookPrefix, id))
+}
+
+func (s bookStore) Save(book config.Book) error {
+	_, err := s.save(book)
+	return err
+}
+
+// save writes book and returns it as saved. The items of a book, and the
+// counts derived from them, are kept from the saved book. AddCount items
+// are added to them
+func (s bookStore) save(book config.Book) (config.Book, error) {
+	itemIDs := make([]int, book.AddCount)
+	for i := range itemIDs {
+		id, err := nextID(s.b, ItemPrefix)
+		if err != nil {
+			return config.Book{}, err
+		}
+		itemIDs[i] = id
+	}
+	saved := config.Book{}
+	err := s.b.update(func(tx txn) error {
+		saved = config.Book{}
+		if err := getTxRecord(tx, intKey(BookPrefix, book.ID), &saved); err != nil && err != ErrNotFound {
+			return err
+		}
+		if err := creditContributors(tx, book.ID, saved.Credits(), book.Credits()); err != nil {
+			return err
+		}
+
+		updated := book
+		updated.AddCount = 0
+		updated.ItemIDs = saved.ItemIDs
+		updated.TotalCount, updated.OnLoanCount, updated.LendableCount = saved.TotalCount, saved.OnLoanCount, saved.LendableCount
+		if book.AddCount > 0 {
+			if err := itemizeTxBook(tx, &updated); err != nil {
+				return err
+			}
+			for _, id := range itemIDs {
+				if _, err := addTxItem(tx, &updated, config.Item{ID: id}); err != nil {
+					return err
+				}
+			}
+		}
+		saved = updated
+		return saveTxBookCounts(tx, &saved)
+	})
+	return saved, err
+}
+
+func (s bookStore) Delete(id int) error {
+	return s.b.update(func(tx txn) error {
+		book := config.Book{}
+		if err := getTxRecord(tx, intKey(BookPrefix, id), &book); err != nil {
+			if err == ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		openLoanIDs := []int{}
+		if err := getTxRecord(tx, intKey(OpenLoanPrefix, id), &openLoanIDs); err != nil && err != ErrNotFound {
+			return err
+		}
+		if len(openLoanIDs) > 0 || book.OnLoanCount > 0 {
+			return ErrBookOnLoan
+		}
+		items, err := getTxItems(tx, book)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if item.Status == config.ItemOnLoan {
+				return ErrBookOnLoan
+			}
+		}
+
+		if err := creditContributors(tx, id, book.Credits(), nil); err != nil {
+			return err
+		}
+		for _, item := range items {
+			tx.del(BarcodePrefix + item.Barcode)
+			tx.del(intKey(ItemPrefix, item.ID))
+		}
+		tx.del(intKey(BookPrefix, id))
+		tx.del(intKey(OpenLoanPrefix, id))
+		return nil
+	})
+}
+
+func (s bookStore) All() ([]config.Book, error) {
+	books := []config.Book{}
+	err := scanRecords(s.b, BookPrefix, func(recordBytes []byte) error {
+		book := config.Book{}
+		if err := json.Unmarshal(recordBytes, &book); err != nil {
+			return err
+		}
+		books = append(books, book)
+		return nil
+	})
+	sort.Slice(books, func(i, j int) bool { return books[i].ID < books[j].ID })
+	return books, err
+}
+
+type authorStore struct{ b backend }
+
+func (s authorStore) Create(author config.Author) (config.Author, error) {
+	id, err := nextID(s.b, AuthorPrefix)
+	if err != nil {
+		return config.Author{}, err
+	}
+	author.ID = id
+	return author, s.Save(author)
+}
+
+func (s authorStore) Get(id int) (config.Author, error) {
+	author := config.Author{}
+	err := getRecord(s.b, intKey(AuthorPrefix, id), &author)
+	return author, err
+}
+
+func (s authorStore) Exists(id int) (bool, error) {
+	return recordExists(s.b, intKey(AuthorPrefix, id))
+}
+
+func (s authorStore) Save(author config.Author) error {
+	return saveRecord(s.b, intKey(AuthorPrefix, author.ID), author)
+}
+
+func (s authorStore) Update(id int, change func(author *config.Author) error) (config.Author, error) {
+	author := config.Author{}
+	err := s.b.update(func(tx txn) error {
+		author = config.Author{}
+		if err := getTxRecord(tx, intKey(AuthorPrefix, id), &author); err != nil {
+			return err
+		}
+		if err := change(&author); err != nil {
+			return err
+		}
+		return saveTxRecord(tx, intKey(AuthorPrefix, id), author)
+	})
+	return author, err
+}
+
+func (s authorStore) Delete(id int) error {
+	return s.b.update(func(tx txn) error {
+		author := config.Author{}
+		if err := getTxRecord(tx, intKey(AuthorPrefix, id), &author); err != nil {
+			if err == ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		// the books stay, without the author among their contributors
+		for _, work := range author.Bibliography() {
+			book := config.Book{}
+			if err := getTxRecord(tx, intKey(BookPrefix, work.BookID), &book); err != nil {
+				if err == ErrNotFound {
+					continue
+				}
+				return err
+			}
+			contributors := []config.Contribution{}
+			for _, contributor := range book.Credits() {
+				if contributor.AuthorID != id {
+					contributors = append(contributors, contributor)
+				}
+			}
+			book.SetContributors(contributors)
+			if err := saveTxRecord(tx, intKey(BookPrefix, book.ID), book); err != nil {
+				return err
+			}
+		}
+		tx.del(intKey(AuthorPrefix, id))
+		return nil
+	})
+}
+
+func (s authorStore) All() ([]config.Author, error) {
+	authors := []config.Author{}
+	err := scanRecords(s.b, AuthorPrefix, func(recordBytes []byte) error {
+		author := config.Author{}
+		if err := json.Unmarshal(recordBytes, &author); err != nil {
+			return err
+		}
+		authors = append(authors, author)
+		return nil
+	})
+	sort.Slice(authors, func(i, j int) bool { return authors[i].ID < authors[j].ID })
+	return authors, err
+}
+
+// creditContributors brings the works of the contributors of a book in
+// line with its contributors changing from before to after. Contributors
+// that are gone are skipped, new contributors have to exist
+func creditContributors(tx txn, bookID int, before, after []config.Contribution) error {
+	removed := map[int][]string{}
+	added := map[int][]string{}
+	for _, contributor := range before {
+		if !hasContribution(after, contributor) {
+			removed[contributor.AuthorID] = append(removed[contributor.AuthorID], contributor.Role)
+		}
+	}
+	for _, contributor := range after {
+		if !hasContribution(before, contributor) {
+			added[contributor.AuthorID] = append(added[contributor.AuthorID], contributor.Role)
+		}
+	}
+
+	for authorID, roles := range removed {
+		author := config.Author{}
+		if err := getTxRecord(tx, intKey(AuthorPrefix, authorID), &author); err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+			return err
+		}
+		for _, role := range roles {
+			author.RemoveWork(config.Work{BookID: bookID, Role: role})
+		}
+		for _, role := range added[authorID] {
+			author.AddWork(config.Work{BookID: bookID, Role: role})
+		}
+		delete(added, authorID)
+		if err := saveTxRecord(tx, intKey(AuthorPrefix, authorID), author); err != nil {
+			return err
+		}
+	}
+	for authorID, roles := range added {
+		author := config.Author{}
+		if err := getTxRecord(tx, intKey(AuthorPrefix, authorID), &author); err != nil {
+			return err
+		}
+		for _, role := range roles {
+			author.AddWork(config.Work{BookID: bookID, Role: role})
+		}
+		if err := saveTxRecord(tx, intKey(AuthorPrefix, authorID), author); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasContribution(contributors []config.Contribution, contribution config.Contribution) bool {
+	for _, c := range contributors {
+		if c == contribution {
+			return true
+		}
+	}
+	return false
+}
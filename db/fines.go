@@ -0,0 +1,93 @@
+package db
+
+import (
+	"errors"
+	"evl-book-server/config"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrOverpayment = errors.New("amount is more than the user owes")
+
+type fineStore struct{ b backend }
+
+func (s fineStore) Ledger(username string) ([]config.LedgerEntry, error) {
+	ledger := []config.LedgerEntry{}
+	err := getRecord(s.b, fineKey(username), &ledger)
+	if err == ErrNotFound {
+		return []config.LedgerEntry{}, nil
+	}
+	return ledger, err
+}
+
+func (s fineStore) Balance(username string) (int, error) {
+	ledger, err := s.Ledger(username)
+	if err != nil {
+		return 0, err
+	}
+	return config.LedgerBalance(ledger), nil
+}
+
+func (s fineStore) Record(entry config.LedgerEntry) (config.LedgerEntry, error) {
+	recorded := config.LedgerEntry{}
+	err := s.b.update(func(tx txn) error {
+		var err error
+		recorded, err = appendTxLedger(tx, entry)
+		return err
+	})
+	return recorded, err
+}
+
+// chargeTxFines charges the user of a loan that is being closed at closedAt
+// its overdue fine, and the lost book fee if its book is lost.
+// It has to run before the loan is marked returned or lost.
+func chargeTxFines(tx txn, loan *config.Loan, closedAt time.Time, lost bool) error {
+	fines := config.Fines()
+	charges := []config.LedgerEntry{}
+	if fine := fines.OverdueFine(*loan, closedAt); fine > 0 {
+		charges = append(charges, config.LedgerEntry{
+			Kind:   config.LedgerFine,
+			Amount: fine,
+			Note:   fmt.Sprintf("%d days overdue", -loan.DaysRemaining(closedAt)),
+		})
+	}
+	if lost && fines.LostBookFee > 0 {
+		charges = append(charges, config.LedgerEntry{
+			Kind:   config.LedgerLostFee,
+			Amount: fines.LostBookFee,
+		})
+	}
+
+	for _, charge := range charges {
+		charge.Username = loan.Username
+		charge.LoanID = loan.ID
+		if _, err := appendTxLedger(tx, charge); err != nil {
+			return err
+		}
+		loan.Fine += charge.Amount
+	}
+	return nil
+}
+
+// appendTxLedger numbers entry and appends it to its user's ledger.
+// Payments and waivers can't take the balance below zero.
+func appendTxLedger(tx txn, entry config.LedgerEntry) (config.LedgerEntry, error) {
+	key := fineKey(entry.Username)
+	ledger := []config.LedgerEntry{}
+	err := getTxRecord(tx, key, &ledger)
+	if err != nil && err != ErrNotFound {
+		return config.LedgerEntry{}, err
+	}
+	if entry.IsCredit() && entry.Amount > config.LedgerBalance(ledger) {
+		return config.LedgerEntry{}, ErrOverpayment
+	}
+
+	entry.ID = len(ledger) + 1
+	entry.CreatedAt = time.Now()
+	return entry, saveTxRecord(tx, key, append(ledger, entry))
+}
+
+func fineKey(username string) string {
+	return FinePrefix + strings.ToLower(username)
+}
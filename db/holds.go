@@ -0,0 +1,185 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"evl-book-server/config"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBookAvailable = errors.New("book has copies available, request a loan instead")
+	ErrAlreadyOnHold = errors.New("you already have a hold on this book")
+	ErrHoldNotFound  = errors.New("you dont have a hold on this book")
+)
+
+type holdStore struct{ b backend }
+
+func (s holdStore) Place(bookID int, username string) (int, error) {
+	position := 0
+	err := s.b.update(func(tx txn) error {
+		book := config.Book{}
+		if err := getTxRecord(tx, intKey(BookPrefix, bookID), &book); err != nil {
+			return err
+		}
+		if book.Available() > 0 {
+			return ErrBookAvailable
+		}
+
+		queueKey := intKey(HoldPrefix, bookID)
+		queue, err := getTxQueue(tx, queueKey)
+		if err != nil {
+			return err
+		}
+		for _, hold := range queue {
+			if strings.EqualFold(hold.Username, username) {
+				return ErrAlreadyOnHold
+			}
+		}
+		queue = append(queue, config.Hold{
+			BookID:   bookID,
+			Username: username,
+			PlacedAt: time.Now(),
+		})
+		position = len(queue)
+		return saveTxRecord(tx, queueKey, queue)
+	})
+	return position, err
+}
+
+func (s holdStore) Cancel(bookID int, username string) error {
+	return s.b.update(func(tx txn) error {
+		queueKey := intKey(HoldPrefix, bookID)
+		queue, err := getTxQueue(tx, queueKey)
+		if err != nil {
+			return err
+		}
+		for i, hold := range queue {
+			if strings.EqualFold(hold.Username, username) {
+				return saveTxQueue(tx, queueKey, append(queue[:i], queue[i+1:]...))
+			}
+		}
+		return ErrHoldNotFound
+	})
+}
+
+func (s holdStore) Queue(bookID int) ([]config.Hold, error) {
+	queue := []config.Hold{}
+	err := getRecord(s.b, intKey(HoldPrefix, bookID), &queue)
+	if err == ErrNotFound {
+		return []config.Hold{}, nil
+	}
+	return queue, err
+}
+
+func (s holdStore) BooksHeldBy(username string) ([]int, error) {
+	bookIDs := []int{}
+	err := scanRecords(s.b, HoldPrefix, func(recordBytes []byte) error {
+		queue := []config.Hold{}
+		if err := json.Unmarshal(recordBytes, &queue); err != nil {
+			return err
+		}
+		for _, hold := range queue {
+			if strings.EqualFold(hold.Username, username) {
+				bookIDs = append(bookIDs, hold.BookID)
+			}
+		}
+		return nil
+	})
+	sort.Ints(bookIDs)
+	return bookIDs, err
+}
+
+func (s holdStore) PromoteNext(bookID int, check LoanCheck) (config.Loan, bool, error) {
+	queue, err := s.Queue(bookID)
+	if err != nil || len(queue) == 0 {
+		return config.Loan{}, false, err
+	}
+	loanID, err := nextID(s.b, LoanPrefix)
+	if err != nil {
+		return config.Loan{}, false, err
+	}
+
+	loan := config.Loan{}
+	promoted := false
+	err = s.b.update(func(tx txn) error {
+		loan = config.Loan{}
+		promoted = false
+		queueKey := intKey(HoldPrefix, bookID)
+		queue, err := getTxQueue(tx, queueKey)
+		if err != nil {
+			return err
+		}
+		// holds of accounts that are gone are dropped on the way, those
+		// check turns down stay in the queue, and are passed over
+		kept := []config.Hold{}
+		for i, hold := range queue {
+			key := userKey(hold.Username)
+			user := config.UserCredentials{}
+			err := getTxRecord(tx, key, &user)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			next := config.Loan{
+				ID:          loanID,
+				BookID:      bookID,
+				Username:    hold.Username,
+				Status:      config.LoanRequested,
+				RequestedAt: time.Now(),
+			}
+			if check != nil {
+				openLoans, balance, err := getTxBorrower(tx, user)
+				if err != nil {
+					return err
+				}
+				if check(next, user, openLoans, balance) != nil {
+					kept = append(kept, hold)
+					continue
+				}
+			}
+			user.LoanIDArray = append(user.LoanIDArray, next.ID)
+			if err := saveTxRecord(tx, key, user); err != nil {
+				return err
+			}
+			if err := openTxLoan(tx, next); err != nil {
+				return err
+			}
+			loan, promoted = next, true
+			kept = append(kept, queue[i+1:]...)
+			break
+		}
+		return saveTxQueue(tx, queueKey, kept)
+	})
+	if err != nil || !promoted {
+		return config.Loan{}, false, err
+	}
+	return loan, true, nil
+}
+
+func (s holdStore) Clear(bookID int) error {
+	return s.b.del(intKey(HoldPrefix, bookID))
+}
+
+func getTxQueue(tx txn, queueKey string) ([]config.Hold, error) {
+	queue := []config.Hold{}
+	err := getTxRecord(tx, queueKey, &queue)
+	if err == ErrNotFound {
+		return []config.Hold{}, nil
+	}
+	return queue, err
+}
+
+// saveTxQueue saves the queue, removing it altogether once it is empty
+func saveTxQueue(tx txn, queueKey string, queue []config.Hold) error {
+	if len(queue) == 0 {
+		tx.del(queueKey)
+		return nil
+	}
+	return saveTxRecord(tx, queueKey, queue)
+}
@@ -0,0 +1,303 @@
+package db
+
+import (
+	"errors"
+	"evl-book-server/config"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	ErrBarcodeTaken    = errors.New("another item has this barcode")
+	ErrItemOnLoan      = errors.New("item is on loan, it has to be returned first")
+	ErrItemRetired     = errors.New("item has been retired already")
+	ErrItemNotOfBook   = errors.New("no copy of this book has this barcode")
+	ErrItemUnavailable = errors.New("item can not be lent at the moment")
+)
+
+type itemStore struct{ b backend }
+
+func (s itemStore) Get(id int) (config.Item, error) {
+	item := config.Item{}
+	err := getRecord(s.b, intKey(ItemPrefix, id), &item)
+	return item, err
+}
+
+func (s itemStore) ByBarcode(barcode string) (config.Item, error) {
+	id := 0
+	if err := getRecord(s.b, BarcodePrefix+barcode, &id); err != nil {
+		return config.Item{}, err
+	}
+	return s.Get(id)
+}
+
+func (s itemStore) OfBook(bookID int) ([]config.Item, error) {
+	book := config.Book{}
+	if err := getRecord(s.b, intKey(BookPrefix, bookID), &book); err != nil {
+		return nil, err
+	}
+	items := []config.Item{}
+	for _, id := range book.ItemIDs {
+		item, err := s.Get(id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (s itemStore) Add(item config.Item) (config.Item, error) {
+	id, err := nextID(s.b, ItemPrefix)
+	if err != nil {
+		return config.Item{}, err
+	}
+	item.ID = id
+	added := config.Item{}
+	err = s.b.update(func(tx txn) error {
+		book := config.Book{}
+		if err := getTxRecord(tx, intKey(BookPrefix, item.BookID), &book); err != nil {
+			return err
+		}
+		if err := itemizeTxBook(tx, &book); err != nil {
+			return err
+		}
+		var err error
+		if added, err = addTxItem(tx, &book, item); err != nil {
+			return err
+		}
+		return saveTxBookCounts(tx, &book)
+	})
+	return added, err
+}
+
+func (s itemStore) Retire(id int) (config.Item, error) {
+	return s.Update(id, func(item *config.Item) error {
+		switch item.Status {
+		case config.ItemOnLoan:
+			return ErrItemOnLoan
+		case config.ItemRetired:
+			return ErrItemRetired
+		}
+		now := time.Now()
+		item.Status = config.ItemRetired
+		item.RetiredAt = &now
+		return nil
+	})
+}
+
+func (s itemStore) Update(id int, change func(item *config.Item) error) (config.Item, error) {
+	item := config.Item{}
+	err := s.b.update(func(tx txn) error {
+		item = config.Item{}
+		if err := getTxRecord(tx, intKey(ItemPrefix, id), &item); err != nil {
+			return err
+		}
+		if err := change(&item); err != nil {
+			return err
+		}
+		if err := saveTxRecord(tx, intKey(ItemPrefix, id), item); err != nil {
+			return err
+		}
+		book := config.Book{}
+		err := getTxRecord(tx, intKey(BookPrefix, item.BookID), &book)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return saveTxBookCounts(tx, &book)
+	})
+	return item, err
+}
+
+// addTxItem adds a new copy to book. An item without an ID takes the next
+// one in tx, which concurrent writers contend for, so the IDs of new copies
+// are better taken with nextID beforehand. An item without a barcode gets
+// one made up of its ID
+func addTxItem(tx txn, book *config.Book, item config.Item) (config.Item, error) {
+	if item.ID == 0 {
+		id, err := nextTxID(tx, ItemPrefix)
+		if err != nil {
+			return config.Item{}, err
+		}
+		item.ID = id
+	}
+	item.BookID = book.ID
+	if item.Barcode == "" {
+		item.Barcode = fmt.Sprintf("EVL%07d", item.ID)
+	}
+	if item.Condition == "" {
+		item.Condition = config.ConditionGood
+	}
+	item.Status = config.ItemAvailable
+	item.LoanID = 0
+	item.AddedAt = time.Now()
+	item.RetiredAt = nil
+
+	barcodeKey := BarcodePrefix + item.Barcode
+	if _, err := tx.get(barcodeKey); err != ErrNotFound {
+		if err == nil {
+			return config.Item{}, ErrBarcodeTaken
+		}
+		return config.Item{}, err
+	}
+	if err := saveTxRecord(tx, barcodeKey, item.ID); err != nil {
+		return config.Item{}, err
+	}
+	book.ItemIDs = append(book.ItemIDs, item.ID)
+	return item, saveTxRecord(tx, intKey(ItemPrefix, item.ID), item)
+}
+
+// itemizeTxBook gives a book saved before items existed an item for each
+// of its copies. Copies on loan are items on loan without a known loan
+func itemizeTxBook(tx txn, book *config.Book) error {
+	if len(book.ItemIDs) > 0 {
+		return nil
+	}
+	onLoan := book.OnLoanCount
+	for i := 0; i < book.TotalCount; i++ {
+		item, err := addTxItem(tx, book, config.Item{})
+		if err != nil {
+			return err
+		}
+		if i < onLoan {
+			item.Status = config.ItemOnLoan
+			if err := saveTxRecord(tx, intKey(ItemPrefix, item.ID), item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lendTxItem puts a copy of book on loan. The copy with barcode is
+// taken if one is given, else the first copy that can be lent
+func lendTxItem(tx txn, book *config.Book, loanID int, barcode string) (config.Item, error) {
+	if err := itemizeTxBook(tx, book); err != nil {
+		return config.Item{}, err
+	}
+	items, err := getTxItems(tx, *book)
+	if err != nil {
+		return config.Item{}, err
+	}
+
+	found := -1
+	for i, item := range items {
+		if barcode != "" && item.Barcode == barcode {
+			if !item.IsLendable() {
+				return config.Item{}, ErrItemUnavailable
+			}
+			found = i
+			break
+		}
+		if barcode == "" && item.IsLendable() {
+			found = i
+			break
+		}
+	}
+	if found < 0 {
+		if barcode == "" {
+			return config.Item{}, ErrNoCopyAvailable
+		}
+		return config.Item{}, ErrItemNotOfBook
+	}
+
+	item := items[found]
+	item.Status = config.ItemOnLoan
+	item.LoanID = loanID
+	return item, saveTxRecord(tx, intKey(ItemPrefix, item.ID), item)
+}
+
+// releaseTxItem takes the copy of a closed loan back, or writes it off
+// if it is lost. Loans approved before items existed take back any copy
+// on loan without a known loan, or only count if the book has no items
+func releaseTxItem(tx txn, loan config.Loan, lost bool) error {
+	bookKey := intKey(BookPrefix, loan.BookID)
+	book := config.Book{}
+	err := getTxRecord(tx, bookKey, &book)
+	if err == ErrNotFound {
+		// a deleted book has nothing left to give the copy back to
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(book.ItemIDs) == 0 {
+		if book.OnLoanCount > 0 {
+			book.OnLoanCount--
+		}
+		if lost && book.TotalCount > 0 {
+			book.TotalCount--
+		}
+		return saveTxRecord(tx, bookKey, book)
+	}
+
+	items, err := getTxItems(tx, book)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.Status != config.ItemOnLoan {
+			continue
+		}
+		if (loan.ItemID != 0 && item.ID != loan.ItemID) || (loan.ItemID == 0 && item.LoanID != 0) {
+			continue
+		}
+		item.LoanID = 0
+		item.Status = config.ItemAvailable
+		if lost {
+			item.Status = config.ItemLost
+		}
+		if err := saveTxRecord(tx, intKey(ItemPrefix, item.ID), item); err != nil {
+			return err
+		}
+		break
+	}
+	return saveTxBookCounts(tx, &book)
+}
+
+// getTxItems returns the items of book, ordered by ID
+func getTxItems(tx txn, book config.Book) ([]config.Item, error) {
+	items := []config.Item{}
+	for _, id := range book.ItemIDs {
+		item := config.Item{}
+		if err := getTxRecord(tx, intKey(ItemPrefix, id), &item); err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items, nil
+}
+
+// saveTxBookCounts derives the counts of a book from its items, and saves it
+func saveTxBookCounts(tx txn, book *config.Book) error {
+	if len(book.ItemIDs) > 0 {
+		items, err := getTxItems(tx, *book)
+		if err != nil {
+			return err
+		}
+		book.TotalCount, book.OnLoanCount, book.LendableCount = 0, 0, 0
+		for _, item := range items {
+			if item.InCollection() {
+				book.TotalCount++
+			}
+			if item.Status == config.ItemOnLoan {
+				book.OnLoanCount++
+			}
+			if item.IsLendable() {
+				book.LendableCount++
+			}
+		}
+	}
+	return saveTxRecord(tx, intKey(BookPrefix, book.ID), *book)
+}
@@ -0,0 +1,434 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"evl-book-server/config"
+	"sort"
+	"strings"
+	"time"
+)
+
+type loanStore struct{ b backend }
+
+func (s loanStore) Create(loan config.Loan, check LoanCheck) (config.Loan, error) {
+	id, err := nextID(s.b, LoanPrefix)
+	if err != nil {
+		return config.Loan{}, err
+	}
+	loan.ID = id
+	err = s.b.update(func(tx txn) error {
+		key := userKey(loan.Username)
+		user := config.UserCredentials{}
+		if err := getTxRecord(tx, key, &user); err != nil {
+			return err
+		}
+		if err := checkTxLoan(tx, loan, user, check); err != nil {
+			return err
+		}
+		user.LoanIDArray = append(user.LoanIDArray, loan.ID)
+		if err := saveTxRecord(tx, key, user); err != nil {
+			return err
+		}
+		return openTxLoan(tx, loan)
+	})
+	if err != nil {
+		return config.Loan{}, err
+	}
+	return loan, nil
+}
+
+func (s loanStore) Get(id int) (config.Loan, error) {
+	loan := config.Loan{}
+	err := getRecord(s.b, intKey(LoanPrefix, id), &loan)
+	return loan, err
+}
+
+func (s loanStore) Exists(id int) (bool, error) {
+	return recordExists(s.b, intKey(LoanPrefix, id))
+}
+
+func (s loanStore) Save(loan config.Loan) error {
+	return saveRecord(s.b, intKey(LoanPrefix, loan.ID), loan)
+}
+
+func (s loanStore) Delete(id int) error {
+	return s.b.del(intKey(LoanPrefix, id))
+}
+
+func (s loanStore) All() ([]config.Loan, error) {
+	loans := []config.Loan{}
+	err := scanRecords(s.b, LoanPrefix, func(recordBytes []byte) error {
+		loan := config.Loan{}
+		if err := json.Unmarshal(recordBytes, &loan); err != nil {
+			return err
+		}
+		loans = append(loans, loan)
+		return nil
+	})
+	sort.Slice(loans, func(i, j int) bool { return loans[i].ID < loans[j].ID })
+	return loans, err
+}
+
+var (
+	ErrNotYourLoan     = errors.New("you dont have any loan by this id")
+	ErrBookMissing     = errors.New("book of this loan doesn't exist")
+	ErrNoCopyAvailable = errors.New("can not loan this book at the moment")
+	ErrRenewOverdue    = errors.New("an overdue loan can not be renewed, please return the book")
+	ErrRenewLimit      = errors.New("loan has been renewed as many times as allowed")
+	ErrRenewHeld       = errors.New("loan can not be renewed, other users are waiting for this book")
+)
+
+// Approve marks a pending loan approved, due at dueAt, and puts a copy
+// of its book on loan: the one with barcode, or else the first one available
+func (s loanStore) Approve(id int, barcode string, dueAt time.Time) (config.Loan, error) {
+	loan := config.Loan{}
+	err := s.b.update(func(tx txn) error {
+		if err := loadTxLoan(tx, id, &loan); err != nil {
+			return err
+		}
+		if err := loan.CanMoveTo(config.LoanApproved); err != nil {
+			return err
+		}
+
+		bookKey := intKey(BookPrefix, loan.BookID)
+		book := config.Book{}
+		if err := getTxRecord(tx, bookKey, &book); err != nil {
+			if err == ErrNotFound {
+				return ErrBookMissing
+			}
+			return err
+		}
+		item, err := lendTxItem(tx, &book, loan.ID, barcode)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		loan.Approved = true
+		loan.Status = config.LoanApproved
+		loan.ItemID = item.ID
+		loan.ApprovedAt = &now
+		loan.DueAt = &dueAt
+
+		if err := saveTxBookCounts(tx, &book); err != nil {
+			return err
+		}
+		return saveTxRecord(tx, intKey(LoanPrefix, loan.ID), loan)
+	})
+	return loan, err
+}
+
+// Decline closes a pending loan and drops it from its user's loan list
+func (s loanStore) Decline(id int) (config.Loan, error) {
+	loan := config.Loan{}
+	err := s.b.update(func(tx txn) error {
+		if err := loadTxLoan(tx, id, &loan); err != nil {
+			return err
+		}
+		if err := loan.CanMoveTo(config.LoanDeclined); err != nil {
+			return err
+		}
+		now := time.Now()
+		loan.Status = config.LoanDeclined
+		loan.DeclinedAt = &now
+
+		if err := removeLoanFromUser(tx, loan); err != nil {
+			return err
+		}
+		return archiveLoan(tx, loan)
+	})
+	return loan, err
+}
+
+// Cancel lets username withdraw their own pending loan request
+func (s loanStore) Cancel(id int, username string) (config.Loan, error) {
+	loan := config.Loan{}
+	err := s.b.update(func(tx txn) error {
+		if err := loadTxLoan(tx, id, &loan); err != nil {
+			return err
+		}
+		if !strings.EqualFold(loan.Username, username) {
+			return ErrNotYourLoan
+		}
+		if err := loan.CanMoveTo(config.LoanCancelled); err != nil {
+			return err
+		}
+		now := time.Now()
+		loan.Status = config.LoanCancelled
+		loan.CancelledAt = &now
+
+		if err := removeLoanFromUser(tx, loan); err != nil {
+			return err
+		}
+		return archiveLoan(tx, loan)
+	})
+	return loan, err
+}
+
+// CheckOut records that the user picked the book of an approved loan up.
+// The loan is due at dueAt from then on.
+func (s loanStore) CheckOut(id int, dueAt time.Time) (config.Loan, error) {
+	loan := config.Loan{}
+	err := s.b.update(func(tx txn) error {
+		if err := loadTxLoan(tx, id, &loan); err != nil {
+			return err
+		}
+		if err := loan.CanMoveTo(config.LoanCheckedOut); err != nil {
+			return err
+		}
+		now := time.Now()
+		loan.Status = config.LoanCheckedOut
+		loan.CheckedOutAt = &now
+		loan.DueAt = &dueAt
+		return saveTxRecord(tx, intKey(LoanPrefix, loan.ID), loan)
+	})
+	return loan, err
+}
+
+// Renew extends the due date of a checked out loan of username by period.
+// Overdue loans, loans renewed maxRenewals times already, and loans
+// of books that other users hold can't be renewed.
+func (s loanStore) Renew(id int, username string, period time.Duration, maxRenewals int) (config.Loan, error) {
+	loan := config.Loan{}
+	err := s.b.update(func(tx txn) error {
+		if err := loadTxLoan(tx, id, &loan); err != nil {
+			return err
+		}
+		if !strings.EqualFold(loan.Username, username) {
+			return ErrNotYourLoan
+		}
+		if err := loan.CanMoveTo(config.LoanRenewed); err != nil {
+			return err
+		}
+		now := time.Now()
+		if loan.IsOverdue(now) {
+			return ErrRenewOverdue
+		}
+		if loan.Renewals >= maxRenewals {
+			return ErrRenewLimit
+		}
+		queue, err := getTxQueue(tx, intKey(HoldPrefix, loan.BookID))
+		if err != nil {
+			return err
+		}
+		if len(queue) > 0 {
+			return ErrRenewHeld
+		}
+
+		dueAt := now.Add(period)
+		if loan.DueAt != nil {
+			dueAt = loan.DueAt.Add(period)
+		}
+		loan.Status = config.LoanRenewed
+		loan.Renewals++
+		loan.DueAt = &dueAt
+		return saveTxRecord(tx, intKey(LoanPrefix, loan.ID), loan)
+	})
+	return loan, err
+}
+
+// Return closes an approved loan and puts its copy back on the shelf,
+// charging its user the fine if the loan is overdue
+func (s loanStore) Return(id int) (config.Loan, error) {
+	loan := config.Loan{}
+	err := s.b.update(func(tx txn) error {
+		if err := loadTxLoan(tx, id, &loan); err != nil {
+			return err
+		}
+		if err := loan.CanMoveTo(config.LoanReturned); err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := chargeTxFines(tx, &loan, now, false); err != nil {
+			return err
+		}
+		loan.Status = config.LoanReturned
+		loan.ReturnedAt = &now
+
+		if err := releaseTxItem(tx, loan, false); err != nil {
+			return err
+		}
+
+		if err := removeLoanFromUser(tx, loan); err != nil {
+			return err
+		}
+		return archiveLoan(tx, loan)
+	})
+	return loan, err
+}
+
+// MarkLost closes a loan whose copy will never come back,
+// marking that copy lost. Its user is charged
+// the lost book fee, along with the fine if the loan is overdue
+func (s loanStore) MarkLost(id int) (config.Loan, error) {
+	loan := config.Loan{}
+	err := s.b.update(func(tx txn) error {
+		if err := loadTxLoan(tx, id, &loan); err != nil {
+			return err
+		}
+		if err := loan.CanMoveTo(config.LoanLost); err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := chargeTxFines(tx, &loan, now, true); err != nil {
+			return err
+		}
+		loan.Status = config.LoanLost
+		loan.LostAt = &now
+
+		if err := releaseTxItem(tx, loan, true); err != nil {
+			return err
+		}
+
+		if err := removeLoanFromUser(tx, loan); err != nil {
+			return err
+		}
+		return archiveLoan(tx, loan)
+	})
+	return loan, err
+}
+
+// checkTxLoan runs check on loan for user, with the open loans
+// and the balance of the user as they are in tx
+func checkTxLoan(tx txn, loan config.Loan, user config.UserCredentials, check LoanCheck) error {
+	if check == nil {
+		return nil
+	}
+	openLoans, balance, err := getTxBorrower(tx, user)
+	if err != nil {
+		return err
+	}
+	return check(loan, user, openLoans, balance)
+}
+
+// getTxBorrower returns the open loans of user, and what they owe
+func getTxBorrower(tx txn, user config.UserCredentials) ([]config.Loan, int, error) {
+	openLoans := []config.Loan{}
+	for _, id := range user.LoanIDArray {
+		open := config.Loan{}
+		err := getTxRecord(tx, intKey(LoanPrefix, id), &open)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		openLoans = append(openLoans, open)
+	}
+	ledger := []config.LedgerEntry{}
+	if err := getTxRecord(tx, fineKey(user.Username), &ledger); err != nil && err != ErrNotFound {
+		return nil, 0, err
+	}
+	return openLoans, config.LedgerBalance(ledger), nil
+}
+
+// loadTxLoan loads a loan afresh, as a retried transaction
+// must not see what an earlier attempt changed
+func loadTxLoan(tx txn, id int, loan *config.Loan) error {
+	*loan = config.Loan{}
+	return getTxRecord(tx, intKey(LoanPrefix, id), loan)
+}
+
+func (s loanStore) UserHistory(username string) ([]config.Loan, error) {
+	return s.history(UserHistoryPrefix + strings.ToLower(username))
+}
+
+func (s loanStore) BookHistory(bookID int) ([]config.Loan, error) {
+	return s.history(intKey(BookHistoryPrefix, bookID))
+}
+
+func (s loanStore) history(indexKey string) ([]config.Loan, error) {
+	loanIDs := []int{}
+	err := getRecord(s.b, indexKey, &loanIDs)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	loans := make([]config.Loan, 0, len(loanIDs))
+	for i := len(loanIDs) - 1; i >= 0; i-- {
+		loan := config.Loan{}
+		if err := getRecord(s.b, intKey(LoanHistoryPrefix, loanIDs[i]), &loan); err != nil {
+			return nil, err
+		}
+		loans = append(loans, loan)
+	}
+	return loans, nil
+}
+
+// openTxLoan saves a new loan and lists it among the open loans of its book,
+// which keeps the book from being deleted until the loan is closed
+func openTxLoan(tx txn, loan config.Loan) error {
+	if err := saveTxRecord(tx, intKey(LoanPrefix, loan.ID), loan); err != nil {
+		return err
+	}
+	return appendTxID(tx, intKey(OpenLoanPrefix, loan.BookID), loan.ID)
+}
+
+// archiveLoan moves a closed loan out of the open loans into the loan history
+func archiveLoan(tx txn, loan config.Loan) error {
+	tx.del(intKey(LoanPrefix, loan.ID))
+	if err := removeTxID(tx, intKey(OpenLoanPrefix, loan.BookID), loan.ID); err != nil {
+		return err
+	}
+	if err := saveTxRecord(tx, intKey(LoanHistoryPrefix, loan.ID), loan); err != nil {
+		return err
+	}
+	if err := appendTxID(tx, UserHistoryPrefix+strings.ToLower(loan.Username), loan.ID); err != nil {
+		return err
+	}
+	return appendTxID(tx, intKey(BookHistoryPrefix, loan.BookID), loan.ID)
+}
+
+func appendTxID(tx txn, indexKey string, id int) error {
+	ids := []int{}
+	err := getTxRecord(tx, indexKey, &ids)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	return saveTxRecord(tx, indexKey, append(ids, id))
+}
+
+// removeTxID takes id off the index, which is deleted once it is empty
+func removeTxID(tx txn, indexKey string, id int) error {
+	ids := []int{}
+	err := getTxRecord(tx, indexKey, &ids)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	kept := make([]int, 0, len(ids))
+	for _, other := range ids {
+		if other != id {
+			kept = append(kept, other)
+		}
+	}
+	if len(kept) == 0 {
+		tx.del(indexKey)
+		return nil
+	}
+	return saveTxRecord(tx, indexKey, kept)
+}
+
+func removeLoanFromUser(tx txn, loan config.Loan) error {
+	key := userKey(loan.Username)
+	user := config.UserCredentials{}
+	err := getTxRecord(tx, key, &user)
+	if err == ErrNotFound {
+		// the account is gone, nothing to clean up
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	loanIDs := make([]int, 0, len(user.LoanIDArray))
+	for _, loanID := range user.LoanIDArray {
+		if loanID != loan.ID {
+			loanIDs = append(loanIDs, loanID)
+		}
+	}
+	user.LoanIDArray = loanIDs
+	return saveTxRecord(tx, key, user)
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// memoryBackend keeps every record in process memory.
+// It is meant for development and tests, data is lost on restart.
+type memoryBackend struct {
+	mu     sync.RWMutex
+	data   map[string][]byte
+	hashes map[string]map[string][]byte
+	// indexes holds the keys of each index
+	indexes map[string]map[string]bool
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		data:    make(map[string][]byte),
+		hashes:  make(map[string]map[string][]byte),
+		indexes: make(map[string]map[string]bool),
+	}
+}
+
+func (m *memoryBackend) ping() error {
+	return nil
+}
+
+func (m *memoryBackend) get(key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	val, ok := m.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+func (m *memoryBackend) set(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryBackend) del(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+	delete(m.hashes, key)
+	delete(m.indexes, key)
+	return nil
+}
+
+func (m *memoryBackend) scan(prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var keys []string
+	for key := range m.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range m.hashes {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range m.indexes {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *memoryBackend) hgetall(key string) (map[string][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	fields := map[string][]byte{}
+	for field, val := range m.hashes[key] {
+		fields[field] = append([]byte(nil), val...)
+	}
+	return fields, nil
+}
+
+func (m *memoryBackend) indexed(index, prefix string, limit int) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var keys []string
+	for key := range m.indexes[index] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+func (m *memoryBackend) incr(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var counter int64
+	if val, ok := m.data[key]; ok {
+		var err error
+		counter, err = strconv.ParseInt(string(val), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+	counter++
+	m.data[key] = []byte(strconv.FormatInt(counter, 10))
+	return counter, nil
+}
+
+func (m *memoryBackend) update(fn func(tx txn) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tx := &memoryTxn{m: m}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for _, write := range tx.writes {
+		switch {
+		case write.field != "":
+			m.writeField(write)
+		case write.deleted:
+			delete(m.data, write.key)
+		default:
+			m.data[write.key] = write.value
+		}
+	}
+	return nil
+}
+
+// writeField applies a write to a field of a hash, keeping its index in step
+func (m *memoryBackend) writeField(write pendingWrite) {
+	if write.deleted {
+		delete(m.hashes[write.key], write.field)
+		if len(m.hashes[write.key]) == 0 {
+			delete(m.hashes, write.key)
+			delete(m.indexes[write.index], write.key)
+		}
+		return
+	}
+	if m.hashes[write.key] == nil {
+		m.hashes[write.key] = map[string][]byte{}
+	}
+	m.hashes[write.key][write.field] = write.value
+	if m.indexes[write.index] == nil {
+		m.indexes[write.index] = map[string]bool{}
+	}
+	m.indexes[write.index][write.key] = true
+}
+
+// memoryTxn runs while the backend's write lock is held
+type memoryTxn struct {
+	m      *memoryBackend
+	writes writeBuffer
+}
+
+func (tx *memoryTxn) get(key string) ([]byte, error) {
+	return tx.writes.readThrough(key, func(key string) ([]byte, error) {
+		val, ok := tx.m.data[key]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		return append([]byte(nil), val...), nil
+	})
+}
+
+func (tx *memoryTxn) set(key string, value []byte) {
+	tx.writes.set(key, value)
+}
+
+func (tx *memoryTxn) del(key string) {
+	tx.writes.del(key)
+}
+
+func (tx *memoryTxn) hset(index, key, field string, value []byte) {
+	tx.writes.hset(index, key, field, value)
+}
+
+func (tx *memoryTxn) hdel(index, key, field string) {
+	tx.writes.hdel(index, key, field)
+}
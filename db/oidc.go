@@ -0,0 +1,39 @@
+package db
+
+import (
+	"evl-book-server/config"
+	"time"
+)
+
+type oidcLoginStore struct{ b backend }
+
+func (s oidcLoginStore) Start(state string, login config.OIDCLogin) error {
+	key := OIDCLoginPrefix + state
+	if err := saveRecord(s.b, key, login); err != nil {
+		return err
+	}
+	if e, ok := s.b.(expirer); ok {
+		return e.expireAt(key, login.ExpiresAt)
+	}
+	return nil
+}
+
+func (s oidcLoginStore) Finish(state string) (config.OIDCLogin, error) {
+	key := OIDCLoginPrefix + state
+	login := config.OIDCLogin{}
+	err := s.b.update(func(tx txn) error {
+		login = config.OIDCLogin{}
+		if err := getTxRecord(tx, key, &login); err != nil {
+			return err
+		}
+		tx.del(key)
+		return nil
+	})
+	if err != nil {
+		return config.OIDCLogin{}, err
+	}
+	if !time.Now().Before(login.ExpiresAt) {
+		return config.OIDCLogin{}, ErrNotFound
+	}
+	return login, nil
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/go-redis/redis"
 	"github.com/spf13/viper"
 	"log"
+	"time"
 )
 
 var redisClient RedisClient
@@ -15,8 +16,21 @@ type RedisClient struct {
 
 const (
 	RedisNilErr = "redis: nil"
+	// maxTxRetries is how many times an optimistic transaction
+	// is retried when a watched key changes under it
+	maxTxRetries = 50
 )
 
+// hdelScript deletes a field of the hash at KEYS[1], and drops the hash
+// from the index at KEYS[2] once it is empty, in one step
+var hdelScript = redis.NewScript(`
+redis.call("HDEL", KEYS[1], ARGV[1])
+if redis.call("HLEN", KEYS[1]) == 0 then
+	redis.call("ZREM", KEYS[2], KEYS[1])
+end
+return 0
+`)
+
 // Setup setups the redis client instance with the requied infos
 func (r *RedisClient) SetupMyRedis() {
 	r.Client = redis.NewClient(&redis.Options{
@@ -98,6 +112,136 @@ func RemoveByKey(key string) error {
 	return err
 }
 
+// redisBackend stores records in the redis instance
+type redisBackend struct {
+	client *RedisClient
+}
+
+func (r *redisBackend) ping() error {
+	return r.client.Ping().Err()
+}
+
+func (r *redisBackend) get(key string) ([]byte, error) {
+	val, err := r.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return val, err
+}
+
+func (r *redisBackend) set(key string, value []byte) error {
+	return r.client.Set(key, value, 0).Err()
+}
+
+func (r *redisBackend) del(key string) error {
+	return r.client.Del(key).Err()
+}
+
+func (r *redisBackend) expireAt(key string, at time.Time) error {
+	return r.client.ExpireAt(key, at).Err()
+}
+
+func (r *redisBackend) scan(prefix string) ([]string, error) {
+	return ScanKeysByPrefix(prefix)
+}
+
+func (r *redisBackend) incr(key string) (int64, error) {
+	return r.client.Incr(key).Result()
+}
+
+func (r *redisBackend) hgetall(key string) (map[string][]byte, error) {
+	values, err := r.client.HGetAll(key).Result()
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string][]byte, len(values))
+	for field, val := range values {
+		fields[field] = []byte(val)
+	}
+	return fields, nil
+}
+
+// indexed reads a range of the sorted set at index, whose members all have
+// the same score, so that they are ordered by their bytes
+func (r *redisBackend) indexed(index, prefix string, limit int) ([]string, error) {
+	by := redis.ZRangeBy{Min: "-", Max: "+", Count: int64(limit)}
+	if prefix != "" {
+		by.Min, by.Max = "["+prefix, "("+prefix+"\xff"
+	}
+	return r.client.ZRangeByLex(index, by).Result()
+}
+
+// update uses WATCH/MULTI/EXEC: every key read inside fn is watched,
+// and the queued writes are applied only if none of them changed meanwhile.
+func (r *redisBackend) update(fn func(tx txn) error) error {
+	for i := 0; i < maxTxRetries; i++ {
+		err := r.client.Watch(func(tx *redis.Tx) error {
+			rtx := &redisTxn{tx: tx}
+			if err := fn(rtx); err != nil {
+				return err
+			}
+			if len(rtx.writes) == 0 {
+				return nil
+			}
+			_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+				for _, write := range rtx.writes {
+					switch {
+					case write.field != "" && write.deleted:
+						hdelScript.Eval(pipe, []string{write.key, write.index}, write.field)
+					case write.field != "":
+						pipe.HSet(write.key, write.field, write.value)
+						pipe.ZAdd(write.index, redis.Z{Member: write.key})
+					case write.deleted:
+						pipe.Del(write.key)
+					default:
+						pipe.Set(write.key, write.value, 0)
+					}
+				}
+				return nil
+			})
+			return err
+		})
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return ErrTxConflict
+}
+
+type redisTxn struct {
+	tx     *redis.Tx
+	writes writeBuffer
+}
+
+func (rtx *redisTxn) get(key string) ([]byte, error) {
+	return rtx.writes.readThrough(key, func(key string) ([]byte, error) {
+		if err := rtx.tx.Watch(key).Err(); err != nil {
+			return nil, err
+		}
+		val, err := rtx.tx.Get(key).Bytes()
+		if err == redis.Nil {
+			return nil, ErrNotFound
+		}
+		return val, err
+	})
+}
+
+func (rtx *redisTxn) set(key string, value []byte) {
+	rtx.writes.set(key, value)
+}
+
+func (rtx *redisTxn) del(key string) {
+	rtx.writes.del(key)
+}
+
+func (rtx *redisTxn) hset(index, key, field string, value []byte) {
+	rtx.writes.hset(index, key, field, value)
+}
+
+func (rtx *redisTxn) hdel(index, key, field string) {
+	rtx.writes.hdel(index, key, field)
+}
+
 func CloseRedis() {
 	log.Println("closed redis client")
 	err := redisClient.Close()
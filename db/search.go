@@ -0,0 +1,88 @@
+package db
+
+import (
+	"evl-book-server/search"
+	"strconv"
+	"strings"
+)
+
+// The records of each term are the fields of a hash under the term's key,
+// holding their weights, and the keys of the terms are kept in the
+// lexically ordered SearchTermIndex. A lookup reads at most MaxLookupTerms
+// terms starting with the prefix off the index, and their hashes, never
+// scanning the keyspace. Indexing a record watches only its own terms
+// under SearchDocPrefix, so records indexed at the same time don't conflict.
+const MaxLookupTerms = 100
+
+type searchStore struct{ b backend }
+
+func (s searchStore) Index(key string, terms map[string]int) error {
+	return s.b.update(func(tx txn) error {
+		old := map[string]int{}
+		if err := getTxRecord(tx, SearchDocPrefix+key, &old); err != nil && err != ErrNotFound {
+			return err
+		}
+		for term := range old {
+			if _, ok := terms[term]; !ok {
+				tx.hdel(SearchTermIndex, SearchTermPrefix+term, key)
+			}
+		}
+		for term, weight := range terms {
+			if old[term] != weight {
+				tx.hset(SearchTermIndex, SearchTermPrefix+term, key, []byte(strconv.Itoa(weight)))
+			}
+		}
+		if len(terms) == 0 {
+			tx.del(SearchDocPrefix + key)
+			return nil
+		}
+		return saveTxRecord(tx, SearchDocPrefix+key, terms)
+	})
+}
+
+func (s searchStore) Remove(key string) error {
+	return s.Index(key, nil)
+}
+
+func (s searchStore) Lookup(prefix string) (map[string]search.Postings, error) {
+	termKeys, err := s.b.indexed(SearchTermIndex, SearchTermPrefix+prefix, MaxLookupTerms)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]search.Postings{}
+	for _, termKey := range termKeys {
+		weights, err := s.b.hgetall(termKey)
+		if err != nil {
+			return nil, err
+		}
+		postings := search.Postings{}
+		for key, weight := range weights {
+			if postings[key], err = strconv.Atoi(string(weight)); err != nil {
+				return nil, err
+			}
+		}
+		// the term may have lost its last record since it was read off the index
+		if len(postings) > 0 {
+			found[strings.TrimPrefix(termKey, SearchTermPrefix)] = postings
+		}
+	}
+	return found, nil
+}
+
+func (s searchStore) Clear() error {
+	keys, err := s.b.indexed(SearchTermIndex, "", 0)
+	if err != nil {
+		return err
+	}
+	docKeys, err := s.b.scan(SearchDocPrefix)
+	if err != nil {
+		return err
+	}
+	keys = append(append(keys, docKeys...), SearchTermIndex)
+	for _, key := range keys {
+		if err := s.b.del(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,464 @@
+package db
+
+import (
+	"encoding/json"
+	"evl-book-server/config"
+	"evl-book-server/search"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AuthorPrefix = "author_"
+	BookPrefix   = "book_"
+	UserPrefix   = "user_"
+	LoanPrefix   = "loan_"
+	HoldPrefix   = "hold_"
+	FinePrefix   = "fine_"
+	// IssuedTokenPrefix keys list the tokens handed out to each user,
+	// RevokedTokenPrefix keys make up the denylist of revoked token IDs
+	IssuedTokenPrefix  = "tokens_"
+	RevokedTokenPrefix = "revoked_"
+	// failed logins are counted per username and per client IP
+	UserAttemptPrefix = "failed_login_user_"
+	IPAttemptPrefix   = "failed_login_ip_"
+	AuditPrefix       = "audit_"
+	APIKeyPrefix      = "apikey_"
+	OIDCLoginPrefix   = "oidc_login_"
+	// password reset requests are counted the same way
+	UserResetPrefix = "reset_request_user_"
+	IPResetPrefix   = "reset_request_ip_"
+	// items are the copies of books, found by barcode through BarcodePrefix keys
+	ItemPrefix    = "item_"
+	BarcodePrefix = "barcode_"
+	// the search index keeps the weight of each record of each term,
+	// the index of the terms, and the terms of each record
+	SearchTermPrefix = "search_term_"
+	SearchTermIndex  = "search_terms"
+	SearchDocPrefix  = "search_doc_"
+	// closed loans are kept under LoanHistoryPrefix, and indexed by user and by book
+	LoanHistoryPrefix = "history_loan_"
+	UserHistoryPrefix = "history_user_"
+	BookHistoryPrefix = "history_book_"
+	// OpenLoanPrefix keys list the open loans of each book
+	OpenLoanPrefix = "open_loans_"
+	// SequencePrefix keys hold the last ID handed out for each record type
+	SequencePrefix = "seq_"
+)
+
+// BookStore persists books. The works of the contributors of a book
+// are kept in line with its contributors as it is saved and deleted.
+// Saving a book adds AddCount items to it, deleting it deletes its items.
+type BookStore interface {
+	// Create assigns the next free ID to book, saves it and returns it as saved
+	Create(book config.Book) (config.Book, error)
+	Get(id int) (config.Book, error)
+	Exists(id int) (bool, error)
+	// Save fails with ErrNotFound if a new contributor doesn't exist
+	Save(book config.Book) error
+	// Delete fails with ErrBookOnLoan while a copy of the book is on
+	// loan, or a loan of the book is still open
+	Delete(id int) error
+	All() ([]config.Book, error)
+}
+
+// AuthorStore persists authors
+type AuthorStore interface {
+	// Create assigns the next free ID to author and saves it
+	Create(author config.Author) (config.Author, error)
+	Get(id int) (config.Author, error)
+	Exists(id int) (bool, error)
+	Save(author config.Author) error
+	// Update applies change to the saved author atomically,
+	// an error returned by change aborts the update
+	Update(id int, change func(author *config.Author) error) (config.Author, error)
+	// Delete removes an author, and takes them off the contributors of their books
+	Delete(id int) error
+	All() ([]config.Author, error)
+}
+
+// LoanStore persists loans. Every move of a loan from one state to another
+// is checked against the loan state machine, and updates the loan, its book
+// and its user as one atomic operation.
+type LoanStore interface {
+	// Create assigns the next free ID to loan, saves it and adds it to the
+	// loan list of its user, if check lets the user have it
+	Create(loan config.Loan, check LoanCheck) (config.Loan, error)
+	Get(id int) (config.Loan, error)
+	Exists(id int) (bool, error)
+	Save(loan config.Loan) error
+	Delete(id int) error
+	All() ([]config.Loan, error)
+	// Approve puts the copy with barcode on loan, or the first available one if barcode is empty
+	Approve(id int, barcode string, dueAt time.Time) (config.Loan, error)
+	CheckOut(id int, dueAt time.Time) (config.Loan, error)
+	Renew(id int, username string, period time.Duration, maxRenewals int) (config.Loan, error)
+	// Decline, Cancel, Return and MarkLost close a loan, moving it to the loan history
+	Decline(id int) (config.Loan, error)
+	Cancel(id int, username string) (config.Loan, error)
+	Return(id int) (config.Loan, error)
+	MarkLost(id int) (config.Loan, error)
+	// UserHistory and BookHistory return closed loans, the latest first
+	UserHistory(username string) ([]config.Loan, error)
+	BookHistory(bookID int) ([]config.Loan, error)
+}
+
+// LoanCheck decides if user can have loan, given their open loans and what
+// they owe. It runs inside the update that opens the loan, so concurrent
+// requests of the user are checked one after the other. A returned error
+// turns the loan down
+type LoanCheck func(loan config.Loan, user config.UserCredentials, openLoans []config.Loan, balance int) error
+
+// HoldStore keeps a first in, first out queue of holds per book
+type HoldStore interface {
+	// Place appends a hold of username to the queue of a book that
+	// has no copies available, and returns its position in the queue
+	Place(bookID int, username string) (int, error)
+	Cancel(bookID int, username string) error
+	Queue(bookID int) ([]config.Hold, error)
+	// BooksHeldBy returns the IDs of the books username has a hold on
+	BooksHeldBy(username string) ([]int, error)
+	// PromoteNext turns the oldest hold of a book, whose user check lets have
+	// the loan, into a pending loan request. Holds check turns down stay in
+	// the queue. It returns false if nobody can have the book.
+	PromoteNext(bookID int, check LoanCheck) (config.Loan, bool, error)
+	Clear(bookID int) error
+}
+
+// FineStore keeps the fines ledger of each user.
+// Fines are charged by LoanStore as loans are returned or lost.
+type FineStore interface {
+	Ledger(username string) ([]config.LedgerEntry, error)
+	// Balance returns what username owes
+	Balance(username string) (int, error)
+	// Record adds a charge or a credit to the ledger of its user
+	Record(entry config.LedgerEntry) (config.LedgerEntry, error)
+}
+
+// TokenStore keeps track of the tokens handed out to users, so that
+// they can be revoked before they expire. IDs are the jti claims.
+type TokenStore interface {
+	Issue(username, id string, expiresAt time.Time) error
+	// Revoke puts the token on the denylist until it expires
+	Revoke(id string, expiresAt time.Time) error
+	// RevokeOnce revokes the token, and returns false if it already was
+	RevokeOnce(id string, expiresAt time.Time) (bool, error)
+	IsRevoked(id string) (bool, error)
+	// RevokeAll revokes every token handed out to username
+	RevokeAll(username string) error
+}
+
+// LoginAttemptStore counts the failed logins of usernames or
+// IP addresses. Failures older than window are forgotten.
+type LoginAttemptStore interface {
+	Get(name string, window time.Duration) (config.LoginAttempts, error)
+	// Attempt counts a login of name as failed before it is verified, so
+	// parallel guesses can't all get in. allow sees the attempts so far,
+	// and turns the login down by returning an error; it is not counted then.
+	// name is locked out for lockFor once it failed lockAfter times in a row
+	Attempt(name string, window time.Duration, lockAfter int, lockFor time.Duration,
+		allow func(attempts config.LoginAttempts, now time.Time) error) (config.LoginAttempts, error)
+	// Release takes back an attempt of name that did not fail after all
+	Release(name string, window time.Duration) error
+	// Clear forgets the failed logins of name, lifting its lockout
+	Clear(name string) error
+}
+
+// AuditStore keeps the audit log
+type AuditStore interface {
+	// Record numbers and timestamps entry, and appends it to the log
+	Record(entry config.AuditEntry) (config.AuditEntry, error)
+	// All returns the log, the oldest entry first
+	All() ([]config.AuditEntry, error)
+}
+
+// APIKeyStore persists the API keys of service accounts by key ID
+type APIKeyStore interface {
+	Get(id string) (config.APIKey, error)
+	Save(key config.APIKey) error
+	Delete(id string) error
+	// All returns the keys, the oldest first
+	All() ([]config.APIKey, error)
+	// Touch sets the last use of a key to at
+	Touch(id string, at time.Time) error
+}
+
+// OIDCLoginStore keeps the OpenID Connect logins that have been
+// started by their state, until the user comes back or they expire
+type OIDCLoginStore interface {
+	Start(state string, login config.OIDCLogin) error
+	// Finish removes the login of state and returns it, so that it can
+	// be finished once. Expired logins are ErrNotFound
+	Finish(state string) (config.OIDCLogin, error)
+}
+
+// ItemStore persists the copies of books. The counts of a book
+// are derived from its items as they are added and change.
+type ItemStore interface {
+	Get(id int) (config.Item, error)
+	ByBarcode(barcode string) (config.Item, error)
+	// OfBook returns the items of a book, lost and retired ones included
+	OfBook(bookID int) ([]config.Item, error)
+	// Add gives the book of item a new copy. It fails with ErrBarcodeTaken
+	// if the barcode is in use, and makes up one if there is none
+	Add(item config.Item) (config.Item, error)
+	// Retire takes an item that is not on loan out of the collection
+	Retire(id int) (config.Item, error)
+	// Update applies change to the saved item atomically,
+	// an error returned by change aborts the update
+	Update(id int, change func(item *config.Item) error) (config.Item, error)
+}
+
+// SearchIndex is the full-text index of the catalogue. Records are
+// indexed by their key, with the weight of each of their terms
+type SearchIndex interface {
+	// Index replaces the terms indexed for the record of key
+	Index(key string, terms map[string]int) error
+	// Remove drops the record of key from the index
+	Remove(key string) error
+	// Lookup returns the records of the terms that start with prefix,
+	// of at most MaxLookupTerms of them, the first in lexical order
+	Lookup(prefix string) (map[string]search.Postings, error)
+	// Clear empties the index
+	Clear() error
+}
+
+// UserStore persists user accounts. Usernames are case insensitive.
+type UserStore interface {
+	Get(username string) (config.UserCredentials, error)
+	Exists(username string) (bool, error)
+	// Create saves a new user, it fails with ErrUserExists if the username is taken
+	Create(user config.UserCredentials) error
+	Save(user config.UserCredentials) error
+	// Update applies change to the saved user atomically,
+	// an error returned by change aborts the update
+	Update(username string, change func(user *config.UserCredentials) error) (config.UserCredentials, error)
+	// Delete removes a user that has no open loans
+	Delete(username string) error
+	All() ([]config.UserCredentials, error)
+}
+
+var store backend
+
+// InitStore sets up the storage backend selected in the config file
+func InitStore() {
+	switch backendName := config.Storage().Backend; backendName {
+	case config.MemoryBackend:
+		log.Println("setup in-memory store")
+		store = newMemoryBackend()
+	case config.RedisBackend:
+		InitRedis()
+		store = &redisBackend{&redisClient}
+	default:
+		log.Fatalf("unknown storage backend %q", backendName)
+	}
+}
+
+// IsStoreUp checks whether the storage backend is reachable
+func IsStoreUp() bool {
+	if err := store.ping(); err != nil {
+		log.Println("storage is down:", err.Error())
+		return false
+	}
+	return true
+}
+
+// Books returns the book store of the selected backend
+func Books() BookStore {
+	return bookStore{store}
+}
+
+// Authors returns the author store of the selected backend
+func Authors() AuthorStore {
+	return authorStore{store}
+}
+
+// Loans returns the loan store of the selected backend
+func Loans() LoanStore {
+	return loanStore{store}
+}
+
+// Holds returns the hold store of the selected backend
+func Holds() HoldStore {
+	return holdStore{store}
+}
+
+// Tokens returns the token store of the selected backend
+func Tokens() TokenStore {
+	return tokenStore{store}
+}
+
+// Fines returns the fine store of the selected backend
+func Fines() FineStore {
+	return fineStore{store}
+}
+
+// UserLoginAttempts returns the store of failed logins per username
+func UserLoginAttempts() LoginAttemptStore {
+	return attemptStore{store, UserAttemptPrefix}
+}
+
+// IPLoginAttempts returns the store of failed logins per client IP
+func IPLoginAttempts() LoginAttemptStore {
+	return attemptStore{store, IPAttemptPrefix}
+}
+
+// UserResetRequests returns the store of password reset requests per username
+func UserResetRequests() LoginAttemptStore {
+	return attemptStore{store, UserResetPrefix}
+}
+
+// IPResetRequests returns the store of password reset requests per client IP
+func IPResetRequests() LoginAttemptStore {
+	return attemptStore{store, IPResetPrefix}
+}
+
+// Audit returns the audit store of the selected backend
+func Audit() AuditStore {
+	return auditStore{store}
+}
+
+// APIKeys returns the API key store of the selected backend
+func APIKeys() APIKeyStore {
+	return apiKeyStore{store}
+}
+
+// OIDCLogins returns the OpenID Connect login store of the selected backend
+func OIDCLogins() OIDCLoginStore {
+	return oidcLoginStore{store}
+}
+
+// Items returns the item store of the selected backend
+func Items() ItemStore {
+	return itemStore{store}
+}
+
+// Search returns the search index of the selected backend
+func Search() SearchIndex {
+	return searchStore{store}
+}
+
+// Users returns the user store of the selected backend
+func Users() UserStore {
+	return userStore{store}
+}
+
+func getRecord(b backend, key string, record interface{}) error {
+	recordBytes, err := b.get(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(recordBytes, record)
+}
+
+func saveRecord(b backend, key string, record interface{}) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return b.set(key, recordBytes)
+}
+
+func getTxRecord(tx txn, key string, record interface{}) error {
+	recordBytes, err := tx.get(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(recordBytes, record)
+}
+
+func saveTxRecord(tx txn, key string, record interface{}) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	tx.set(key, recordBytes)
+	return nil
+}
+
+func recordExists(b backend, key string) (bool, error) {
+	_, err := b.get(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// scanRecords calls decode with the raw value of every record under prefix
+func scanRecords(b backend, prefix string, decode func([]byte) error) error {
+	keys, err := b.scan(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		recordBytes, err := b.get(key)
+		if err == ErrNotFound {
+			// removed while scanning
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := decode(recordBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextID hands out IDs from the sequence of prefix. Every call gets a
+// distinct value from the backend counter; values that are already taken by
+// records saved before sequences existed are skipped.
+func nextID(b backend, prefix string) (int, error) {
+	seqKey := SequencePrefix + strings.TrimSuffix(prefix, "_")
+	for {
+		id, err := b.incr(seqKey)
+		if err != nil {
+			return 0, err
+		}
+		ok, err := recordExists(b, intKey(prefix, int(id)))
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return int(id), nil
+		}
+	}
+}
+
+// nextTxID hands out IDs from the sequence of prefix inside an update,
+// where the backend can't be used directly. Updates that take IDs from
+// the same sequence at the same time conflict, and one is retried.
+func nextTxID(tx txn, prefix string) (int, error) {
+	seqKey := SequencePrefix + strings.TrimSuffix(prefix, "_")
+	for {
+		id := 0
+		if err := getTxRecord(tx, seqKey, &id); err != nil && err != ErrNotFound {
+			return 0, err
+		}
+		id++
+		if err := saveTxRecord(tx, seqKey, id); err != nil {
+			return 0, err
+		}
+		_, err := tx.get(intKey(prefix, id))
+		if err == ErrNotFound {
+			return id, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func intKey(prefix string, id int) string {
+	return prefix + strconv.Itoa(id)
+}
+
+func userKey(username string) string {
+	return UserPrefix + strings.ToLower(username)
+}
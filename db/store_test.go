@@ -0,0 +1,334 @@
+package db
+
+import (
+	"errors"
+	"evl-book-server/config"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const parallelWriters = 20
+
+// useMemoryStore gives the test an empty in-memory store
+func useMemoryStore() {
+	store = newMemoryBackend()
+}
+
+func addTestUser(t *testing.T, username string) {
+	if err := Users().Create(config.UserCredentials{Username: username}); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func addTestBook(t *testing.T, copies int) config.Book {
+	book, err := Books().Create(config.Book{BookName: "A Book", AddCount: copies})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return book
+}
+
+// runParallel runs write parallelWriters times at once
+func runParallel(write func()) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < parallelWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			write()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestUserCreate(t *testing.T) {
+	useMemoryStore()
+	addTestUser(t, "reader")
+	if err := Users().Create(config.UserCredentials{Username: "reader", Password: "taken"}); err != ErrUserExists {
+		t.Error("expected", ErrUserExists, "got", err)
+	}
+	user, err := Users().Get("reader")
+	if err != nil || user.Password != "" {
+		t.Error("expected the first user to be kept, got", user, err)
+	}
+}
+
+func TestUserUpdateConcurrently(t *testing.T) {
+	useMemoryStore()
+	addTestUser(t, "reader")
+	var next int32
+	runParallel(func() {
+		id := int(atomic.AddInt32(&next, 1))
+		_, err := Users().Update("reader", func(user *config.UserCredentials) error {
+			user.LoanIDArray = append(user.LoanIDArray, id)
+			return nil
+		})
+		if err != nil {
+			t.Error(err.Error())
+		}
+	})
+	user, err := Users().Get("reader")
+	if err != nil || len(user.LoanIDArray) != parallelWriters {
+		t.Error("expected every update to be kept, got", user.LoanIDArray, err)
+	}
+	if _, err := Users().Update("nobody", func(*config.UserCredentials) error { return nil }); err != ErrNotFound {
+		t.Error("expected", ErrNotFound, "got", err)
+	}
+}
+
+func TestLoanCreateCheck(t *testing.T) {
+	useMemoryStore()
+	addTestUser(t, "reader")
+	book := addTestBook(t, 1)
+	errTooMany := errors.New("too many loans")
+	const limit = 2
+	check := func(loan config.Loan, user config.UserCredentials, openLoans []config.Loan, balance int) error {
+		if len(openLoans) >= limit {
+			return errTooMany
+		}
+		return nil
+	}
+
+	var created, refused int32
+	runParallel(func() {
+		_, err := Loans().Create(config.Loan{BookID: book.ID, Username: "reader", Status: config.LoanRequested}, check)
+		switch err {
+		case nil:
+			atomic.AddInt32(&created, 1)
+		case errTooMany:
+			atomic.AddInt32(&refused, 1)
+		default:
+			t.Error(err.Error())
+		}
+	})
+	if created != limit || refused != parallelWriters-limit {
+		t.Error("expected", limit, "loans, got", created, "and", refused, "refused")
+	}
+}
+
+func TestLoanLifecycle(t *testing.T) {
+	useMemoryStore()
+	addTestUser(t, "reader")
+	addTestUser(t, "other")
+	book := addTestBook(t, 1)
+	dueAt := time.Now().Add(time.Hour)
+
+	loan, err := Loans().Create(config.Loan{BookID: book.ID, Username: "reader", Status: config.LoanRequested}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	other, err := Loans().Create(config.Loan{BookID: book.ID, Username: "other", Status: config.LoanRequested}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Books().Delete(book.ID); err != ErrBookOnLoan {
+		t.Error("expected", ErrBookOnLoan, "while loans are open, got", err)
+	}
+	if _, err := Loans().Approve(loan.ID, "", dueAt); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := Loans().Approve(other.ID, "", dueAt); err != ErrNoCopyAvailable {
+		t.Error("expected", ErrNoCopyAvailable, "for the only copy, got", err)
+	}
+	if _, err := Loans().CheckOut(loan.ID, dueAt); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	returned, err := Loans().Return(loan.ID)
+	if err != nil || returned.Status != config.LoanReturned {
+		t.Fatal("expected the loan to be returned, got", returned, err)
+	}
+	user, err := Users().Get("reader")
+	if err != nil || len(user.LoanIDArray) != 0 {
+		t.Error("expected the loan to be dropped from the user, got", user.LoanIDArray, err)
+	}
+	book, err = Books().Get(book.ID)
+	if err != nil || book.OnLoanCount != 0 || book.Available() != 1 {
+		t.Error("expected the copy back on the shelf, got", book, err)
+	}
+	if _, err := Loans().Approve(other.ID, "", dueAt); err != nil {
+		t.Error("expected the returned copy to be lent again, got", err)
+	}
+}
+
+func TestLoanNotPickedUpIsNotOverdue(t *testing.T) {
+	useMemoryStore()
+	addTestUser(t, "reader")
+	book := addTestBook(t, 1)
+	loan, err := Loans().Create(config.Loan{BookID: book.ID, Username: "reader", Status: config.LoanRequested}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := Loans().Approve(loan.ID, "", time.Now().Add(-72*time.Hour)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	returned, err := Loans().Return(loan.ID)
+	if err != nil || returned.Fine != 0 {
+		t.Error("expected no fine for a loan that was never checked out, got", returned, err)
+	}
+	if balance, err := Fines().Balance("reader"); err != nil || balance != 0 {
+		t.Error("expected nothing owed, got", balance, err)
+	}
+}
+
+func TestHoldPromoteNext(t *testing.T) {
+	useMemoryStore()
+	addTestUser(t, "blocked")
+	addTestUser(t, "patient")
+	book := addTestBook(t, 0)
+	for _, username := range []string{"blocked", "patient"} {
+		if _, err := Holds().Place(book.ID, username); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if _, err := Holds().Place(book.ID, "PATIENT"); err != ErrAlreadyOnHold {
+		t.Error("expected", ErrAlreadyOnHold, "got", err)
+	}
+
+	errBlocked := errors.New("blocked")
+	check := func(loan config.Loan, user config.UserCredentials, openLoans []config.Loan, balance int) error {
+		if user.Username == "blocked" {
+			return errBlocked
+		}
+		return nil
+	}
+	loan, promoted, err := Holds().PromoteNext(book.ID, check)
+	if err != nil || !promoted || loan.Username != "patient" {
+		t.Fatal("expected the second hold to be promoted, got", loan, promoted, err)
+	}
+	queue, err := Holds().Queue(book.ID)
+	if err != nil || len(queue) != 1 || queue[0].Username != "blocked" {
+		t.Error("expected the refused hold to keep its place, got", queue, err)
+	}
+	user, err := Users().Get("patient")
+	if err != nil || len(user.LoanIDArray) != 1 || user.LoanIDArray[0] != loan.ID {
+		t.Error("expected the loan to be given to the user, got", user.LoanIDArray, err)
+	}
+}
+
+func TestTokenRevokeOnce(t *testing.T) {
+	useMemoryStore()
+	var consumed int32
+	runParallel(func() {
+		revoked, err := Tokens().RevokeOnce("refresh", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Error(err.Error())
+		}
+		if revoked {
+			atomic.AddInt32(&consumed, 1)
+		}
+	})
+	if consumed != 1 {
+		t.Error("expected the token to be used once, got", consumed)
+	}
+	if revoked, err := Tokens().IsRevoked("refresh"); err != nil || !revoked {
+		t.Error("expected the token to be revoked, got", revoked, err)
+	}
+}
+
+func TestLoginAttempts(t *testing.T) {
+	useMemoryStore()
+	const lockAfter = 5
+	errLocked := errors.New("locked")
+	allow := func(attempts config.LoginAttempts, now time.Time) error {
+		if attempts.LockedUntil != nil && now.Before(*attempts.LockedUntil) {
+			return errLocked
+		}
+		return nil
+	}
+
+	var counted, refused int32
+	runParallel(func() {
+		_, err := UserLoginAttempts().Attempt("reader", time.Hour, lockAfter, time.Hour, allow)
+		switch err {
+		case nil:
+			atomic.AddInt32(&counted, 1)
+		case errLocked:
+			atomic.AddInt32(&refused, 1)
+		default:
+			t.Error(err.Error())
+		}
+	})
+	if counted != lockAfter || refused != parallelWriters-lockAfter {
+		t.Error("expected", lockAfter, "attempts before the lock, got", counted, "and", refused, "refused")
+	}
+
+	if err := UserLoginAttempts().Release("reader", time.Hour); err != nil {
+		t.Fatal(err.Error())
+	}
+	attempts, err := UserLoginAttempts().Get("READER", time.Hour)
+	if err != nil || attempts.Failures != lockAfter-1 || attempts.LockedUntil == nil {
+		t.Error("expected a released attempt to keep the lock, got", attempts, err)
+	}
+	if err := UserLoginAttempts().Clear("reader"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if attempts, err := UserLoginAttempts().Get("reader", time.Hour); err != nil || attempts.Failures != 0 {
+		t.Error("expected the attempts to be cleared, got", attempts, err)
+	}
+}
+
+func TestSearchIndexConcurrently(t *testing.T) {
+	useMemoryStore()
+	var next int32
+	runParallel(func() {
+		key := BookPrefix + string(rune('a'+atomic.AddInt32(&next, 1)))
+		if err := Search().Index(key, map[string]int{"shared": 2, "shore": 1}); err != nil {
+			t.Error(err.Error())
+		}
+	})
+	found, err := Search().Lookup("sh")
+	if err != nil || len(found["shared"]) != parallelWriters || len(found["shore"]) != parallelWriters {
+		t.Error("expected every record under both terms, got", found, err)
+	}
+
+	if err := Search().Index(BookPrefix+"b", map[string]int{"shared": 3}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Search().Remove(BookPrefix + "c"); err != nil {
+		t.Fatal(err.Error())
+	}
+	found, err = Search().Lookup("sho")
+	if err != nil || len(found) != 1 || len(found["shore"]) != parallelWriters-2 {
+		t.Error("expected the dropped terms to be gone, got", found, err)
+	}
+	if found, _ = Search().Lookup("shared"); found["shared"][BookPrefix+"b"] != 3 {
+		t.Error("expected the new weight, got", found)
+	}
+}
+
+// noScanBackend fails the test on every scan of the keyspace
+type noScanBackend struct {
+	backend
+	t *testing.T
+}
+
+func (b noScanBackend) scan(prefix string) ([]string, error) {
+	b.t.Error("unexpected scan of", prefix)
+	return b.backend.scan(prefix)
+}
+
+func TestSearchLookupDoesNotScan(t *testing.T) {
+	memory := newMemoryBackend()
+	store = noScanBackend{memory, t}
+	if err := Search().Index(BookPrefix+"1", map[string]int{"sea": 1, "search": 2}); err != nil {
+		t.Fatal(err.Error())
+	}
+	found, err := Search().Lookup("se")
+	if err != nil || len(found) != 2 || found["search"][BookPrefix+"1"] != 2 {
+		t.Error("expected both terms of the record, got", found, err)
+	}
+
+	if err := Search().Remove(BookPrefix + "1"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if found, err := Search().Lookup("se"); err != nil || len(found) != 0 {
+		t.Error("expected the removed record to be gone, got", found, err)
+	}
+	if terms, _ := memory.indexed(SearchTermIndex, "", 0); len(terms) != 0 {
+		t.Error("expected the terms without records to leave the index, got", terms)
+	}
+}
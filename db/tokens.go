@@ -0,0 +1,113 @@
+package db
+
+import (
+	"strings"
+	"time"
+)
+
+type tokenStore struct{ b backend }
+
+// issuedToken is an entry of the list of tokens handed out to a user
+type issuedToken struct {
+	ID        string
+	ExpiresAt time.Time
+}
+
+func (s tokenStore) Issue(username, id string, expiresAt time.Time) error {
+	key := issuedTokensKey(username)
+	return s.b.update(func(tx txn) error {
+		issued, err := getTxIssuedTokens(tx, key)
+		if err != nil {
+			return err
+		}
+		// tokens that expired don't need revoking anymore
+		now := time.Now()
+		live := make([]issuedToken, 0, len(issued)+1)
+		for _, token := range issued {
+			if token.ExpiresAt.After(now) {
+				live = append(live, token)
+			}
+		}
+		return saveTxRecord(tx, key, append(live, issuedToken{ID: id, ExpiresAt: expiresAt}))
+	})
+}
+
+func (s tokenStore) Revoke(id string, expiresAt time.Time) error {
+	key := RevokedTokenPrefix + id
+	if err := saveRecord(s.b, key, expiresAt); err != nil {
+		return err
+	}
+	if e, ok := s.b.(expirer); ok {
+		return e.expireAt(key, expiresAt)
+	}
+	return nil
+}
+
+func (s tokenStore) RevokeOnce(id string, expiresAt time.Time) (bool, error) {
+	key := RevokedTokenPrefix + id
+	revoked := false
+	err := s.b.update(func(tx txn) error {
+		_, err := tx.get(key)
+		if err == nil {
+			revoked = false
+			return nil
+		}
+		if err != ErrNotFound {
+			return err
+		}
+		revoked = true
+		return saveTxRecord(tx, key, expiresAt)
+	})
+	if err != nil || !revoked {
+		return false, err
+	}
+	if e, ok := s.b.(expirer); ok {
+		return true, e.expireAt(key, expiresAt)
+	}
+	return true, nil
+}
+
+func (s tokenStore) IsRevoked(id string) (bool, error) {
+	return recordExists(s.b, RevokedTokenPrefix+id)
+}
+
+func (s tokenStore) RevokeAll(username string) error {
+	key := issuedTokensKey(username)
+	issued := []issuedToken{}
+	err := s.b.update(func(tx txn) error {
+		var err error
+		issued, err = getTxIssuedTokens(tx, key)
+		if err != nil {
+			return err
+		}
+		tx.del(key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, token := range issued {
+		if !token.ExpiresAt.After(now) {
+			continue
+		}
+		if err := s.Revoke(token.ID, token.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getTxIssuedTokens(tx txn, key string) ([]issuedToken, error) {
+	issued := []issuedToken{}
+	err := getTxRecord(tx, key, &issued)
+	if err == ErrNotFound {
+		return []issuedToken{}, nil
+	}
+	return issued, err
+}
+
+func issuedTokensKey(username string) string {
+	return IssuedTokenPrefix + strings.ToLower(username)
+}
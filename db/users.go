@@ -0,0 +1,83 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"evl-book-server/config"
+)
+
+var (
+	ErrUserHasLoans = errors.New("user has open loans, close them first")
+	ErrUserExists   = errors.New("username is taken")
+)
+
+type userStore struct{ b backend }
+
+func (s userStore) Get(username string) (config.UserCredentials, error) {
+	user := config.UserCredentials{}
+	err := getRecord(s.b, userKey(username), &user)
+	return user, err
+}
+
+func (s userStore) Exists(username string) (bool, error) {
+	return recordExists(s.b, userKey(username))
+}
+
+func (s userStore) Save(user config.UserCredentials) error {
+	return saveRecord(s.b, userKey(user.Username), user)
+}
+
+func (s userStore) Create(user config.UserCredentials) error {
+	return s.b.update(func(tx txn) error {
+		key := userKey(user.Username)
+		if _, err := tx.get(key); err != ErrNotFound {
+			if err == nil {
+				return ErrUserExists
+			}
+			return err
+		}
+		return saveTxRecord(tx, key, user)
+	})
+}
+
+func (s userStore) Delete(username string) error {
+	return s.b.update(func(tx txn) error {
+		user := config.UserCredentials{}
+		if err := getTxRecord(tx, userKey(username), &user); err != nil {
+			return err
+		}
+		if len(user.LoanIDArray) > 0 {
+			return ErrUserHasLoans
+		}
+		tx.del(userKey(username))
+		return nil
+	})
+}
+
+func (s userStore) All() ([]config.UserCredentials, error) {
+	users := []config.UserCredentials{}
+	err := scanRecords(s.b, UserPrefix, func(recordBytes []byte) error {
+		user := config.UserCredentials{}
+		if err := json.Unmarshal(recordBytes, &user); err != nil {
+			return err
+		}
+		users = append(users, user)
+		return nil
+	})
+	return users, err
+}
+
+func (s userStore) Update(username string, change func(user *config.UserCredentials) error) (config.UserCredentials, error) {
+	user := config.UserCredentials{}
+	err := s.b.update(func(tx txn) error {
+		user = config.UserCredentials{}
+		if err := getTxRecord(tx, userKey(username), &user); err != nil {
+			return err
+		}
+		if err := change(&user); err != nil {
+			return err
+		}
+		return saveTxRecord(tx, userKey(username), user)
+	})
+	return user, err
+}
@@ -0,0 +1,108 @@
+// Package isbn validates International Standard Book Numbers.
+//
+// ISBNs are written with or without hyphens and spaces. The 10 digit
+// form ends in a check digit that may be X; the 13 digit form starts
+// with 978 or 979. Every ISBN-10 has an ISBN-13 with the 978 prefix,
+// which is the form the catalogue stores.
+package isbn
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrLength is returned for numbers that have neither 10 nor 13 digits
+	ErrLength = errors.New("isbn has to have 10 or 13 digits")
+	// ErrChecksum is returned when the check digit doesn't match the rest of the number
+	ErrChecksum = errors.New("isbn check digit is wrong")
+	// ErrPrefix is returned for 13 digit numbers that don't start with 978 or 979
+	ErrPrefix = errors.New("isbn-13 has to start with 978 or 979")
+)
+
+// Normalize validates an ISBN-10 or ISBN-13 and returns it as 13 digits
+func Normalize(s string) (string, error) {
+	digits := strip(s)
+	switch len(digits) {
+	case 10:
+		if err := check10(digits); err != nil {
+			return "", err
+		}
+		return To13(digits), nil
+	case 13:
+		if err := check13(digits); err != nil {
+			return "", err
+		}
+		return digits, nil
+	}
+	return "", ErrLength
+}
+
+// To13 turns a valid ISBN-10 into its ISBN-13
+func To13(isbn10 string) string {
+	digits := "978" + strip(isbn10)[:9]
+	return digits + string(checkDigit13(digits))
+}
+
+// strip drops hyphens and spaces, and upper cases an x check digit
+func strip(s string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(s)))
+}
+
+func check10(digits string) error {
+	if !allDigits(digits[:9]) || !(allDigits(digits[9:]) || digits[9] == 'X') {
+		return ErrLength
+	}
+	if checkDigit10(digits[:9]) != digits[9] {
+		return ErrChecksum
+	}
+	return nil
+}
+
+func check13(digits string) error {
+	if !allDigits(digits) {
+		return ErrLength
+	}
+	if !strings.HasPrefix(digits, "978") && !strings.HasPrefix(digits, "979") {
+		return ErrPrefix
+	}
+	if checkDigit13(digits[:12]) != digits[12] {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// checkDigit10 weighs the first 9 digits 10 down to 2, modulo 11
+func checkDigit10(digits string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(digits[i]-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return byte('0' + check)
+}
+
+// checkDigit13 weighs the first 12 digits alternately 1 and 3, modulo 10
+func checkDigit13(digits string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(digits[i]-'0')
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+// Package notify delivers messages, such as password reset tokens, to users.
+//
+// The notifier is selected in the config file: smtp sends emails, while
+// file and log keep the messages locally, for development.
+package notify
+
+import (
+	"evl-book-server/config"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is addressed to the email address of a user
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages
+type Notifier interface {
+	Notify(msg Message) error
+}
+
+var notifier Notifier = logNotifier{}
+
+// Init sets up the notifier selected in the config file
+func Init() {
+	notifyCfg := config.Notify()
+	switch notifyCfg.Notifier {
+	case config.SMTPNotifier:
+		notifier = smtpNotifier{cfg: notifyCfg}
+	case config.FileNotifier:
+		notifier = &fileNotifier{path: notifyCfg.File, from: notifyCfg.From}
+	case config.LogNotifier:
+		notifier = logNotifier{}
+	default:
+		log.Fatalf("unknown notifier %q", notifyCfg.Notifier)
+	}
+}
+
+// Send delivers msg with the selected notifier
+func Send(msg Message) error {
+	return notifier.Notify(msg)
+}
+
+// smtpNotifier sends messages as plain text emails
+type smtpNotifier struct {
+	cfg config.NotifyConfig
+}
+
+func (n smtpNotifier) Notify(msg Message) error {
+	var auth smtp.Auth
+	if n.cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", n.cfg.SMTPUsername, n.cfg.SMTPPassword, n.cfg.SMTPHost)
+	}
+	addr := n.cfg.SMTPHost + ":" + strconv.Itoa(n.cfg.SMTPPort)
+	return smtp.SendMail(addr, auth, n.cfg.From, []string{msg.To}, []byte(format(n.cfg.From, msg)))
+}
+
+// fileNotifier appends messages to a file
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+	from string
+}
+
+func (n *fileNotifier) Notify(msg Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	file, err := os.OpenFile(n.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(format(n.from, msg) + "\r\n"); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// logNotifier writes messages to the server log
+type logNotifier struct{}
+
+func (logNotifier) Notify(msg Message) error {
+	log.Printf("message to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// format returns msg as an email
+func format(from string, msg Message) string {
+	headers := []string{
+		"From: " + from,
+		"To: " + msg.To,
+		"Subject: " + msg.Subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	body := strings.Replace(msg.Body, "\n", "\r\n", -1)
+	return fmt.Sprintf("%s\r\n\r\n%s\r\n", strings.Join(headers, "\r\n"), body)
+}
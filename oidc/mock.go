@@ -0,0 +1,201 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"evl-book-server/auth"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const mockTokenTTL = 5 * time.Minute
+
+// MockProvider is an OpenID Connect provider for development and tests.
+// It logs in whoever its claims say, without asking for anything
+type MockProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	key    *rsa.PrivateKey
+	keyID  string
+	mu     sync.Mutex
+	claims map[string]interface{}
+	grants map[string]mockGrant
+}
+
+// mockGrant is what an authorization code of the mock provider stands for
+type mockGrant struct {
+	claims      map[string]interface{}
+	nonce       string
+	redirectURI string
+}
+
+// NewMockProvider returns a mock provider for issuer, which
+// only hands out ID tokens to the client clientID
+func NewMockProvider(issuer, clientID, clientSecret string) (*MockProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	// every mock provider has a new key, which needs a kid of its own
+	keyHash := sha256.Sum256(key.PublicKey.N.Bytes())
+	return &MockProvider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		keyID:        "mock-" + hex.EncodeToString(keyHash[:6]),
+		claims:       map[string]interface{}{},
+		grants:       map[string]mockGrant{},
+	}, nil
+}
+
+// SetClaims sets the claims of the ID tokens of the next logins.
+// The sub claim defaults to the username in preferred_username
+func (m *MockProvider) SetClaims(claims map[string]interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.claims = claims
+}
+
+func (m *MockProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	issuerURL, err := url.Parse(m.Issuer)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, issuerURL.Path) {
+	case DiscoveryPath:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                m.Issuer,
+			"authorization_endpoint":                m.Issuer + "/authorize",
+			"token_endpoint":                        m.Issuer + "/token",
+			"jwks_uri":                              m.Issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{jwt.SigningMethodRS256.Alg()},
+		})
+	case "/authorize":
+		m.authorize(w, r)
+	case "/token":
+		m.token(w, r)
+	case "/jwks":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"keys": []auth.JWK{auth.NewJWK(m.keyID, &m.key.PublicKey)},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorize logs the user in right away, and sends them back with a code
+func (m *MockProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("redirect_uri") == "" {
+		http.Error(w, "redirect_uri is missing", http.StatusBadRequest)
+		return
+	}
+	if query.Get("client_id") != m.ClientID || query.Get("response_type") != "code" {
+		http.Error(w, "unknown client, or response type other than code", http.StatusBadRequest)
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	m.mu.Lock()
+	m.grants[code] = mockGrant{claims: m.claims, nonce: query.Get("nonce"), redirectURI: redirectURI.String()}
+	m.mu.Unlock()
+
+	back := redirectURI.Query()
+	back.Set("code", code)
+	back.Set("state", query.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token trades a code for an ID token, once
+func (m *MockProvider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	clientID, _ = url.QueryUnescape(clientID)
+	clientSecret, _ = url.QueryUnescape(clientSecret)
+	if clientID != m.ClientID || clientSecret != m.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	code := r.PostFormValue("code")
+	m.mu.Lock()
+	grant, ok := m.grants[code]
+	delete(m.grants, code)
+	m.mu.Unlock()
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != grant.redirectURI {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	for name, value := range grant.claims {
+		claims[name] = value
+	}
+	if claims["sub"] == nil {
+		claims["sub"] = claims["preferred_username"]
+	}
+	claims["iss"] = m.Issuer
+	claims["aud"] = m.ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(mockTokenTTL).Unix()
+	if grant.nonce != "" {
+		claims["nonce"] = grant.nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.keyID
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	accessToken, err := randomString()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(mockTokenTTL / time.Second),
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() (string, error) {
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
@@ -0,0 +1,239 @@
+// Package oidc lets users login with an OpenID Connect identity provider,
+// using the authorization code flow.
+//
+// The provider is discovered from its issuer URL. The ID token it hands out
+// for an authorization code is checked against the keys the provider
+// publishes, and must be issued by it, to the client, for the nonce of the
+// login. Providers sign with RS256 or EdDSA keys.
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"evl-book-server/auth"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// DiscoveryPath is where a provider publishes its configuration, under its issuer URL
+const DiscoveryPath = "/.well-known/openid-configuration"
+
+// the keys of a provider are fetched again at most this often,
+// so that tokens with made up kids can't flood the provider
+const keyRefreshInterval = 5 * time.Second
+
+var (
+	ErrInvalidIDToken = errors.New("id token not valid")
+	ErrUnknownKey     = errors.New("id token is signed with an unknown key")
+)
+
+// Provider is an OpenID Connect identity provider, as discovered
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	mu        sync.Mutex
+	keys      map[string]auth.JWK
+	fetchedAt time.Time
+}
+
+// tokenResponse is the answer of the token endpoint
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+var (
+	client = &http.Client{Timeout: 10 * time.Second}
+
+	// providers caches the discovered providers by issuer
+	providersMu sync.Mutex
+	providers   = map[string]*Provider{}
+)
+
+// Discover returns the provider of issuer, fetching its configuration
+// the first time. A failed discovery is tried again on the next call
+func Discover(issuer string) (*Provider, error) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if provider, ok := providers[issuer]; ok {
+		return provider, nil
+	}
+
+	provider := &Provider{}
+	if err := getJSON(issuer+DiscoveryPath, provider); err != nil {
+		return nil, err
+	}
+	if provider.Issuer != issuer {
+		return nil, fmt.Errorf("provider says its issuer is %q instead of %q", provider.Issuer, issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("provider configuration is missing endpoints")
+	}
+	providers[issuer] = provider
+	return provider, nil
+}
+
+// AuthCodeURL returns where to send the user to login with the provider.
+// The provider sends them back to redirectURL with a code and state
+func (p *Provider) AuthCodeURL(clientID, redirectURL, state, nonce string, scopes []string) string {
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", clientID)
+	query.Set("redirect_uri", redirectURL)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// Exchange trades an authorization code for the ID token of the user
+func (p *Provider) Exchange(code, clientID, clientSecret, redirectURL string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body := tokenResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint answered %d", res.StatusCode)
+	}
+	if res.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token endpoint refused the code: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token endpoint didn't hand out an id token")
+	}
+	return body.IDToken, nil
+}
+
+// VerifyIDToken checks the signature of an ID token, and that it was issued
+// by the provider to clientID for nonce, and hasn't expired. It returns its claims
+func (p *Provider) VerifyIDToken(rawIDToken, clientID, nonce string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(rawIDToken, p.verificationKey)
+	if err != nil {
+		if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Inner == ErrUnknownKey {
+			return nil, ErrUnknownKey
+		}
+		return nil, fmt.Errorf("%s: %s", ErrInvalidIDToken.Error(), err.Error())
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, ErrInvalidIDToken
+	}
+
+	switch {
+	case claims["iss"] != p.Issuer:
+		return nil, fmt.Errorf("%s: issued by %v", ErrInvalidIDToken.Error(), claims["iss"])
+	case !hasAudience(claims, clientID):
+		return nil, fmt.Errorf("%s: issued to %v", ErrInvalidIDToken.Error(), claims["aud"])
+	case claims["exp"] == nil:
+		return nil, fmt.Errorf("%s: it never expires", ErrInvalidIDToken.Error())
+	case claims["nonce"] != nonce:
+		return nil, fmt.Errorf("%s: nonce doesn't match", ErrInvalidIDToken.Error())
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, fmt.Errorf("%s: no subject", ErrInvalidIDToken.Error())
+	}
+	return claims, nil
+}
+
+// verificationKey picks the key of the provider an ID token is verified with
+// by its kid. Keys the provider rotated in are fetched when first seen
+func (p *Provider) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	jwk, ok, err := p.key(kid)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	publicKey, method, err := jwk.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	return publicKey, nil
+}
+
+func (p *Provider) key(kid string) (auth.JWK, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if jwk, ok := p.keys[kid]; ok || time.Since(p.fetchedAt) < keyRefreshInterval {
+		return jwk, ok, nil
+	}
+
+	jwks := struct {
+		Keys []auth.JWK `json:"keys"`
+	}{}
+	if err := getJSON(p.JWKSURI, &jwks); err != nil {
+		return auth.JWK{}, false, err
+	}
+	p.fetchedAt = time.Now()
+	p.keys = make(map[string]auth.JWK, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		p.keys[jwk.KeyID] = jwk
+	}
+	jwk, ok := p.keys[kid]
+	return jwk, ok, nil
+}
+
+// hasAudience tells if the aud claim, a string or a list, has clientID
+func hasAudience(claims jwt.MapClaims, clientID string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, audience := range aud {
+			if audience == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getJSON(url string, v interface{}) error {
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", url, res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
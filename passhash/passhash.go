@@ -0,0 +1,69 @@
+// Package passhash hashes and verifies user passwords.
+//
+// New hashes are bcrypt hashes, which carry their own random salt and are
+// recognized by their "$2a$" style format prefix. Hashes without a known
+// prefix are treated as the unsalted MD5 hex digests used by older versions
+// of the server, so existing accounts can still log in and get rehashed.
+package passhash
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cost is the bcrypt work factor used for new hashes
+const Cost = bcrypt.DefaultCost
+
+const bcryptPrefix = "$2"
+
+// ErrUnknownFormat is returned when a stored hash is neither bcrypt nor legacy MD5
+var ErrUnknownFormat = errors.New("unknown password hash format")
+
+// Hash returns a salted bcrypt hash of password
+func Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify reports whether password matches the stored hash
+func Verify(hash, password string) (bool, error) {
+	if strings.HasPrefix(hash, bcryptPrefix) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if isLegacyMD5(hash) {
+		sum := md5.Sum([]byte(password))
+		legacyHash := hex.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(legacyHash), []byte(strings.ToLower(hash))) == 1, nil
+	}
+	return false, ErrUnknownFormat
+}
+
+// NeedsRehash reports whether the stored hash should be replaced by a fresh
+// one, either because it uses a legacy format or an outdated bcrypt cost
+func NeedsRehash(hash string) bool {
+	if !strings.HasPrefix(hash, bcryptPrefix) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != Cost
+}
+
+func isLegacyMD5(hash string) bool {
+	if len(hash) != hex.EncodedLen(md5.Size) {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
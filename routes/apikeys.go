@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"encoding/json"
+	"evl-book-server/auth"
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+// apiKeyRequest is sent by the admin to create an API key
+type apiKeyRequest struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	// ExpiresInDays is how long the key works, 0 for as long as it isn't revoked
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+// createdAPIKey is a new key, along with the API key itself that is shown only once
+type createdAPIKey struct {
+	config.APIKey
+	Key string `json:"api_key"`
+}
+
+// GetAPIKeysHandler returns to admin the API keys, the oldest first
+func GetAPIKeysHandler(w http.ResponseWriter, _ *http.Request) {
+	keys, err := db.APIKeys().All()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(keys) == 0 {
+		_, _ = w.Write([]byte("no api keys found"))
+		return
+	}
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	JsonResponse(keys, w)
+}
+
+// CreateAPIKeyHandler is used by the admin to create an API key for a
+// service account. Keys can have any staff permission, and catalogue:read
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	body := apiKeyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "" || len(body.Permissions) == 0 {
+		http.Error(w, "name and permissions are required", http.StatusBadRequest)
+		return
+	}
+	for _, permission := range body.Permissions {
+		if !config.IsServicePermission(permission) {
+			http.Error(w, fmt.Sprintf("api keys can't have permission %q", permission), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.ExpiresInDays < 0 {
+		http.Error(w, "expires_in_days can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	key := config.APIKey{
+		Name:        body.Name,
+		Permissions: body.Permissions,
+		CreatedBy:   auth.PrincipalOf(r).Username,
+	}
+	if body.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, body.ExpiresInDays)
+		key.ExpiresAt = &expiresAt
+	}
+	key, apiKey, err := auth.NewAPIKey(key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	audit(config.AuditEntry{
+		Kind:  config.AuditAPIKeyCreated,
+		Actor: key.CreatedBy,
+		Note:  fmt.Sprintf("key %s for %s, allowed %v", key.ID, key.Name, key.Permissions),
+	})
+	key.Hash = ""
+	JsonResponse(createdAPIKey{APIKey: key, Key: apiKey}, w)
+}
+
+// RevokeAPIKeyHandler is used by the admin to delete an API key,
+// which stops working right away
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	key, err := db.APIKeys().Get(id)
+	if err == nil {
+		err = db.APIKeys().Delete(id)
+	}
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "api key doesn't exist", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	audit(config.AuditEntry{
+		Kind:  config.AuditAPIKeyRevoked,
+		Actor: auth.PrincipalOf(r).Username,
+		Note:  fmt.Sprintf("key %s for %s", key.ID, key.Name),
+	})
+	_, _ = w.Write([]byte("api key revoked"))
+}
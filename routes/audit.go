@@ -0,0 +1,33 @@
+package routes
+
+import (
+	"evl-book-server/db"
+	"net/http"
+	"strings"
+)
+
+// GetAuditLogHandler returns the audit log, the oldest entry first.
+// The username query parameter keeps the entries about that user
+func GetAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := db.Audit().All()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	username := r.URL.Query().Get("username")
+	if username != "" {
+		filtered := entries[:0]
+		for _, entry := range entries {
+			if strings.EqualFold(entry.Username, username) {
+				filtered = append(filtered, entry)
+			}
+		}
+		entries = filtered
+	}
+	if len(entries) == 0 {
+		_, _ = w.Write([]byte("no audit entries found"))
+		return
+	}
+	JsonResponse(entries, w)
+}
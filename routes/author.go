@@ -10,10 +10,12 @@ import (
 	"strconv"
 )
 
-// AuthorCreateHandler creates a new author using the given JSON
+// AuthorCreateHandler creates a new author using the given JSON.
+// The author ID is assigned by the server, and the created author is returned
 func AuthorCreateHandler(w http.ResponseWriter, r *http.Request) {
 	// assuming that we will receive json as signup form
 	author := getAuthorDetails(r)
+	author.ID = 0
 
 	// check for inconsistencies
 	validAuthor, err := validateAuthorCreate(author)
@@ -22,19 +24,14 @@ func AuthorCreateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// save author to db
-	authorKey := AuthorPrefix + strconv.Itoa(author.ID)
-	authorBytes, err := json.Marshal(validAuthor)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	err = db.SetJsonValues(authorKey, authorBytes)
+	createdAuthor, err := db.Authors().Create(validAuthor)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	indexAuthor(createdAuthor)
 
-	_, _ = w.Write([]byte("author added successfully"))
+	JsonResponse(createdAuthor, w)
 }
 
 // AuthorUpdateHandler updates author info using the given JSON
@@ -48,17 +45,21 @@ func AuthorUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	authorKey := AuthorPrefix + strconv.Itoa(author.ID)
-	authorBytes, err := json.Marshal(validAuthor)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	err = db.SetJsonValues(authorKey, authorBytes)
+	// the works of an author follow their books, only the name is updated
+	savedAuthor, err := db.Authors().Update(validAuthor.ID, func(author *config.Author) error {
+		author.AuthorName = validAuthor.AuthorName
+		return nil
+	})
 	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "author does not exist", http.StatusBadRequest)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	indexAuthor(savedAuthor)
+	reindexBooks(savedAuthor.Bibliography())
 
 	_, _ = w.Write([]byte("author added successfully"))
 }
@@ -66,15 +67,25 @@ func AuthorUpdateHandler(w http.ResponseWriter, r *http.Request) {
 // AuthorDeleteHandler deletes an author by ID
 func AuthorDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	authorID := vars["id"]
-
-	authorKey := AuthorPrefix + authorID
+	authorID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "author id has to be an integer", http.StatusBadRequest)
+		return
+	}
 
-	err := db.RemoveByKey(authorKey)
+	author, err := db.Authors().Get(authorID)
+	if err != nil && err != db.ErrNotFound {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// the books of the author stay, without the author among their contributors
+	err = db.Authors().Delete(authorID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	unindex(authorKey(authorID))
+	reindexBooks(author.Bibliography())
 
 	_, _ = w.Write([]byte("author deleted successfully"))
 }
@@ -82,13 +93,15 @@ func AuthorDeleteHandler(w http.ResponseWriter, r *http.Request) {
 // GetAuthorHandler returns an author's info by authorID
 func GetAuthorHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	authorID := vars["id"]
-
-	authorKey := AuthorPrefix + authorID
+	authorID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "author id has to be an integer", http.StatusBadRequest)
+		return
+	}
 
-	author, err := db.GetByteValues(authorKey)
+	author, err := db.Authors().Get(authorID)
 	if err != nil {
-		if err.Error() == db.RedisNilErr {
+		if err == db.ErrNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
@@ -96,35 +109,70 @@ func GetAuthorHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, _ = w.Write(author)
+	JsonResponse(author, w)
 }
 
-// GetAllAuthorsHandler returns an array of all authors' info
-func GetAllAuthorsHandler(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("Content-Type", "application/jsonResponse")
-	authorKeys, err := db.ScanKeysByPrefix(AuthorPrefix)
+// workView is a work of an author, with its book
+type workView struct {
+	Role string      `json:"role"`
+	Book config.Book `json:"book"`
+}
+
+// GetAuthorWorksHandler returns the books an author contributed to,
+// ordered by role. The role query parameter keeps the works in that role
+func GetAuthorWorksHandler(w http.ResponseWriter, r *http.Request) {
+	authorID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		http.Error(w, "author id has to be an integer", http.StatusBadRequest)
 		return
 	}
-	if len(authorKeys) == 0 {
-		_, _ = w.Write([]byte("no author has been added yet"))
+	role := r.URL.Query().Get("role")
+	if role != "" {
+		if err := config.CheckContributorRole(role); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	author, err := db.Authors().Get(authorID)
+	if err != nil {
+		if err == db.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	resultString := "["
-	for _, authorKey := range authorKeys {
-		author, err := db.GetSingleValue(authorKey)
+	works := []workView{}
+	for _, work := range author.Bibliography() {
+		if role != "" && work.Role != role {
+			continue
+		}
+		book, err := db.Books().Get(work.BookID)
+		if err == db.ErrNotFound {
+			continue
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if resultString != "[" {
-			resultString += ","
-		}
-		resultString += author
+		works = append(works, workView{Role: work.Role, Book: book})
+	}
+	JsonResponse(works, w)
+}
+
+// GetAllAuthorsHandler returns an array of all authors' info
+func GetAllAuthorsHandler(w http.ResponseWriter, _ *http.Request) {
+	authors, err := db.Authors().All()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(authors) == 0 {
+		_, _ = w.Write([]byte("no author has been added yet"))
+		return
 	}
-	resultString += "]"
-	_, _ = w.Write([]byte(resultString))
+	JsonResponse(authors, w)
 }
 
 func getAuthorDetails(r *http.Request) config.Author {
@@ -138,48 +186,18 @@ func getAuthorDetails(r *http.Request) config.Author {
 }
 
 func validateAuthorCreate(author config.Author) (config.Author, error) {
-	if author.AuthorName == "" || author.ID == 0 {
-		return config.Author{}, errors.New("author name or ID is missing")
-	}
-
-	authorKey := AuthorPrefix + strconv.Itoa(author.ID)
-	ok, err := isAuthorExistInDB(authorKey)
-	if err != nil {
-		return config.Author{}, err
-	}
-	if !ok {
-		return author, nil
+	if author.AuthorName == "" {
+		return config.Author{}, errors.New("author name is missing")
 	}
-	// author already exists
-	return config.Author{}, errors.New("author already exists")
-}
-
-func isAuthorExistInDB(key string) (bool, error) {
-	_, err := db.GetSingleValue(key)
-	if err != nil && err.Error() != db.RedisNilErr {
-		return false, err
-	}
-	if err != nil && err.Error() == db.RedisNilErr {
-		//author doesnt already exist
-		return false, nil
-	}
-	// author exists
-	return true, nil
+	// a new author has no books yet, they are added as books get created
+	author.AuthoredBookIDs = nil
+	author.Works = nil
+	return author, nil
 }
 
 func validateAuthorUpdate(author config.Author) (config.Author, error) {
 	if author.AuthorName == "" || author.ID == 0 {
 		return config.Author{}, errors.New("author name or ID is missing")
 	}
-	authorKey := AuthorPrefix + strconv.Itoa(author.ID)
-	ok, err := isAuthorExistInDB(authorKey)
-	if err != nil {
-		return config.Author{}, err
-	}
-	if !ok {
-		// author is new
-		return author, errors.New("author does not exist")
-	}
-	// author is old
 	return author, nil
 }
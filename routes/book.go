@@ -5,48 +5,53 @@ import (
 	"errors"
 	"evl-book-server/config"
 	"evl-book-server/db"
+	"fmt"
 	"github.com/gorilla/mux"
-	"log"
 	"net/http"
 	"strconv"
 )
 
 const (
-	AuthorPrefix = "author_"
-	BookPrefix   = "book_"
-	UserPrefix   = "user_"
-	LoanPrefix   = "loan_"
+	AuthorPrefix = db.AuthorPrefix
+	BookPrefix   = db.BookPrefix
+	UserPrefix   = db.UserPrefix
+	LoanPrefix   = db.LoanPrefix
 )
 
-// BookCreateHandler creates a new book using the given JSON
+// maxAddCount is the most copies that can be added to a book at once
+const maxAddCount = 100
+
+// BookCreateHandler creates a new book using the given JSON.
+// The book ID is assigned by the server, and the created book is returned
 func BookCreateHandler(w http.ResponseWriter, r *http.Request) {
 	// assuming that we will receive json as signup form
 	book := getBookDetails(r)
+	book.ID = 0
 
 	// check for inconsistencies
 	validBook, err := ValidateBookCreate(book)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		if err.Error() == db.RedisNilErr {
+		if err == db.ErrNotFound {
 			http.Error(w, "author doesn't exist", http.StatusBadRequest)
 		} else {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 		}
 		return
 	}
-	bookKey := BookPrefix + strconv.Itoa(book.ID)
-	bookBytes, err := json.Marshal(validBook)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	err = db.SetJsonValues(bookKey, bookBytes)
+	createdBook, err := db.Books().Create(validBook)
 	if err != nil {
+		if err == db.ErrNotFound {
+			// removed since the book was validated
+			http.Error(w, "author doesn't exist", http.StatusBadRequest)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	indexBook(createdBook)
 
-	_, _ = w.Write([]byte("book added successfully"))
+	JsonResponse(createdBook, w)
 }
 
 // BookUpdateHandler updates a book's info using the given JSON
@@ -57,20 +62,24 @@ func BookUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	// check for inconsistencies
 	validBook, err := ValidateBookUpdate(book)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	bookKey := BookPrefix + strconv.Itoa(book.ID)
-	bookBytes, err := json.Marshal(validBook)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		if err == db.ErrNotFound {
+			http.Error(w, "author doesn't exist", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
 		return
 	}
-	err = db.SetJsonValues(bookKey, bookBytes)
+	err = db.Books().Save(validBook)
 	if err != nil {
+		if err == db.ErrNotFound {
+			// removed since the book was validated
+			http.Error(w, "author doesn't exist", http.StatusBadRequest)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	indexBook(validBook)
 
 	_, _ = w.Write([]byte("book added successfully"))
 }
@@ -78,52 +87,35 @@ func BookUpdateHandler(w http.ResponseWriter, r *http.Request) {
 // BookDeleteHandler deletes a book by the given ID
 func BookDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	bookID := vars["id"]
-
-	bookKey := BookPrefix + bookID
-
-	bookBytes, err := db.GetByteValues(bookKey)
+	bookID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		if err.Error() == db.RedisNilErr {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		w.WriteHeader(http.StatusInternalServerError)
+		http.Error(w, "book id has to be an integer", http.StatusBadRequest)
 		return
 	}
 
-	var book config.Book
-	err = json.Unmarshal(bookBytes, &book)
+	ok, err := db.Books().Exists(bookID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
-	if book.AuthorID != 0 {
-		//delete from authors collection
-		bookIDInt, err := strconv.Atoi(bookID)
-		if err != nil {
-			http.Error(w, "book id has to be an integer", http.StatusBadRequest)
-			return
-		}
-		authorKey := AuthorPrefix + strconv.Itoa(book.AuthorID)
-		author, err := getAuthorByKeyFromDB(authorKey)
-		if err != nil && err.Error() != db.RedisNilErr {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if err == nil {
-			author.AuthoredBookIDs = RemoveElementFromArray(author.AuthoredBookIDs, bookIDInt)
-			authorBytes, _ := json.Marshal(author)
-			_ = db.SetJsonValues(authorKey, authorBytes)
-		}
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
-	err = db.RemoveByKey(bookKey)
+	// the book is taken off the works of its contributors as well
+	err = db.Books().Delete(bookID)
 	if err != nil {
+		if err == db.ErrBookOnLoan {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	unindex(bookKey(bookID))
+	// nobody can be waiting for a book that's gone
+	_ = db.Holds().Clear(bookID)
 
 	_, _ = w.Write([]byte("book deleted successfully"))
 }
@@ -131,13 +123,15 @@ func BookDeleteHandler(w http.ResponseWriter, r *http.Request) {
 // GetBookHandler returns a book's info by bookID
 func GetBookHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	bookID := vars["id"]
-
-	bookKey := BookPrefix + bookID
+	bookID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "book id has to be an integer", http.StatusBadRequest)
+		return
+	}
 
-	book, err := db.GetByteValues(bookKey)
+	book, err := db.Books().Get(bookID)
 	if err != nil {
-		if err.Error() == db.RedisNilErr {
+		if err == db.ErrNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
@@ -145,35 +139,26 @@ func GetBookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, _ = w.Write(book)
+	JsonResponse(book, w)
 }
 
-// GetAllBooksHandler returns an array of all books' info
-func GetAllBooksHandler(w http.ResponseWriter, _ *http.Request) {
-
-	bookKeys, err := db.ScanKeysByPrefix(BookPrefix)
+// GetAllBooksHandler returns a page of the catalogue. The books can be
+// filtered by title, author_id and available, ordered by sort and order,
+// and paged through with limit and the next_cursor of the previous page.
+// Only the books that can match are read, but without a title or author_id
+// every page reads and sorts the whole catalogue
+func GetAllBooksHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseBookQuery(r.URL.Query())
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if len(bookKeys) == 0 {
-		_, _ = w.Write([]byte("no book has been added yet"))
+	books, err := query.candidates()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	resultString := "["
-	for _, bookKey := range bookKeys {
-		book, err := db.GetSingleValue(bookKey)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if resultString != "[" {
-			resultString += ","
-		}
-		resultString += book
-	}
-	resultString += "]"
-	_, _ = w.Write([]byte(resultString))
+	JsonResponse(query.run(books), w)
 }
 
 func getBookDetails(r *http.Request) config.Book {
@@ -186,142 +171,112 @@ func getBookDetails(r *http.Request) config.Book {
 	return book
 }
 
+// ValidateBookCreate checks a new book, that is yet to get its ID
 func ValidateBookCreate(book config.Book) (config.Book, error) {
-	if book.BookName == "" || book.ID == 0 {
-		return config.Book{}, errors.New("book name or ID is missing")
+	if book.BookName == "" {
+		return config.Book{}, errors.New("book name is missing")
 	}
-
-	author := config.Author{}
-	authorKey := AuthorPrefix + strconv.Itoa(book.AuthorID)
-	var err error
-	err = nil
-	if book.AuthorID != 0 {
-		author, err = getAuthorByKeyFromDB(authorKey)
-		if err != nil {
-			return config.Book{}, err
-		}
-		author.AuthoredBookIDs = append(author.AuthoredBookIDs, book.ID)
-	}
-
-	bookKey := BookPrefix + strconv.Itoa(book.ID)
-	ok, err := isBookExistInDB(bookKey)
+	metadata, err := validateBookMetadata(book.BookMetadata)
 	if err != nil {
 		return config.Book{}, err
 	}
-	if !ok {
-		// book is new
-		book.TotalCount = book.AddCount
-		if book.TotalCount == 0 {
-			book.TotalCount = 1
-		}
-		book.AddCount = 0
-		book.OnLoanCount = 0
-		if author.ID != 0 {
-			authorBytes, err := json.Marshal(author)
-			if err != nil {
-				return config.Book{}, err
-			}
-			_ = db.SetJsonValues(authorKey, authorBytes)
-		}
+	book.BookMetadata = metadata
 
-		return book, nil
+	if book, err = validateContributors(book); err != nil {
+		return config.Book{}, err
 	}
-	// book is old
-	return book, errors.New("book already exists")
-}
 
-func isBookExistInDB(key string) (bool, error) {
-	_, err := db.GetSingleValue(key)
-	if err != nil {
-		if err.Error() != db.RedisNilErr {
-			return false, err
-		} else {
-			//book doesnt already exist
-			return false, nil
+	// a new book has a copy unless told otherwise, the copies are
+	// added as items as it is saved. TotalCount, that older clients
+	// set, is taken for add_count
+	if book.TotalCount > 0 {
+		if book.AddCount > 0 && book.AddCount != book.TotalCount {
+			return config.Book{}, errors.New("TotalCount is counted from the copies, set add_count only")
 		}
+		book.AddCount = book.TotalCount
+	}
+	if book.AddCount <= 0 {
+		book.AddCount = 1
+	}
+	if book.AddCount > maxAddCount {
+		return config.Book{}, fmt.Errorf("add_count can be at most %d", maxAddCount)
 	}
-	// book exists
-	return true, nil
+
+	return book, nil
 }
 
 func ValidateBookUpdate(book config.Book) (config.Book, error) {
 	if book.BookName == "" || book.ID == 0 {
 		return config.Book{}, errors.New("book name or ID is missing")
 	}
-
-	bookKey := BookPrefix + strconv.Itoa(book.ID)
-	ok, err := isBookExistInDB(bookKey)
+	metadata, err := validateBookMetadata(book.BookMetadata)
 	if err != nil {
 		return config.Book{}, err
 	}
-	if !ok {
-		// book is new
-		return book, errors.New("book does not exist")
-	}
-
-	// book is old
-	savedBook := config.Book{}
-	savedBookByte, _ := db.GetByteValues(bookKey)
+	book.BookMetadata = metadata
 
-	if err := json.Unmarshal(savedBookByte, &savedBook); err != nil {
+	savedBook, err := db.Books().Get(book.ID)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return book, errors.New("book does not exist")
+		}
 		return config.Book{}, err
 	}
-
-	if book.AuthorID != 0 {
-		// look for the author id, if author exists, ad this book to his collection
-		// else return nil
-		log.Println("yet to implement author")
+	// the copies can't be counted anew, the book sent back as it was
+	// read is fine but a new TotalCount is refused
+	if book.TotalCount != 0 && book.TotalCount != savedBook.TotalCount {
+		return config.Book{}, errors.New("TotalCount is counted from the copies, add copies with add_count")
 	}
-	if savedBook.AuthorID != book.AuthorID {
-		if book.AuthorID != 0 {
-			authorKey := AuthorPrefix + strconv.Itoa(book.AuthorID)
-			author, err := getAuthorByKeyFromDB(authorKey)
-			if err != nil {
-				return config.Book{}, err
-			}
-			author.AuthoredBookIDs = append(author.AuthoredBookIDs, book.ID)
-			authorByte, err := json.Marshal(author)
-			if err != nil {
-				return config.Book{}, err
-			}
-			_ = db.SetJsonValues(authorKey, authorByte)
-		}
-		if savedBook.AuthorID != 0 {
-			authorKey := AuthorPrefix + strconv.Itoa(savedBook.AuthorID)
-			author, err := getAuthorByKeyFromDB(authorKey)
-			// we dont have to block update for any error here
-			if err == nil {
-				author.AuthoredBookIDs = append(author.AuthoredBookIDs, book.ID)
-				author.AuthoredBookIDs = RemoveElementFromArray(author.AuthoredBookIDs, savedBook.AuthorID)
-				authorByte, err := json.Marshal(author)
-				if err != nil {
-					return config.Book{}, err
-				}
-				_ = db.SetJsonValues(authorKey, authorByte)
-			}
 
-		}
+	// the works of the contributors are brought in line as the book is saved
+	if book, err = validateContributors(book); err != nil {
+		return config.Book{}, err
 	}
 
-	book.TotalCount = savedBook.TotalCount
-	book.OnLoanCount = savedBook.OnLoanCount
-	if book.AddCount > 0 {
-		book.TotalCount += book.AddCount
+	if book.AddCount > maxAddCount {
+		return config.Book{}, fmt.Errorf("add_count can be at most %d", maxAddCount)
 	}
 
 	return book, nil
 }
 
-func getAuthorByKeyFromDB(authorKey string) (config.Author, error) {
-	authorByte, err := db.GetByteValues(authorKey)
-	if err != nil {
-		return config.Author{}, err
+// validateContributors checks the contributors of a book. An author_id
+// without contributors stands for a single author, and a contributor
+// without a role is an author. It returns db.ErrNotFound if a
+// contributor doesn't exist
+func validateContributors(book config.Book) (config.Book, error) {
+	contributors := []config.Contribution{}
+	for _, contributor := range book.Credits() {
+		if contributor.Role == "" {
+			contributor.Role = config.ContributorAuthor
+		}
+		if err := config.CheckContributorRole(contributor.Role); err != nil {
+			return config.Book{}, err
+		}
+		if contributor.AuthorID <= 0 {
+			return config.Book{}, errors.New("contributor author_id is missing")
+		}
+		if hasContributor(contributors, contributor) {
+			continue
+		}
+		ok, err := db.Authors().Exists(contributor.AuthorID)
+		if err != nil {
+			return config.Book{}, err
+		}
+		if !ok {
+			return config.Book{}, db.ErrNotFound
+		}
+		contributors = append(contributors, contributor)
 	}
-	author := config.Author{}
+	book.SetContributors(contributors)
+	return book, nil
+}
 
-	if err := json.Unmarshal(authorByte, &author); err != nil {
-		return config.Author{}, err
+func hasContributor(contributors []config.Contribution, contributor config.Contribution) bool {
+	for _, c := range contributors {
+		if c == contributor {
+			return true
+		}
 	}
-
-	return author, nil
+	return false
 }
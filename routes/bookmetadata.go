@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"errors"
+	"evl-book-server/config"
+	"evl-book-server/isbn"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Limits of the bibliographic record of a book
+const (
+	maxTextLength        = 200
+	maxDescriptionLength = 10000
+	maxSubjects          = 20
+	maxPageCount         = 100000
+	// books are catalogued up to a year before they are published
+	yearsAhead = 1
+)
+
+// languageTag matches the BCP 47 tags of the catalogue: a language code
+// of 2 or 3 letters, followed by optional script, region or variant subtags
+var languageTag = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// validateBookMetadata checks the bibliographic record of a book,
+// and returns it cleaned up: text trimmed, the ISBN as 13 digits,
+// the language tag in its usual case and subjects without duplicates
+func validateBookMetadata(metadata config.BookMetadata) (config.BookMetadata, error) {
+	metadata.Publisher = strings.TrimSpace(metadata.Publisher)
+	metadata.Edition = strings.TrimSpace(metadata.Edition)
+	metadata.Description = strings.TrimSpace(metadata.Description)
+	metadata.CoverURL = strings.TrimSpace(metadata.CoverURL)
+	if len(metadata.Publisher) > maxTextLength || len(metadata.Edition) > maxTextLength {
+		return config.BookMetadata{}, fmt.Errorf("publisher and edition can be up to %d characters long", maxTextLength)
+	}
+	if len(metadata.Description) > maxDescriptionLength {
+		return config.BookMetadata{}, fmt.Errorf("description can be up to %d characters long", maxDescriptionLength)
+	}
+
+	if strings.TrimSpace(metadata.ISBN) != "" {
+		normalized, err := isbn.Normalize(metadata.ISBN)
+		if err != nil {
+			return config.BookMetadata{}, err
+		}
+		metadata.ISBN = normalized
+	} else {
+		metadata.ISBN = ""
+	}
+
+	if latest := time.Now().Year() + yearsAhead; metadata.PublicationYear < 0 || metadata.PublicationYear > latest {
+		return config.BookMetadata{}, fmt.Errorf("publication year has to be up to %d", latest)
+	}
+	if metadata.PageCount < 0 || metadata.PageCount > maxPageCount {
+		return config.BookMetadata{}, fmt.Errorf("page count can be up to %d", maxPageCount)
+	}
+
+	if metadata.Language = strings.TrimSpace(metadata.Language); metadata.Language != "" {
+		if !languageTag.MatchString(metadata.Language) {
+			return config.BookMetadata{}, errors.New("language has to be a language tag, such as en or pt-BR")
+		}
+		metadata.Language = canonicalLanguage(metadata.Language)
+	}
+
+	if metadata.CoverURL != "" {
+		cover, err := url.Parse(metadata.CoverURL)
+		if err != nil || (cover.Scheme != "http" && cover.Scheme != "https") || cover.Host == "" {
+			return config.BookMetadata{}, errors.New("cover url has to be an http or https url")
+		}
+	}
+
+	subjects := []string{}
+	seen := map[string]bool{}
+	for _, subject := range metadata.Subjects {
+		subject = strings.TrimSpace(subject)
+		if subject == "" || seen[strings.ToLower(subject)] {
+			continue
+		}
+		if len(subject) > maxTextLength {
+			return config.BookMetadata{}, fmt.Errorf("subjects can be up to %d characters long", maxTextLength)
+		}
+		seen[strings.ToLower(subject)] = true
+		subjects = append(subjects, subject)
+	}
+	if len(subjects) > maxSubjects {
+		return config.BookMetadata{}, fmt.Errorf("a book can have up to %d subjects", maxSubjects)
+	}
+	metadata.Subjects = nil
+	if len(subjects) > 0 {
+		metadata.Subjects = subjects
+	}
+	return metadata, nil
+}
+
+// canonicalLanguage writes a language tag in its usual case:
+// the language lower case, a script title case and a region upper case
+func canonicalLanguage(tag string) string {
+	subtags := strings.Split(tag, "-")
+	subtags[0] = strings.ToLower(subtags[0])
+	for i := 1; i < len(subtags); i++ {
+		switch subtag := subtags[i]; {
+		case len(subtag) == 4 && !strings.ContainsAny(subtag, "0123456789"):
+			subtags[i] = strings.ToUpper(subtag[:1]) + strings.ToLower(subtag[1:])
+		case len(subtag) == 2:
+			subtags[i] = strings.ToUpper(subtag)
+		default:
+			subtags[i] = strings.ToLower(subtag)
+		}
+	}
+	return strings.Join(subtags, "-")
+}
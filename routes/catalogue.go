@@ -0,0 +1,247 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"evl-book-server/search"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Pages of the catalogue hold defaultPageSize books,
+// unless a limit of up to maxPageSize is asked for
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// Fields the catalogue can be sorted by
+const (
+	sortByID        = "id"
+	sortByTitle     = "title"
+	sortByAvailable = "available"
+)
+
+// bookPage is one page of the books that match a catalogue query.
+// Total counts all of them, NextCursor is empty on the last page
+type bookPage struct {
+	Books      []config.Book `json:"books"`
+	Total      int           `json:"total"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// bookQuery filters, sorts and pages the catalogue
+type bookQuery struct {
+	title         string
+	authorID      int
+	availableOnly bool
+	sortBy        string
+	descending    bool
+	limit         int
+	after         *bookCursor
+}
+
+// bookCursor is where a page ends: the sort keys of its last book.
+// The next page starts after it, even if books were added or removed since
+type bookCursor struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title,omitempty"`
+	Available int    `json:"available,omitempty"`
+}
+
+// parseBookQuery reads the query parameters of /api/books
+func parseBookQuery(values url.Values) (bookQuery, error) {
+	query := bookQuery{
+		title:  strings.ToLower(strings.TrimSpace(values.Get("title"))),
+		sortBy: sortByID,
+		limit:  defaultPageSize,
+	}
+	var err error
+	if v := values.Get("author_id"); v != "" {
+		if query.authorID, err = strconv.Atoi(v); err != nil || query.authorID <= 0 {
+			return bookQuery{}, errors.New("author_id has to be a positive integer")
+		}
+	}
+	if v := values.Get("available"); v != "" {
+		if query.availableOnly, err = strconv.ParseBool(v); err != nil {
+			return bookQuery{}, errors.New("available has to be true or false")
+		}
+	}
+	if v := values.Get("sort"); v != "" {
+		if v != sortByID && v != sortByTitle && v != sortByAvailable {
+			return bookQuery{}, errors.New("sort has to be one of id, title and available")
+		}
+		query.sortBy = v
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.descending = true
+	default:
+		return bookQuery{}, errors.New("order has to be asc or desc")
+	}
+	if v := values.Get("limit"); v != "" {
+		if query.limit, err = strconv.Atoi(v); err != nil || query.limit <= 0 || query.limit > maxPageSize {
+			return bookQuery{}, errors.New("limit has to be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+	}
+	if v := values.Get("cursor"); v != "" {
+		cursor := bookCursor{}
+		cursorBytes, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || json.Unmarshal(cursorBytes, &cursor) != nil || cursor.ID <= 0 {
+			return bookQuery{}, errors.New("cursor not valid")
+		}
+		query.after = &cursor
+	}
+	return query, nil
+}
+
+// candidates returns the books that can match the query. The books of
+// author_id are read off the works of the author, and those of title off
+// the search index. Other queries read the whole catalogue, as do titles
+// of words too short to narrow it down
+func (q bookQuery) candidates() ([]config.Book, error) {
+	var ids []int
+	switch {
+	case q.authorID != 0:
+		author, err := db.Authors().Get(q.authorID)
+		if err == db.ErrNotFound {
+			return []config.Book{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = author.AuthoredBookIDs
+	case q.title != "":
+		var err error
+		if ids, err = titleBookIDs(q.title); err != nil {
+			return nil, err
+		}
+	}
+	if ids == nil {
+		return db.Books().All()
+	}
+
+	books := []config.Book{}
+	for _, id := range ids {
+		book, err := db.Books().Get(id)
+		if err == db.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	return books, nil
+}
+
+// titleBookIDs returns the IDs of the indexed books with a word that starts
+// with each word of title. It returns nil if a word matches too many terms
+// to tell all of its books
+func titleBookIDs(title string) ([]int, error) {
+	words := search.Tokenize(title)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	var found map[int]bool
+	for _, word := range words {
+		terms, err := db.Search().Lookup(word)
+		if err != nil {
+			return nil, err
+		}
+		if len(terms) >= db.MaxLookupTerms {
+			return nil, nil
+		}
+		books := map[int]bool{}
+		for _, postings := range terms {
+			for key := range postings {
+				if !strings.HasPrefix(key, db.BookPrefix) {
+					continue
+				}
+				id, err := strconv.Atoi(strings.TrimPrefix(key, db.BookPrefix))
+				if err == nil && (found == nil || found[id]) {
+					books[id] = true
+				}
+			}
+		}
+		found = books
+	}
+	ids := []int{}
+	for id := range found {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// matches reports whether book passes the filters of the query
+func (q bookQuery) matches(book config.Book) bool {
+	if q.title != "" && !strings.Contains(strings.ToLower(book.BookName), q.title) {
+		return false
+	}
+	if q.authorID != 0 && !book.HasContributor(q.authorID, config.ContributorAuthor) {
+		return false
+	}
+	if q.availableOnly && book.Available() == 0 {
+		return false
+	}
+	return true
+}
+
+// before reports whether a comes before b in the order of the query.
+// Ties are broken by ID, so that the order is total and cursors are exact
+func (q bookQuery) before(a, b bookCursor) bool {
+	if q.descending {
+		a, b = b, a
+	}
+	switch q.sortBy {
+	case sortByTitle:
+		if titleA, titleB := strings.ToLower(a.Title), strings.ToLower(b.Title); titleA != titleB {
+			return titleA < titleB
+		}
+	case sortByAvailable:
+		if a.Available != b.Available {
+			return a.Available < b.Available
+		}
+	}
+	return a.ID < b.ID
+}
+
+// run returns the page of books that the query asks for
+func (q bookQuery) run(books []config.Book) bookPage {
+	matched := []config.Book{}
+	for _, book := range books {
+		if q.matches(book) {
+			matched = append(matched, book)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return q.before(cursorOf(matched[i]), cursorOf(matched[j]))
+	})
+
+	page := bookPage{Books: []config.Book{}, Total: len(matched)}
+	start := 0
+	if q.after != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return q.before(*q.after, cursorOf(matched[i]))
+		})
+	}
+	end := start + q.limit
+	if end >= len(matched) {
+		end = len(matched)
+	} else {
+		cursorBytes, _ := json.Marshal(cursorOf(matched[end-1]))
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(cursorBytes)
+	}
+	page.Books = append(page.Books, matched[start:end]...)
+	return page
+}
+
+func cursorOf(book config.Book) bookCursor {
+	return bookCursor{ID: book.ID, Title: book.BookName, Available: book.Available()}
+}
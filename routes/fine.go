@@ -0,0 +1,109 @@
+package routes
+
+import (
+	"encoding/json"
+	"evl-book-server/auth"
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// fineStatement is a user's fines ledger along with what they owe
+type fineStatement struct {
+	Username string               `json:"username"`
+	Balance  int                  `json:"balance"`
+	Entries  []config.LedgerEntry `json:"entries"`
+}
+
+// credit is a payment or a waiver sent by the admin
+type credit struct {
+	Amount int    `json:"amount"`
+	Note   string `json:"note"`
+}
+
+// GetFinesForThisUserHandler returns the fines ledger of this user
+func GetFinesForThisUserHandler(w http.ResponseWriter, r *http.Request) {
+	writeFineStatement(auth.PrincipalOf(r).Username, w)
+}
+
+// GetUserFinesHandler returns to admin the fines ledger of a user
+func GetUserFinesHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	exists, err := db.Users().Exists(username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "user doesn't exist", http.StatusNotFound)
+		return
+	}
+	writeFineStatement(username, w)
+}
+
+// RecordFinePaymentHandler is used by the admin to record
+// a payment a user made towards their fines
+func RecordFinePaymentHandler(w http.ResponseWriter, r *http.Request) {
+	recordCredit(config.LedgerPayment, w, r)
+}
+
+// WaiveFineHandler is used by the admin to waive
+// some or all of what a user owes
+func WaiveFineHandler(w http.ResponseWriter, r *http.Request) {
+	recordCredit(config.LedgerWaiver, w, r)
+}
+
+func recordCredit(kind string, w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	exists, err := db.Users().Exists(username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "user doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	amount := credit{}
+	if err := json.NewDecoder(r.Body).Decode(&amount); err != nil || amount.Amount <= 0 {
+		http.Error(w, "amount has to be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := db.Fines().Record(config.LedgerEntry{
+		Username:   username,
+		Kind:       kind,
+		Amount:     amount.Amount,
+		Note:       amount.Note,
+		RecordedBy: auth.PrincipalOf(r).Username,
+	})
+	if err != nil {
+		if err == db.ErrOverpayment {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	JsonResponse(entry, w)
+}
+
+func writeFineStatement(username string, w http.ResponseWriter) {
+	ledger, err := db.Fines().Ledger(username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(ledger) == 0 {
+		_, _ = w.Write([]byte("no fines"))
+		return
+	}
+
+	JsonResponse(fineStatement{
+		Username: username,
+		Balance:  config.LedgerBalance(ledger),
+		Entries:  ledger,
+	}, w)
+}
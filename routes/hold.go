@@ -0,0 +1,140 @@
+package routes
+
+import (
+	"errors"
+	"evl-book-server/auth"
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heldBook is a user's hold along with its place in the queue
+type heldBook struct {
+	BookID   int       `json:"book_id"`
+	Position int       `json:"position"`
+	PlacedAt time.Time `json:"placed_at"`
+}
+
+// PlaceHoldHandler lets a logged in user to get in the queue
+// of a book that has no copies available at the moment
+func PlaceHoldHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := getBookIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	position, err := db.Holds().Place(bookID, auth.PrincipalOf(r).Username)
+	if err != nil {
+		switch err {
+		case db.ErrNotFound:
+			http.Error(w, "book doesn't exist", http.StatusNotFound)
+		case db.ErrBookAvailable, db.ErrAlreadyOnHold:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	_, _ = w.Write([]byte("hold placed, your position in the queue is " + strconv.Itoa(position)))
+}
+
+// CancelHoldHandler removes this user from the queue of a book
+func CancelHoldHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := getBookIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = db.Holds().Cancel(bookID, auth.PrincipalOf(r).Username)
+	if err != nil {
+		if err == db.ErrHoldNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, _ = w.Write([]byte("hold cancelled"))
+}
+
+// GetAllHoldsForThisUserHandler returns the holds of this user
+// with their position in the queue of each book
+func GetAllHoldsForThisUserHandler(w http.ResponseWriter, r *http.Request) {
+	username := auth.PrincipalOf(r).Username
+	bookIDs, err := db.Holds().BooksHeldBy(username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	holds := []heldBook{}
+	for _, bookID := range bookIDs {
+		queue, err := db.Holds().Queue(bookID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for i, hold := range queue {
+			if strings.EqualFold(hold.Username, username) {
+				holds = append(holds, heldBook{BookID: bookID, Position: i + 1, PlacedAt: hold.PlacedAt})
+				break
+			}
+		}
+	}
+	if len(holds) == 0 {
+		_, _ = w.Write([]byte("no holds"))
+		return
+	}
+	JsonResponse(holds, w)
+}
+
+// GetBookHoldsHandler returns to admin the queue of holds of a book
+func GetBookHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := getBookIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	queue, err := db.Holds().Queue(bookID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(queue) == 0 {
+		_, _ = w.Write([]byte("no holds on this book"))
+		return
+	}
+	JsonResponse(queue, w)
+}
+
+// promoteNextHold turns the oldest hold of a book, that just got a
+// copy back, into a loan request. Holds of users the loan policy
+// turns down are passed over. The return itself has already
+// succeeded, so a failure here is only logged.
+func promoteNextHold(bookID int) (config.Loan, bool) {
+	loan, promoted, err := db.Holds().PromoteNext(bookID, checkLoanPolicy)
+	if err != nil {
+		log.Println("could not promote hold of book", bookID, ":", err.Error())
+		return config.Loan{}, false
+	}
+	return loan, promoted
+}
+
+func getBookIDFromPath(r *http.Request) (int, error) {
+	vars := mux.Vars(r)
+	bookID, err := strconv.Atoi(vars["book_id"])
+	if err != nil {
+		return 0, errors.New("book id has to be an integer")
+	}
+	return bookID, nil
+}
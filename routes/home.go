@@ -7,8 +7,9 @@ import (
 )
 
 func HomePageHandler(w http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalOf(r)
 	_, _ = w.Write([]byte("Hello World. This is a placeholder for URL: " + r.URL.String() + "\n"))
-	_, _ = w.Write([]byte(fmt.Sprintf("User : %s \n", r.Header.Get(auth.UsernameKey))))
-	_, _ = w.Write([]byte(fmt.Sprintf("Admin : %s \n", r.Header.Get(auth.AdminKey))))
+	_, _ = w.Write([]byte(fmt.Sprintf("User : %s \n", principal.Username)))
+	_, _ = w.Write([]byte(fmt.Sprintf("Admin : %t \n", principal.IsAdmin())))
 
 }
@@ -0,0 +1,235 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// barcodes are printed on labels and typed in at the desk,
+// so they are kept to letters, digits and dashes
+var barcodePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]{0,63}$`)
+
+type itemDetails struct {
+	Barcode   string `json:"barcode"`
+	Location  string `json:"location"`
+	Condition string `json:"condition"`
+}
+
+// AddItemHandler adds a copy to a book, with the barcode, location and
+// condition given. A barcode is made up if none is given. The oldest
+// hold of the book is turned into a loan request, as a copy just came in
+func AddItemHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "book id has to be an integer", http.StatusBadRequest)
+		return
+	}
+	details := itemDetails{}
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		http.Error(w, "item details are missing", http.StatusBadRequest)
+		return
+	}
+	item, err := validateItem(config.Item{
+		BookID:    bookID,
+		Barcode:   details.Barcode,
+		Location:  details.Location,
+		Condition: details.Condition,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	item, err = db.Items().Add(item)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "book doesn't exist", http.StatusNotFound)
+			return
+		}
+		itemErrorResponse(err, w)
+		return
+	}
+	if item.IsLendable() {
+		promoteNextHold(item.BookID)
+	}
+
+	JsonResponse(item, w)
+}
+
+// RetireItemHandler takes a copy, that is not on loan, out of the collection
+func RetireItemHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, err := getItemIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	item, err := db.Items().Retire(itemID)
+	if err != nil {
+		itemErrorResponse(err, w)
+		return
+	}
+
+	JsonResponse(item, w)
+}
+
+// RelocateItemHandler moves a copy to the location given
+func RelocateItemHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, err := getItemIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	details := itemDetails{}
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		http.Error(w, "location is missing", http.StatusBadRequest)
+		return
+	}
+	location, err := validateLocation(details.Location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	item, err := db.Items().Update(itemID, func(item *config.Item) error {
+		if !item.InCollection() {
+			return db.ErrItemRetired
+		}
+		item.Location = location
+		return nil
+	})
+	if err != nil {
+		itemErrorResponse(err, w)
+		return
+	}
+
+	JsonResponse(item, w)
+}
+
+// SetItemConditionHandler records the condition of a copy. Damaged
+// copies are not lent until their condition is set back
+func SetItemConditionHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, err := getItemIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	details := itemDetails{}
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		http.Error(w, "condition is missing", http.StatusBadRequest)
+		return
+	}
+	if err := config.CheckItemCondition(details.Condition); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wasLendable := false
+	item, err := db.Items().Update(itemID, func(item *config.Item) error {
+		if !item.InCollection() {
+			return db.ErrItemRetired
+		}
+		wasLendable = item.IsLendable()
+		item.Condition = details.Condition
+		return nil
+	})
+	if err != nil {
+		itemErrorResponse(err, w)
+		return
+	}
+	if !wasLendable && item.IsLendable() {
+		promoteNextHold(item.BookID)
+	}
+
+	JsonResponse(item, w)
+}
+
+// GetBookItemsHandler returns the copies of a book
+func GetBookItemsHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "book id has to be an integer", http.StatusBadRequest)
+		return
+	}
+
+	items, err := db.Items().OfBook(bookID)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "book doesn't exist", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	JsonResponse(items, w)
+}
+
+// GetItemByBarcodeHandler returns the copy with the barcode given
+func GetItemByBarcodeHandler(w http.ResponseWriter, r *http.Request) {
+	barcode := strings.TrimSpace(mux.Vars(r)["barcode"])
+
+	item, err := db.Items().ByBarcode(barcode)
+	if err != nil {
+		itemErrorResponse(err, w)
+		return
+	}
+
+	JsonResponse(item, w)
+}
+
+// validateItem checks a new item. The barcode is left empty for
+// the store to make one up, and the condition defaults to good
+func validateItem(item config.Item) (config.Item, error) {
+	item.Barcode = strings.TrimSpace(item.Barcode)
+	if item.Barcode != "" && !barcodePattern.MatchString(item.Barcode) {
+		return config.Item{}, errors.New("barcode can only have letters, digits and dashes, up to 64 of them")
+	}
+	location, err := validateLocation(item.Location)
+	if err != nil {
+		return config.Item{}, err
+	}
+	item.Location = location
+	if item.Condition == "" {
+		item.Condition = config.ConditionGood
+	}
+	if err := config.CheckItemCondition(item.Condition); err != nil {
+		return config.Item{}, err
+	}
+	return item, nil
+}
+
+func validateLocation(location string) (string, error) {
+	location = strings.TrimSpace(location)
+	if len(location) > maxTextLength {
+		return "", fmt.Errorf("location can be up to %d characters long", maxTextLength)
+	}
+	return location, nil
+}
+
+func itemErrorResponse(err error, w http.ResponseWriter) {
+	switch err {
+	case db.ErrNotFound:
+		http.Error(w, "item doesn't exist", http.StatusNotFound)
+	case db.ErrBarcodeTaken, db.ErrItemOnLoan, db.ErrItemRetired:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func getItemIDFromPath(r *http.Request) (int, error) {
+	itemID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, errors.New("item id has to be an integer")
+	}
+	return itemID, nil
+}
@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"evl-book-server/auth"
+	"net/http"
+)
+
+// jwkSet is the JSON Web Key Set document
+type jwkSet struct {
+	Keys []auth.JWK `json:"keys"`
+}
+
+// JWKSHandler publishes the public keys tokens are signed with,
+// so that other services can verify the tokens of the library
+func JWKSHandler(w http.ResponseWriter, _ *http.Request) {
+	JsonResponse(jwkSet{Keys: auth.JWKS()}, w)
+}
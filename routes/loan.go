@@ -1,184 +1,180 @@
 package routes
 
 import (
-	"encoding/json"
 	"errors"
 	"evl-book-server/auth"
 	"evl-book-server/config"
 	"evl-book-server/db"
 	"github.com/gorilla/mux"
-	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // CreateLoanRequestHandler lets a logged in user to
 // request for a book using that books ID.
+// The created loan request is returned with its ID
 func CreateLoanRequestHandler(w http.ResponseWriter, r *http.Request) {
 	loan := getLoanDetails(r)
 	// check for inconsistencies
 	validLoan, err := ValidateLoanCreate(loan)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		if rejection, ok := err.(*LoanRejection); ok {
+			writeLoanRejection(rejection, w)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	loanKey := LoanPrefix + strconv.Itoa(loan.ID)
-	loanBytes, err := json.Marshal(validLoan)
+	// the loan is checked against the loan policy, saved and
+	// added to user's loanArray together
+	createdLoan, err := db.Loans().Create(validLoan, checkLoanPolicy)
 	if err != nil {
+		if rejection, ok := err.(*LoanRejection); ok {
+			writeLoanRejection(rejection, w)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	err = db.SetJsonValues(loanKey, loanBytes)
+
+	JsonResponse(createdLoan, w)
+}
+
+// ApproveLoanRequestHandler is used by the admin to
+// approve a loan request by loan ID
+func ApproveLoanRequestHandler(w http.ResponseWriter, r *http.Request) {
+	loanID, err := getLoanIDFromPath(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	// Add loan to user's loanArray
-	err = addLoanIDToUsersLoanIDArray(r.Header.Get(auth.UsernameKey), loan.ID)
+
+	// the loan is lent the copy with the barcode, or any lendable copy
+	// without one. The loan, the copy and its book are updated together
+	dueAt := time.Now().Add(config.Lending().LoanPeriod)
+	barcode := strings.TrimSpace(r.URL.Query().Get("barcode"))
+	_, err = db.Loans().Approve(loanID, barcode, dueAt)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		loanErrorResponse(err, w)
 		return
 	}
 
-	_, _ = w.Write([]byte("loan request created"))
+	_, _ = w.Write([]byte("loan approved successfully"))
 }
 
-func addLoanIDToUsersLoanIDArray(username string, loanID int) error {
-	userKey := strings.ToLower(UserPrefix + username)
-
-	user, err := getUserByKey(userKey)
+// DeclineLoanRequestHandler declines loan. If it is a pending loan,
+// It moves loan request to the loan history and remove it;s id from user's pending list
+func DeclineLoanRequestHandler(w http.ResponseWriter, r *http.Request) {
+	loanID, err := getLoanIDFromPath(r)
 	if err != nil {
-		return err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	user.LoanIDArray = append(user.LoanIDArray, loanID)
-
-	updatedUserBytes, err := json.Marshal(user)
+	_, err = db.Loans().Decline(loanID)
 	if err != nil {
-		return err
+		loanErrorResponse(err, w)
+		return
 	}
 
-	_ = db.SetJsonValues(userKey, updatedUserBytes)
-
-	return nil
+	_, _ = w.Write([]byte("loan declined successfully"))
 }
 
-// ApproveLoanRequestHandler is used by the admin to
-// approve a loan request by loan ID
-func ApproveLoanRequestHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	loanKey := LoanPrefix + vars["id"]
-	loan := getLoanByKeyFromDB(loanKey)
-	if loan.Approved == true {
-		http.Error(w, "loan has been approved already", http.StatusForbidden)
+// CheckOutLoanHandler is used by the admin to hand the book
+// of an approved loan over to its user. The loan period starts then
+func CheckOutLoanHandler(w http.ResponseWriter, r *http.Request) {
+	loanID, err := getLoanIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	//add approved flag
-	loan.Approved = true
 
-	//increment onloan in books by one
-	err := updateBookLoanCountByID(loan.BookID, 1)
+	dueAt := time.Now().Add(config.Lending().LoanPeriod)
+	loan, err := db.Loans().CheckOut(loanID, dueAt)
 	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		if err.Error() == db.RedisNilErr {
-			http.Error(w, "loan doesn't exist", http.StatusForbidden)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusForbidden)
+		loanErrorResponse(err, w)
 		return
 	}
 
-	//now update the load and finish the approval process
-	loanBytes, err := json.Marshal(loan)
+	JsonResponse(loan, w)
+}
+
+// CancelLoanRequestHandler lets a user withdraw
+// one of their loan requests that is still pending
+func CancelLoanRequestHandler(w http.ResponseWriter, r *http.Request) {
+	loanID, err := getLoanIDFromPath(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = db.SetJsonValues(loanKey, loanBytes)
+
+	_, err = db.Loans().Cancel(loanID, auth.PrincipalOf(r).Username)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		loanErrorResponse(err, w)
 		return
 	}
 
-	_, _ = w.Write([]byte("loan approved successfully"))
+	_, _ = w.Write([]byte("loan request cancelled successfully"))
 }
 
-// DeclineLoanRequestHandler declines loan. If it is a pending loan,
-// It removes loan request from database and remove it;s id from user's pending list
-func DeclineLoanRequestHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	loanKey := LoanPrefix + vars["id"]
-	loan := getLoanByKeyFromDB(loanKey)
-	if loan.Approved == true {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte("can not decline request, loan has already been approved"))
+// RenewLoanHandler lets a user extend the due date
+// of a checked out loan by another loan period
+func RenewLoanHandler(w http.ResponseWriter, r *http.Request) {
+	loanID, err := getLoanIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	loanID, err := strconv.Atoi(vars["id"])
+	lending := config.Lending()
+	loan, err := db.Loans().Renew(loanID, auth.PrincipalOf(r).Username, lending.LoanPeriod, lending.MaxRenewals)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte("loan id is must be an integer"))
+		loanErrorResponse(err, w)
 		return
 	}
-	//remove loan from user's end
-	err = removeLoanIDFromUser(UserPrefix+loan.Username, loanID)
+
+	JsonResponse(newDueLoan(loan, time.Now()), w)
+}
+
+// LostLoanHandler is used by the admin to close a loan whose book
+// will never be returned. The lost copy is taken out of the book's total count
+func LostLoanHandler(w http.ResponseWriter, r *http.Request) {
+	loanID, err := getLoanIDFromPath(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte("loan id could not be removed from user's loan array"))
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	//now delete the loan and finish the decline process
-	err = db.RemoveByKey(loanKey)
+	_, err = db.Loans().MarkLost(loanID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		loanErrorResponse(err, w)
 		return
 	}
 
-	_, _ = w.Write([]byte("loan declined successfully"))
+	_, _ = w.Write([]byte("loan marked as lost"))
 }
 
 // ReturnedBookHandler takes loaned item back. If it is an approved loan,
-// It removes loan request from database and remove it's id from user's pending list
+// It moves loan to the loan history and remove it's id from user's pending list
 func ReturnedBookHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	loanKey := LoanPrefix + vars["id"]
-	loan := getLoanByKeyFromDB(loanKey)
-
-	if loan.Approved == false {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte("can not accept return request, loan has not been approved yet"))
-		return
-	}
-
-	loanID, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte("loan id is must be an integer"))
-		return
-	}
-	//remove loan from user's end
-	err = removeLoanIDFromUser(UserPrefix+loan.Username, loanID)
+	loanID, err := getLoanIDFromPath(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte("loan id could not be removed from user's loan array"))
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// decrement onloan count in book by one
-	err = updateBookLoanCountByID(loan.BookID, -1)
+	loan, err := db.Loans().Return(loanID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusForbidden)
+		loanErrorResponse(err, w)
 		return
 	}
 
-	//now delete the loan and finish the decline process
-	err = db.RemoveByKey(loanKey)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	// the copy that just came back goes to whoever is first in the queue
+	if nextLoan, ok := promoteNextHold(loan.BookID); ok {
+		_, _ = w.Write([]byte("return confirmed successfully, the next hold became loan request " + strconv.Itoa(nextLoan.ID)))
 		return
 	}
 
@@ -188,21 +184,20 @@ func ReturnedBookHandler(w http.ResponseWriter, r *http.Request) {
 // GetLoanByIDForThisUserHandler returns a loan by loanID
 // if the loan belongs to this user
 func GetLoanByIDForThisUserHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	loanID := vars["id"]
-
-	loanKey := LoanPrefix + loanID
-
-	userKey := UserPrefix + strings.ToLower(r.Header.Get(auth.UsernameKey))
+	loanID, err := getLoanIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	user, err := getUserByKey(userKey)
+	user, err := db.Users().Get(auth.PrincipalOf(r).Username)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	loanIDFound := false
 	for _, userLoanID := range user.LoanIDArray {
-		if strconv.Itoa(userLoanID) == loanID {
+		if userLoanID == loanID {
 			loanIDFound = true
 			break
 		}
@@ -213,9 +208,9 @@ func GetLoanByIDForThisUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	loanByte, err := db.GetByteValues(loanKey)
+	loan, err := db.Loans().Get(loanID)
 	if err == nil {
-		_, _ = w.Write(loanByte)
+		JsonResponse(loan, w)
 		return
 	}
 
@@ -226,125 +221,93 @@ func GetLoanByIDForThisUserHandler(w http.ResponseWriter, r *http.Request) {
 // GetAllLoansForThisUserHandler returns all loans
 // that belongs to this user
 func GetAllLoansForThisUserHandler(w http.ResponseWriter, r *http.Request) {
-	userKey := UserPrefix + strings.ToLower(r.Header.Get(auth.UsernameKey))
-
-	user, err := getUserByKey(userKey)
+	loans, err := getLoansOfUser(auth.PrincipalOf(r).Username)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	resultString := "["
-	for _, loanID := range user.LoanIDArray {
-		loanKey := LoanPrefix + strconv.Itoa(loanID)
-		loan, err := db.GetSingleValue(loanKey)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		if resultString != "[" {
-			resultString += ","
-		}
-		resultString += loan
-	}
-	resultString += "]"
-	if resultString == "[]" {
+	if len(loans) == 0 {
 		_, _ = w.Write([]byte("no active or pending loans"))
 		return
 	}
-	_, _ = w.Write([]byte(resultString))
+	JsonResponse(loans, w)
 }
 
 // GetAllPendingLoansForThisUserHandler returns all pending loans
 // that belongs to this user
 func GetAllPendingLoansForThisUserHandler(w http.ResponseWriter, r *http.Request) {
-	userKey := UserPrefix + strings.ToLower(r.Header.Get(auth.UsernameKey))
-
-	user, err := getUserByKey(userKey)
+	loans, err := getLoansOfUser(auth.PrincipalOf(r).Username)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	resultString := "["
-	for _, loanID := range user.LoanIDArray {
-		loanKey := LoanPrefix + strconv.Itoa(loanID)
-		loan := getLoanByKeyFromDB(loanKey)
-		if loan.Approved == true {
-			continue
-		}
-		// else if loan is not approved, add to the string of pending loans
-		loanString, err := db.GetSingleValue(loanKey)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		if resultString != "[" {
-			resultString += ","
-		}
-		resultString += loanString
-	}
-	resultString += "]"
-	if resultString == "[]" {
+	pendingLoans := filterLoansByApproval(loans, false)
+	if len(pendingLoans) == 0 {
 		_, _ = w.Write([]byte("no pending loan requests"))
 		return
 	}
-	_, _ = w.Write([]byte(resultString))
+	JsonResponse(pendingLoans, w)
 }
 
 // GetAllActiveLoansForThisUserHandler returns all
-//approved loans that belongs to this user
+//approved loans that belongs to this user,
+// with the number of days left until each is due
 func GetAllActiveLoansForThisUserHandler(w http.ResponseWriter, r *http.Request) {
-	userKey := UserPrefix + strings.ToLower(r.Header.Get(auth.UsernameKey))
-
-	user, err := getUserByKey(userKey)
+	loans, err := getLoansOfUser(auth.PrincipalOf(r).Username)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	resultString := "["
-	for _, loanID := range user.LoanIDArray {
-		loanKey := LoanPrefix + strconv.Itoa(loanID)
-		loan := getLoanByKeyFromDB(loanKey)
-		if loan.Approved == false {
-			continue
-		}
-		// else if loan is approved, add to the string of approved loans
-		loanString, err := db.GetSingleValue(loanKey)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		if resultString != "[" {
-			resultString += ","
-		}
-		resultString += loanString
-	}
-	resultString += "]"
-	if resultString == "[]" {
+	activeLoans := filterLoansByApproval(loans, true)
+	if len(activeLoans) == 0 {
 		_, _ = w.Write([]byte("no active loans"))
 		return
 	}
-	_, _ = w.Write([]byte(resultString))
+
+	now := time.Now()
+	dueLoans := make([]dueLoan, 0, len(activeLoans))
+	for _, loan := range activeLoans {
+		dueLoans = append(dueLoans, newDueLoan(loan, now))
+	}
+	JsonResponse(dueLoans, w)
+}
+
+// dueLoan is an active loan along with how soon it is due
+type dueLoan struct {
+	config.Loan
+	DaysRemaining *int `json:"days_remaining,omitempty"`
+	Overdue       bool `json:"overdue"`
+}
+
+func newDueLoan(loan config.Loan, now time.Time) dueLoan {
+	view := dueLoan{
+		Loan:    loan,
+		Overdue: loan.IsOverdue(now),
+	}
+	if loan.DueAt != nil {
+		daysRemaining := loan.DaysRemaining(now)
+		view.DaysRemaining = &daysRemaining
+	}
+	return view
 }
 
 // GetLoanByIDHandler returns a loan by loanID for admin
 func GetLoanByIDHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	loanID := vars["id"]
-
-	loanKey := LoanPrefix + loanID
+	loanID, err := getLoanIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	loanByte, err := db.GetByteValues(loanKey)
+	loan, err := db.Loans().Get(loanID)
 	if err == nil {
-		_, _ = w.Write(loanByte)
+		JsonResponse(loan, w)
 		return
 	} else {
-		if err.Error() == db.RedisNilErr {
+		if err == db.ErrNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			_, _ = w.Write([]byte("no loan by this id"))
 			return
@@ -357,108 +320,154 @@ func GetLoanByIDHandler(w http.ResponseWriter, r *http.Request) {
 
 // GetAllLoansHandler returns to admin a list of all loans
 func GetAllLoansHandler(w http.ResponseWriter, _ *http.Request) {
-	loanKeys, err := db.ScanKeysByPrefix(LoanPrefix)
+	loans, err := db.Loans().All()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if len(loanKeys) == 0 {
+	if len(loans) == 0 {
 		_, _ = w.Write([]byte("you dont have any loans"))
 		return
 	}
-	resultString := "["
-	for _, loanKey := range loanKeys {
-		loan, err := db.GetSingleValue(loanKey)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		if resultString != "[" {
-			resultString += ","
-		}
-		resultString += loan
-	}
-	resultString += "]"
-	if resultString == "[]" {
-		_, _ = w.Write([]byte("no active loans or pending loan requests"))
-		return
-	}
-	_, _ = w.Write([]byte(resultString))
+	JsonResponse(loans, w)
 }
 
 // GetAllPendingLoansHandler returns to admin a list of all pending loans
 func GetAllPendingLoansHandler(w http.ResponseWriter, _ *http.Request) {
-	loanKeys, err := db.ScanKeysByPrefix(LoanPrefix)
+	loans, err := db.Loans().All()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if len(loanKeys) == 0 {
+	if len(loans) == 0 {
 		_, _ = w.Write([]byte("you dont have any loans"))
 		return
 	}
-	resultString := "["
-	for _, loanKey := range loanKeys {
-		loan := getLoanByKeyFromDB(loanKey)
-		if loan.Approved == true {
-			continue
-		}
 
-		loanString, err := db.GetSingleValue(loanKey)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		if resultString != "[" {
-			resultString += ","
-		}
-		resultString += loanString
-	}
-	resultString += "]"
-	if resultString == "[]" {
+	pendingLoans := filterLoansByApproval(loans, false)
+	if len(pendingLoans) == 0 {
 		_, _ = w.Write([]byte("no pending loan requests"))
 		return
 	}
-	_, _ = w.Write([]byte(resultString))
+	JsonResponse(pendingLoans, w)
 }
 
 // GetAllActiveLoansHandler returns to admin a list of all active loans
 func GetAllActiveLoansHandler(w http.ResponseWriter, _ *http.Request) {
-	loanKeys, err := db.ScanKeysByPrefix(LoanPrefix)
+	loans, err := db.Loans().All()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if len(loanKeys) == 0 {
+	if len(loans) == 0 {
 		_, _ = w.Write([]byte("you dont have any loans"))
 		return
 	}
-	resultString := "["
-	for _, loanKey := range loanKeys {
-		loan := getLoanByKeyFromDB(loanKey)
-		if loan.Approved == false {
+
+	activeLoans := filterLoansByApproval(loans, true)
+	if len(activeLoans) == 0 {
+		_, _ = w.Write([]byte("no active loans"))
+		return
+	}
+	JsonResponse(activeLoans, w)
+}
+
+// GetLoanHistoryForThisUserHandler returns the closed
+// loans of this user, the latest first
+func GetLoanHistoryForThisUserHandler(w http.ResponseWriter, r *http.Request) {
+	loans, err := db.Loans().UserHistory(auth.PrincipalOf(r).Username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(loans) == 0 {
+		_, _ = w.Write([]byte("no past loans"))
+		return
+	}
+	JsonResponse(loans, w)
+}
+
+// GetBookLoanHistoryHandler returns to admin the closed
+// loans of a book, the latest first
+func GetBookLoanHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bookID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "book id has to be an integer", http.StatusBadRequest)
+		return
+	}
+
+	loans, err := db.Loans().BookHistory(bookID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(loans) == 0 {
+		_, _ = w.Write([]byte("this book has never been loaned"))
+		return
+	}
+	JsonResponse(loans, w)
+}
+
+// overdueLoan is an entry of the overdue loans report
+type overdueLoan struct {
+	config.Loan
+	BookName    string `json:"book_name"`
+	DaysOverdue int    `json:"days_overdue"`
+}
+
+// GetOverdueLoansHandler returns to admin a report of all loans
+// that are past their due date, the most overdue first
+func GetOverdueLoansHandler(w http.ResponseWriter, _ *http.Request) {
+	loans, err := db.Loans().All()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	report := []overdueLoan{}
+	for _, loan := range loans {
+		if !loan.IsOverdue(now) {
 			continue
 		}
-
-		loanString, err := db.GetSingleValue(loanKey)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		entry := overdueLoan{
+			Loan:        loan,
+			DaysOverdue: -loan.DaysRemaining(now),
 		}
-
-		if resultString != "[" {
-			resultString += ","
+		// the report is still useful for a book that has been deleted since
+		if book, err := db.Books().Get(loan.BookID); err == nil {
+			entry.BookName = book.BookName
 		}
-		resultString += loanString
+		report = append(report, entry)
 	}
-	resultString += "]"
-	if resultString == "[]" {
-		_, _ = w.Write([]byte("no active loans"))
+	if len(report) == 0 {
+		_, _ = w.Write([]byte("no overdue loans"))
 		return
 	}
-	_, _ = w.Write([]byte(resultString))
+
+	sort.Slice(report, func(i, j int) bool { return report[i].DueAt.Before(*report[j].DueAt) })
+	JsonResponse(report, w)
+}
+
+// loanErrorResponse writes the response for an error
+// that came out of moving a loan to another state
+func loanErrorResponse(err error, w http.ResponseWriter) {
+	if _, ok := err.(*config.TransitionError); ok {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	switch err {
+	case db.ErrNotFound:
+		http.Error(w, "loan doesn't exist", http.StatusNotFound)
+	case db.ErrNotYourLoan:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case db.ErrBookMissing, db.ErrNoCopyAvailable, db.ErrRenewOverdue, db.ErrRenewLimit, db.ErrRenewHeld,
+		db.ErrItemNotOfBook, db.ErrItemUnavailable:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 // extract info about loan from the incoming request
@@ -472,65 +481,67 @@ func getLoanDetails(r *http.Request) config.Loan {
 
 	loan := config.Loan{}
 	loan.BookID = bookID
-	loanID := 0
-	for n := 1; loanID == 0; n++ {
-		_, err := db.GetByteValues(LoanPrefix + strconv.Itoa(n))
-		if err != nil && err.Error() == db.RedisNilErr {
-			loanID = n
-		}
-	}
-
-	loan.ID = loanID
-
-	loan.Username = r.Header.Get(auth.UsernameKey)
+	loan.Username = auth.PrincipalOf(r).Username
 	loan.Approved = false
+	loan.Status = config.LoanRequested
+	loan.RequestedAt = time.Now()
 
 	return loan
 }
 
-func getLoanByKeyFromDB(loanKey string) config.Loan {
-
-	loanByte, err := db.GetByteValues(loanKey)
+func getLoanIDFromPath(r *http.Request) (int, error) {
+	vars := mux.Vars(r)
+	loanID, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		return config.Loan{}
+		return 0, errors.New("loan id is must be an integer")
 	}
-	loan := config.Loan{}
+	return loanID, nil
+}
 
-	if err := json.Unmarshal(loanByte, &loan); err != nil {
-		return config.Loan{}
+// getLoansOfUser returns the loans listed in the user's loan array
+func getLoansOfUser(username string) ([]config.Loan, error) {
+	user, err := db.Users().Get(username)
+	if err != nil {
+		return nil, err
 	}
 
-	return loan
+	loans := []config.Loan{}
+	for _, loanID := range user.LoanIDArray {
+		loan, err := db.Loans().Get(loanID)
+		if err != nil {
+			return nil, err
+		}
+		loans = append(loans, loan)
+	}
+	return loans, nil
 }
 
-func ValidateLoanCreate(loan config.Loan) (config.Loan, error) {
-	if loan.ID == 0 || loan.Username == "" || loan.BookID == 0 {
-		return config.Loan{}, errors.New("loanID, username, or BookID is missing")
+func filterLoansByApproval(loans []config.Loan, approved bool) []config.Loan {
+	filtered := []config.Loan{}
+	for _, loan := range loans {
+		if loan.Approved == approved {
+			filtered = append(filtered, loan)
+		}
 	}
-	return loan, nil
+	return filtered
 }
 
-func removeLoanIDFromUser(userKey string, loanID int) error {
-	user, err := getUserByKey(userKey)
-	if err != nil {
-		return err
+// ValidateLoanCreate checks that a loan request is for a book that exists.
+// The loan policy is checked as the loan is created, see checkLoanPolicy.
+// A request that is turned down gets a *LoanRejection error
+func ValidateLoanCreate(loan config.Loan) (config.Loan, error) {
+	if loan.Username == "" || loan.BookID == 0 {
+		return config.Loan{}, rejectLoan(http.StatusBadRequest, RejectMissingFields, "username, or BookID is missing")
 	}
 
-	// remove loan from loan array
-	newLoanIDArray := RemoveElementFromArray(user.LoanIDArray, loanID)
-	// replace existing array with this new one
-	user.LoanIDArray = newLoanIDArray
-	//Save the new information in db
-	userBytes, err := json.Marshal(user)
+	exists, err := db.Books().Exists(loan.BookID)
 	if err != nil {
-		return err
+		return config.Loan{}, err
 	}
-	err = db.SetJsonValues(userKey, userBytes)
-	if err != nil {
-		return err
+	if !exists {
+		return config.Loan{}, rejectLoan(http.StatusNotFound, RejectBookNotFound, "book %d doesn't exist", loan.BookID)
 	}
-
-	return nil
+	return loan, nil
 }
 
 // A helper method that removes a single element from an array
@@ -546,27 +557,3 @@ func RemoveElementFromArray(sourceArray []int, element int) []int {
 	}
 	return sourceArray
 }
-
-func updateBookLoanCountByID(bookID int, count int) error {
-	bookKey := BookPrefix + strconv.Itoa(bookID)
-	savedBook := config.Book{}
-	savedBookByte, err := db.GetByteValues(bookKey)
-	if err != nil {
-		return err
-	}
-
-	if err := json.Unmarshal(savedBookByte, &savedBook); err != nil {
-		log.Println("unmarshal error :", err.Error())
-		return err
-	}
-	if savedBook.OnLoanCount+count <= savedBook.TotalCount && savedBook.OnLoanCount+count >= 0 {
-		savedBook.OnLoanCount += count
-		newBookByte, err := json.Marshal(savedBook)
-		if err != nil {
-			return err
-		}
-		_ = db.SetJsonValues(bookKey, newBookByte)
-		return nil
-	}
-	return errors.New("can not loan this book at the moment")
-}
@@ -0,0 +1,109 @@
+package routes
+
+import (
+	"encoding/json"
+	"evl-book-server/config"
+	"fmt"
+	"net/http"
+)
+
+// Reasons a loan request can be rejected for
+const (
+	RejectMissingFields    = "missing_fields"
+	RejectBookNotFound     = "book_not_found"
+	RejectDuplicateRequest = "duplicate_request"
+	RejectMaxPending       = "max_pending_requests"
+	RejectMaxActive        = "max_active_loans"
+	RejectFinesOwed        = "fines_owed"
+)
+
+// LoanRejection tells why the loan policy turned a loan request down
+type LoanRejection struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	status  int
+}
+
+func (e *LoanRejection) Error() string {
+	return e.Message
+}
+
+func rejectLoan(status int, reason string, format string, args ...interface{}) *LoanRejection {
+	return &LoanRejection{Reason: reason, Message: fmt.Sprintf(format, args...), status: status}
+}
+
+// loanRule checks a loan request of user, who has the open loans and owes the balance given
+type loanRule func(loan config.Loan, user config.UserCredentials, openLoans []config.Loan, balance int) *LoanRejection
+
+// loanRules are checked in order, the first one to reject a request wins
+var loanRules = []loanRule{
+	duplicateRequestRule,
+	loanLimitsRule,
+	finesOwedRule,
+}
+
+// checkLoanPolicy is the db.LoanCheck of the loan rules. The store runs it
+// inside the update that opens the loan, against the user record it reads
+func checkLoanPolicy(loan config.Loan, user config.UserCredentials, openLoans []config.Loan, balance int) error {
+	for _, rule := range loanRules {
+		if rejection := rule(loan, user, openLoans, balance); rejection != nil {
+			return rejection
+		}
+	}
+	return nil
+}
+
+func duplicateRequestRule(loan config.Loan, _ config.UserCredentials, openLoans []config.Loan, _ int) *LoanRejection {
+	if config.LoanPolicy().AllowDuplicateRequests {
+		return nil
+	}
+	for _, openLoan := range openLoans {
+		if openLoan.BookID == loan.BookID {
+			return rejectLoan(http.StatusConflict, RejectDuplicateRequest,
+				"you already have loan %d of this book", openLoan.ID)
+		}
+	}
+	return nil
+}
+
+func loanLimitsRule(_ config.Loan, user config.UserCredentials, openLoans []config.Loan, _ int) *LoanRejection {
+	limits := config.LoanPolicy().LimitsFor(user.Role())
+	pending := 0
+	for _, openLoan := range openLoans {
+		if openLoan.State() == config.LoanRequested {
+			pending++
+		}
+	}
+	active := len(openLoans) - pending
+
+	if limits.MaxPendingRequests > 0 && pending >= limits.MaxPendingRequests {
+		return rejectLoan(http.StatusForbidden, RejectMaxPending,
+			"you can have at most %d pending loan requests", limits.MaxPendingRequests)
+	}
+	if limits.MaxActiveLoans > 0 && active >= limits.MaxActiveLoans {
+		return rejectLoan(http.StatusForbidden, RejectMaxActive,
+			"you can have at most %d books on loan", limits.MaxActiveLoans)
+	}
+	return nil
+}
+
+func finesOwedRule(_ config.Loan, _ config.UserCredentials, _ []config.Loan, balance int) *LoanRejection {
+	if !config.Fines().BlocksLoans(balance) {
+		return nil
+	}
+	return rejectLoan(http.StatusForbidden, RejectFinesOwed,
+		"you owe %d in fines, pay them before requesting a loan", balance)
+}
+
+// writeLoanRejection responds with the rejection as json, so
+// that clients can tell the reason without parsing the message
+func writeLoanRejection(rejection *LoanRejection, w http.ResponseWriter) {
+	jsonResponse, err := json.Marshal(rejection)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jsonResponse")
+	w.WriteHeader(rejection.status)
+	_, _ = w.Write(jsonResponse)
+}
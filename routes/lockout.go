@@ -0,0 +1,146 @@
+package routes
+
+import (
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// loginAttempt is a login that counts as failed until it is known not to be
+type loginAttempt struct {
+	username, ip string
+	user, fromIP config.LoginAttempts
+}
+
+// loginWait turns a login down until it can be tried again
+type loginWait struct {
+	message string
+	wait    time.Duration
+}
+
+func (e *loginWait) Error() string {
+	return e.message
+}
+
+// startLogin counts a login of username from ip as failed before the
+// password is verified, so parallel guesses can't all get past the back-off
+// and the lockout. If the login has to wait, it answers with 429 and a
+// Retry-After header, and returns false
+func startLogin(username, ip string, w http.ResponseWriter) (loginAttempt, bool) {
+	lockout := config.Lockout()
+	attempt := loginAttempt{username: username, ip: ip}
+	var err error
+	attempt.user, err = db.UserLoginAttempts().Attempt(username, lockout.FailureWindow, lockout.MaxUserFailures, lockout.LockoutDuration,
+		func(attempts config.LoginAttempts, now time.Time) error {
+			wait := lockout.RetryAfter(attempts, now, true)
+			switch {
+			case attempts.IsLocked(now):
+				return &loginWait{"account is locked after too many failed logins", wait}
+			case wait > 0:
+				return &loginWait{"too many failed logins", wait}
+			}
+			return nil
+		})
+	if err != nil {
+		refuseLogin(err, w)
+		return loginAttempt{}, false
+	}
+	attempt.fromIP, err = db.IPLoginAttempts().Attempt(ip, lockout.FailureWindow, lockout.MaxIPFailures, lockout.LockoutDuration,
+		func(attempts config.LoginAttempts, now time.Time) error {
+			if attempts.IsLocked(now) {
+				return &loginWait{"too many failed logins from this address", lockout.RetryAfter(attempts, now, false)}
+			}
+			return nil
+		})
+	if err != nil {
+		releaseAttempt(db.UserLoginAttempts(), username)
+		refuseLogin(err, w)
+		return loginAttempt{}, false
+	}
+	return attempt, true
+}
+
+func refuseLogin(err error, w http.ResponseWriter) {
+	wait, ok := err.(*loginWait)
+	if !ok {
+		if err != db.ErrTxConflict {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		wait = &loginWait{"too many logins at once", time.Second}
+	}
+	seconds := int((wait.wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("%s, try again in %d seconds", wait.message, seconds), http.StatusTooManyRequests)
+}
+
+// failed records the lockouts the failed login caused in the audit log,
+// the login itself was counted as it started
+func (a loginAttempt) failed() {
+	lockout := config.Lockout()
+	if a.user.Failures == lockout.MaxUserFailures {
+		audit(config.AuditEntry{
+			Kind:     config.AuditAccountLocked,
+			Username: a.username,
+			IP:       a.ip,
+			Note:     fmt.Sprintf("%d failed logins, locked until %s", a.user.Failures, a.user.LockedUntil.Format(time.RFC3339)),
+		})
+	}
+	if a.fromIP.Failures == lockout.MaxIPFailures {
+		audit(config.AuditEntry{
+			Kind: config.AuditIPLocked,
+			IP:   a.ip,
+			Note: fmt.Sprintf("%d failed logins, locked until %s", a.fromIP.Failures, a.fromIP.LockedUntil.Format(time.RFC3339)),
+		})
+	}
+}
+
+// succeeded forgets the failed logins of the username, and takes
+// the login back from those of the client IP
+func (a loginAttempt) succeeded() {
+	loginSucceeded(a.username)
+	releaseAttempt(db.IPLoginAttempts(), a.ip)
+}
+
+// release takes the login back, as it was neither right nor wrong
+func (a loginAttempt) release() {
+	releaseAttempt(db.UserLoginAttempts(), a.username)
+	releaseAttempt(db.IPLoginAttempts(), a.ip)
+}
+
+func releaseAttempt(attempts db.LoginAttemptStore, name string) {
+	if err := attempts.Release(name, config.Lockout().FailureWindow); err != nil {
+		log.Println("could not take back the login of", name, err.Error())
+	}
+}
+
+// loginSucceeded forgets the failed logins of username. Those of the
+// client IP are kept, as they may be guesses at other accounts
+func loginSucceeded(username string) {
+	if err := db.UserLoginAttempts().Clear(username); err != nil {
+		log.Println("could not clear the failed logins of", username, err.Error())
+	}
+}
+
+// clientIP returns the address the request came from. Forwarding headers
+// are ignored, anyone can set them to dodge the per IP counter
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// audit appends entry to the audit log. A failure is only logged,
+// the action being audited has already happened
+func audit(entry config.AuditEntry) {
+	if _, err := db.Audit().Record(entry); err != nil {
+		log.Println("could not record", entry.Kind, "in the audit log", err.Error())
+	}
+}
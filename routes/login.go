@@ -3,17 +3,26 @@ package routes
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"evl-book-server/auth"
 	"evl-book-server/config"
 	"evl-book-server/db"
+	"evl-book-server/passhash"
+	"github.com/dgrijalva/jwt-go"
+	"log"
 	"net/http"
 	"strings"
 )
 
+// errPasswordChanged stops a rehash when the password
+// was changed since the legacy hash was verified
+var errPasswordChanged = errors.New("password changed during the rehash")
+
 // LoginHandler lets user login using basic auth
 // credentials used during the signup process. It
 // returns a token upon successful login, that can
-// be used to access user specific contents
+// be used to access user specific contents.
+// Users with two-factor login send a code too
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	user := getBasicAuthCredentials(r)
 	if user.Username == "" || user.Password == "" {
@@ -21,33 +30,125 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// guessing passwords gets slower with every failed login. The login
+	// counts as failed until the password is verified
+	attempt, allowed := startLogin(user.Username, clientIP(r), w)
+	if !allowed {
+		return
+	}
+
 	// use db to verify credentials
 	ok, user, err := UserAuthentication(user.Username, user.Password)
 	if err != nil {
-		if err.Error() == db.RedisNilErr {
+		if err == db.ErrNotFound {
+			attempt.failed()
 			w.WriteHeader(http.StatusUnauthorized)
 			_, _ = w.Write([]byte("user doesn't exist"))
 			return
 		}
+		attempt.release()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	if !ok {
+		attempt.failed()
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	//Generate token
-	token, err := auth.GenerateJWT(user)
+	// accounts with two-factor login need a code as well
+	if user.HasTwoFactor() {
+		code := r.Header.Get(TwoFactorCodeHeader)
+		if code == "" {
+			attempt.release()
+			w.Header().Set(TwoFactorCodeHeader, "required")
+			http.Error(w, "one-time code required in the "+TwoFactorCodeHeader+" header", http.StatusUnauthorized)
+			return
+		}
+		ok, err := verifySecondFactor(user, code)
+		if err != nil {
+			attempt.release()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			attempt.failed()
+			http.Error(w, "one-time code not valid", http.StatusUnauthorized)
+			return
+		}
+	}
+	attempt.succeeded()
+	if user.UserData.Disabled {
+		http.Error(w, auth.ErrAccountDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	//Generate an access token, and a refresh token to get new ones with
+	tokens, err := auth.IssueTokens(user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	//create a token instance using the token string
-	JsonResponse(token, w)
+	JsonResponse(tokens, w)
+
+}
 
+// refreshRequest carries the refresh token sent
+// to /api/token/refresh and /api/logout
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshTokenHandler exchanges a refresh token for a new
+// access token and refresh token. A refresh token works only once
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	body := refreshRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		http.Error(w, "refresh_token is missing", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := auth.RefreshTokens(body.RefreshToken)
+	if err != nil {
+		if _, ok := err.(*jwt.ValidationError); ok || err == auth.ErrTokenRevoked || err == auth.ErrWrongTokenType ||
+			err == auth.ErrAccountDisabled || err == db.ErrNotFound {
+			http.Error(w, "refresh token not valid: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	JsonResponse(tokens, w)
+}
+
+// LogoutHandler revokes the access token the request was made with,
+// along with the refresh token if one is sent in the body
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	tokens := []string{auth.BearerToken(r)}
+	body := refreshRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err == nil && body.RefreshToken != "" {
+		tokens = append(tokens, body.RefreshToken)
+	}
+
+	username := auth.PrincipalOf(r).Username
+	for i, tokenString := range tokens {
+		tokenType := auth.AccessToken
+		if i > 0 {
+			tokenType = auth.RefreshToken
+		}
+		claims, err := auth.ParseToken(tokenString, tokenType)
+		if err != nil || claims[auth.UsernameKey] != username {
+			// an unusable refresh token has nothing left to revoke
+			continue
+		}
+		if err := auth.RevokeToken(claims); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	_, _ = w.Write([]byte("logged out successfully"))
 }
 
 func JsonResponse(response interface{}, w http.ResponseWriter) {
@@ -85,15 +186,42 @@ func getBasicAuthCredentials(r *http.Request) config.UserCredentials {
 	}
 }
 
+// UserAuthentication checks the password of a user. Passwords
+// stored in an outdated hash format are rehashed on a successful login
 func UserAuthentication(username, password string) (bool, config.UserCredentials, error) {
-	userDetails, err := db.GetByteValues(UserPrefix + username)
+	user, err := db.Users().Get(username)
 	if err != nil {
 		return false, config.UserCredentials{}, err
 	}
-
-	user := config.UserCredentials{}
-	if err := json.Unmarshal(userDetails, &user); err != nil {
+	// users created at their first OIDC login have no password,
+	// they can only login through the provider
+	if user.Password == "" {
+		return false, config.UserCredentials{}, nil
+	}
+	ok, err := passhash.Verify(user.Password, password)
+	if err != nil {
 		return false, config.UserCredentials{}, err
 	}
-	return GetMD5Hash(password) == user.Password, user, nil
+	if ok && passhash.NeedsRehash(user.Password) {
+		// the login doesn't depend on the migration succeeding. Only the
+		// password is written, and only if it is still the one verified
+		if hash, err := passhash.Hash(password); err == nil {
+			legacyHash := user.Password
+			rehashed, err := db.Users().Update(user.Username, func(saved *config.UserCredentials) error {
+				if saved.Password != legacyHash {
+					return errPasswordChanged
+				}
+				saved.Password = hash
+				return nil
+			})
+			switch err {
+			case nil:
+				user = rehashed
+			case errPasswordChanged:
+			default:
+				log.Println("could not rehash password of", user.Username)
+			}
+		}
+	}
+	return ok, user, nil
 }
@@ -0,0 +1,219 @@
+package routes
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"evl-book-server/auth"
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"evl-book-server/oidc"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OIDCStateCookie ties a login with the OpenID Connect provider
+// to the browser that started it
+const OIDCStateCookie = "oidc_state"
+
+// how long a user has to login with the provider
+const oidcLoginTTL = 10 * time.Minute
+
+var (
+	errOIDCNoUsername  = errors.New("id token has no username")
+	errOIDCLocalTaken  = errors.New("username is taken by an account that isn't linked to the identity provider")
+	errOIDCStateBroken = errors.New("login state doesn't match, start the login again")
+)
+
+// OIDCLoginHandler starts a login with the OpenID Connect provider,
+// sending the user there
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	oidcCfg := config.OIDC()
+	if !oidcCfg.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := oidc.Discover(oidcCfg.Issuer)
+	if err != nil {
+		http.Error(w, "identity provider is unavailable: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	expiresAt := time.Now().Add(oidcLoginTTL)
+	if err := db.OIDCLogins().Start(state, config.OIDCLogin{Nonce: nonce, ExpiresAt: expiresAt}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCStateCookie,
+		Value:    state,
+		Path:     "/api/oidc",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   config.App().Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.AuthCodeURL(oidcCfg.ClientID, oidcCfg.RedirectURL, state, nonce, oidcCfg.Scopes), http.StatusFound)
+}
+
+// OIDCCallbackHandler finishes a login with the OpenID Connect provider.
+// The user of the ID token is mapped to a local user, created on their
+// first login, whose role follows their groups. It returns the tokens
+// of the local user, like LoginHandler
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	oidcCfg := config.OIDC()
+	if !oidcCfg.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		http.Error(w, "identity provider refused the login: "+providerErr+" "+query.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+
+	// the state has to come back to the browser it was given to, once
+	state := query.Get("state")
+	cookie, err := r.Cookie(OIDCStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, errOIDCStateBroken.Error(), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: OIDCStateCookie, Path: "/api/oidc", MaxAge: -1})
+	login, err := db.OIDCLogins().Finish(state)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, errOIDCStateBroken.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	provider, err := oidc.Discover(oidcCfg.Issuer)
+	if err != nil {
+		http.Error(w, "identity provider is unavailable: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	idToken, err := provider.Exchange(query.Get("code"), oidcCfg.ClientID, oidcCfg.ClientSecret, oidcCfg.RedirectURL)
+	if err != nil {
+		http.Error(w, "could not login with the identity provider: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	claims, err := provider.VerifyIDToken(idToken, oidcCfg.ClientID, login.Nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := oidcUser(claims)
+	if err != nil {
+		switch err {
+		case errOIDCNoUsername:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errOIDCLocalTaken:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if user.UserData.Disabled {
+		http.Error(w, auth.ErrAccountDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	tokens, err := auth.IssueTokens(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	JsonResponse(tokens, w)
+}
+
+// oidcUser returns the local user of the claims of an ID token, creating
+// it on the first login. Name, email and role are updated on every login
+func oidcUser(claims jwt.MapClaims) (config.UserCredentials, error) {
+	oidcCfg := config.OIDC()
+	username, _ := claims[oidcCfg.UsernameClaim].(string)
+	if username == "" {
+		return config.UserCredentials{}, errOIDCNoUsername
+	}
+	subject, _ := claims["sub"].(string)
+	name, _ := claims["name"].(string)
+	email, _ := claims["email"].(string)
+	role := oidcCfg.MapRole(claimStrings(claims[oidcCfg.RolesClaim]))
+
+	update := func(user *config.UserCredentials) {
+		if name != "" {
+			user.Name = name
+		}
+		if email != "" {
+			user.Email = email
+		}
+		user.SetRole(role)
+	}
+	user, err := db.Users().Update(username, func(user *config.UserCredentials) error {
+		if user.UserData.OIDCSubject != subject {
+			return errOIDCLocalTaken
+		}
+		update(user)
+		return nil
+	})
+	if err != db.ErrNotFound {
+		return user, err
+	}
+
+	user = config.UserCredentials{
+		Username: username,
+		UserData: config.UserData{OIDCSubject: subject},
+	}
+	update(&user)
+	if err := db.Users().Create(user); err != nil {
+		if err == db.ErrUserExists {
+			// the username was taken meanwhile, by a signup or
+			// another first login, which decides like any other user
+			return oidcUser(claims)
+		}
+		return config.UserCredentials{}, err
+	}
+	return user, nil
+}
+
+// claimStrings returns a claim that is a list of strings, or a string
+func claimStrings(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Fields(claim)
+	case []interface{}:
+		values := make([]string, 0, len(claim))
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func randomToken() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
@@ -0,0 +1,166 @@
+package routes
+
+import (
+	"encoding/json"
+	"evl-book-server/auth"
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"evl-book-server/notify"
+	"evl-book-server/passhash"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"log"
+	"net/http"
+	"time"
+)
+
+// forgotPassword names the account whose password is forgotten
+type forgotPassword struct {
+	Username string `json:"username"`
+}
+
+// tokenPasswordReset is a new password, along with the token
+// that was sent to the user to prove they own the account
+type tokenPasswordReset struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ForgotPasswordHandler sends a password reset token to the email
+// address of a user. The response is the same whether or not the
+// user exists, and the token is sent after answering, so that it
+// can't be used to find out usernames. Requests are limited per
+// username and per client IP, as every one of them sends a message
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	body := forgotPassword{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Username == "" {
+		http.Error(w, "username is missing", http.StatusBadRequest)
+		return
+	}
+	if !countResetRequest(body.Username, clientIP(r), w) {
+		return
+	}
+
+	go func(username string) {
+		if err := sendPasswordResetToken(username); err != nil {
+			log.Println("could not send a password reset token to", username, err.Error())
+		}
+	}(body.Username)
+	_, _ = w.Write([]byte("if the account has an email address, a password reset token has been sent to it"))
+}
+
+// ResetPasswordWithTokenHandler sets a new password for the user of
+// a password reset token. The token works once, and every other token
+// of the user is revoked, so whoever had the old password is logged out
+func ResetPasswordWithTokenHandler(w http.ResponseWriter, r *http.Request) {
+	body := tokenPasswordReset{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" || body.Password == "" {
+		http.Error(w, "token and password are required", http.StatusBadRequest)
+		return
+	}
+	hash, err := passhash.Hash(body.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	claims, err := auth.ConsumeToken(body.Token, auth.PasswordResetToken)
+	if err != nil {
+		if _, ok := err.(*jwt.ValidationError); ok || err == auth.ErrTokenRevoked || err == auth.ErrWrongTokenType {
+			http.Error(w, "password reset token not valid: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	username, _ := claims[auth.UsernameKey].(string)
+	user, err := db.Users().Update(username, func(user *config.UserCredentials) error {
+		if user.UserData.Disabled {
+			return auth.ErrAccountDisabled
+		}
+		user.Password = hash
+		return nil
+	})
+	if err != nil {
+		switch err {
+		case db.ErrNotFound:
+			http.Error(w, "user doesn't exist", http.StatusUnauthorized)
+		case auth.ErrAccountDisabled:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := db.Tokens().RevokeAll(user.Username); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// the owner of the account is back, failed logins no longer lock them
+	// out, and they can ask for a reset again
+	loginSucceeded(user.Username)
+	if err := db.UserResetRequests().Clear(user.Username); err != nil {
+		log.Println("could not clear the reset requests of", user.Username, err.Error())
+	}
+	audit(config.AuditEntry{Kind: config.AuditPasswordReset, Username: user.Username, IP: clientIP(r)})
+	_, _ = w.Write([]byte("password reset, login with your new password"))
+}
+
+// countResetRequest counts a password reset request for username from ip,
+// whether or not the user exists. Past the limits of the lockout config,
+// it answers with 429 and a Retry-After header, and returns false
+func countResetRequest(username, ip string, w http.ResponseWriter) bool {
+	lockout := config.Lockout()
+	limits := []struct {
+		requests db.LoginAttemptStore
+		name     string
+		max      int
+	}{
+		{db.IPResetRequests(), ip, lockout.MaxIPResets},
+		{db.UserResetRequests(), username, lockout.MaxUserResets},
+	}
+	for _, limit := range limits {
+		_, err := limit.requests.Attempt(limit.name, lockout.FailureWindow, limit.max, lockout.LockoutDuration,
+			func(requests config.LoginAttempts, now time.Time) error {
+				if requests.IsLocked(now) {
+					return &loginWait{"too many password reset requests", lockout.RetryAfter(requests, now, false)}
+				}
+				return nil
+			})
+		if err != nil {
+			refuseLogin(err, w)
+			return false
+		}
+	}
+	return true
+}
+
+// sendPasswordResetToken notifies the user of username with a new password
+// reset token. Users without an email address, disabled, or who login
+// with the OpenID Connect provider get nothing
+func sendPasswordResetToken(username string) error {
+	user, err := db.Users().Get(username)
+	if err == db.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Email == "" || user.UserData.Disabled || user.IsExternal() {
+		return nil
+	}
+
+	token, err := auth.IssuePasswordResetToken(user)
+	if err != nil {
+		return err
+	}
+	return notify.Send(notify.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of %s. If it wasn't you, ignore this message.\n\n"+
+			"To set a new password within %d minutes, send this token to /api/password/reset:\n\n%s\n",
+			user.Username, int(config.Auth().PasswordResetTTL.Minutes()), token),
+	})
+}
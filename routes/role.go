@@ -0,0 +1,62 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"evl-book-server/auth"
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+var errOwnRole = errors.New("you can't change your own role")
+
+// roleAssignment is the role of a user, as sent to and returned by AssignRoleHandler
+type roleAssignment struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// GetRolesHandler returns to admin the permissions of every role
+func GetRolesHandler(w http.ResponseWriter, _ *http.Request) {
+	JsonResponse(config.RolePermissions(), w)
+}
+
+// AssignRoleHandler is used by the admin to give a user a role.
+// Nobody can change their own role, so there is always an admin left
+func AssignRoleHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	assignment := roleAssignment{}
+	if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil || !config.RoleExists(assignment.Role) {
+		http.Error(w, "role has to be one of patron, librarian, cataloguer, auditor or admin", http.StatusBadRequest)
+		return
+	}
+
+	setRole(username, assignment.Role, w, r)
+}
+
+// setRole gives the user of username role, unless that is the user making the request
+func setRole(username, role string, w http.ResponseWriter, r *http.Request) {
+	user, err := db.Users().Update(username, func(user *config.UserCredentials) error {
+		if strings.EqualFold(user.Username, auth.PrincipalOf(r).Username) {
+			return errOwnRole
+		}
+		user.SetRole(role)
+		return nil
+	})
+	if err != nil {
+		switch err {
+		case db.ErrNotFound:
+			http.Error(w, "user doesn't exist", http.StatusNotFound)
+		case errOwnRole:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	JsonResponse(roleAssignment{Username: user.Username, Role: user.Role()}, w)
+}
@@ -0,0 +1,199 @@
+package routes
+
+import (
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"evl-book-server/search"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Weights of the fields of the catalogue in the search index. The names
+// of the contributors of a book count for it too, less than the title does
+const (
+	titleWeight       = 3
+	authorNameWeight  = 3
+	contributorWeight = 1
+)
+
+// Types of search results
+const (
+	bookResult   = "book"
+	authorResult = "author"
+)
+
+// searchResult is a book or an author that matches a search
+type searchResult struct {
+	Type     string  `json:"type"`
+	ID       int     `json:"id"`
+	Name     string  `json:"name"`
+	AuthorID int     `json:"author_id,omitempty"`
+	Score    float64 `json:"score"`
+}
+
+// SearchHandler returns the books and authors that match every word
+// of the q query parameter, the best match first. Words match the
+// start of words in titles and author names, whatever their case
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "q is missing", http.StatusBadRequest)
+		return
+	}
+	limit := defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxPageSize {
+			http.Error(w, "limit has to be between 1 and "+strconv.Itoa(maxPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	hits, err := search.Rank(q, db.Search().Lookup)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	results := []searchResult{}
+	for _, hit := range hits {
+		if len(results) == limit {
+			break
+		}
+		result, err := loadSearchResult(hit)
+		if err == db.ErrNotFound {
+			// removed without the index knowing, rebuilding it cleans up
+			continue
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		results = append(results, result)
+	}
+	JsonResponse(results, w)
+}
+
+func loadSearchResult(hit search.Hit) (searchResult, error) {
+	result := searchResult{Score: hit.Score}
+	switch {
+	case strings.HasPrefix(hit.Key, db.BookPrefix):
+		id, _ := strconv.Atoi(strings.TrimPrefix(hit.Key, db.BookPrefix))
+		book, err := db.Books().Get(id)
+		if err != nil {
+			return result, err
+		}
+		result.Type, result.ID, result.Name, result.AuthorID = bookResult, book.ID, book.BookName, book.AuthorID
+	case strings.HasPrefix(hit.Key, db.AuthorPrefix):
+		id, _ := strconv.Atoi(strings.TrimPrefix(hit.Key, db.AuthorPrefix))
+		author, err := db.Authors().Get(id)
+		if err != nil {
+			return result, err
+		}
+		result.Type, result.ID, result.Name = authorResult, author.ID, author.AuthorName
+	default:
+		return result, db.ErrNotFound
+	}
+	return result, nil
+}
+
+// RebuildSearchIndex indexes the whole catalogue from scratch
+func RebuildSearchIndex() (int, error) {
+	if err := db.Search().Clear(); err != nil {
+		return 0, err
+	}
+	authors, err := db.Authors().All()
+	if err != nil {
+		return 0, err
+	}
+	names := map[int]string{}
+	for _, author := range authors {
+		names[author.ID] = author.AuthorName
+		if err := db.Search().Index(authorKey(author.ID), authorTerms(author)); err != nil {
+			return 0, err
+		}
+	}
+	books, err := db.Books().All()
+	if err != nil {
+		return 0, err
+	}
+	for _, book := range books {
+		contributorNames := []string{}
+		for _, contributor := range book.Credits() {
+			contributorNames = append(contributorNames, names[contributor.AuthorID])
+		}
+		if err := db.Search().Index(bookKey(book.ID), bookTerms(book, contributorNames)); err != nil {
+			return 0, err
+		}
+	}
+	return len(authors) + len(books), nil
+}
+
+// indexBook brings the index up to date with book. The catalogue
+// doesn't depend on the index, so failing to update it is only logged
+func indexBook(book config.Book) {
+	contributorNames := []string{}
+	for _, contributor := range book.Credits() {
+		author, err := db.Authors().Get(contributor.AuthorID)
+		if err != nil && err != db.ErrNotFound {
+			log.Println("could not index book", book.ID, err.Error())
+			return
+		}
+		contributorNames = append(contributorNames, author.AuthorName)
+	}
+	if err := db.Search().Index(bookKey(book.ID), bookTerms(book, contributorNames)); err != nil {
+		log.Println("could not index book", book.ID, err.Error())
+	}
+}
+
+// indexAuthor brings the index up to date with author
+func indexAuthor(author config.Author) {
+	if err := db.Search().Index(authorKey(author.ID), authorTerms(author)); err != nil {
+		log.Println("could not index author", author.ID, err.Error())
+	}
+}
+
+// unindex drops the record of key from the index
+func unindex(key string) {
+	if err := db.Search().Remove(key); err != nil {
+		log.Println("could not drop", key, "from the search index", err.Error())
+	}
+}
+
+// reindexBooks indexes the books of works again,
+// as they carry the names of their contributors
+func reindexBooks(works []config.Work) {
+	indexed := map[int]bool{}
+	for _, work := range works {
+		if indexed[work.BookID] {
+			continue
+		}
+		indexed[work.BookID] = true
+		book, err := db.Books().Get(work.BookID)
+		if err != nil {
+			continue
+		}
+		indexBook(book)
+	}
+}
+
+func bookTerms(book config.Book, contributorNames []string) map[string]int {
+	terms := search.Terms(nil, book.BookName, titleWeight)
+	for _, name := range contributorNames {
+		terms = search.Terms(terms, name, contributorWeight)
+	}
+	return terms
+}
+
+func authorTerms(author config.Author) map[string]int {
+	return search.Terms(nil, author.AuthorName, authorNameWeight)
+}
+
+func bookKey(id int) string {
+	return db.BookPrefix + strconv.Itoa(id)
+}
+
+func authorKey(id int) string {
+	return db.AuthorPrefix + strconv.Itoa(id)
+}
@@ -1,16 +1,14 @@
 package routes
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
 	"evl-book-server/auth"
 	"evl-book-server/config"
 	"evl-book-server/db"
+	"evl-book-server/passhash"
 	"fmt"
-	"log"
 	"net/http"
-	"strings"
+	"net/mail"
 )
 
 // AddUserHandler lets users sign up using
@@ -23,6 +21,12 @@ func AddUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !validEmail(user.Email) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("invalid email"))
+		return
+	}
+
 	ok, err := ValidateUsername(r, user.Username)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -37,17 +41,29 @@ func AddUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	// beyond this block, the user's credentials are acceptable.
 	// process and save them in db
+	user.Password, err = passhash.Hash(user.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	user.TwoFactor = nil
 	user.UserData = config.UserData{
 		IsAdmin:       false,
+		Role:          config.RolePatron,
 		ProfilePicURL: "",
 	}
-	userBytes, err := json.Marshal(user)
+	err = db.Users().Create(user)
 	if err != nil {
+		if err == db.ErrUserExists {
+			// taken since it was validated
+			w.Header().Set(ValidUserName, FalseString)
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("invalid username"))
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
-	_ = db.SetJsonValues(UserPrefix+user.Username, userBytes)
 	_, _ = w.Write([]byte("signed up successfully"))
 }
 
@@ -58,16 +74,10 @@ func getJsonCredentials(r *http.Request) config.UserCredentials {
 		// If there is something wrong with the request body, return a  nil structure
 		return config.UserCredentials{}
 	}
-	cred.Password = GetMD5Hash(cred.Password)
 
 	return cred
 }
 
-func GetMD5Hash(text string) string {
-	hash := md5.Sum([]byte(text))
-	return hex.EncodeToString(hash[:])
-}
-
 //  ValidateUsername validates any input against a set of predefined
 // conditions to validate username, using an existing api endpoint
 func ValidateUsername(r *http.Request, username string) (bool, error) {
@@ -81,19 +91,17 @@ func ValidateUsername(r *http.Request, username string) (bool, error) {
 	return false, nil
 }
 
-// UpdateInfoHandler updates Name or Password, but not username or userinfo{}
+// UpdateInfoHandler updates Name, Email or Password, but not username or userinfo{}
 func UpdateInfoHandler(w http.ResponseWriter, r *http.Request) {
 	// assuming that we will receive json as signup form
-	username := r.Header.Get(auth.UsernameKey)
+	username := auth.PrincipalOf(r).Username
 	user := getJsonCredentials(r)
 	if user.Username != "" && user.Username != username {
 		_, _ = w.Write([]byte("changing username is not allowed"))
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
-	userKey := strings.ToLower(UserPrefix + username)
-
-	savedUser, err := getUserByKey(userKey)
+	savedUser, err := db.Users().Get(username)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -102,39 +110,70 @@ func UpdateInfoHandler(w http.ResponseWriter, r *http.Request) {
 	if user.Name == "" {
 		user.Name = savedUser.Name
 	}
-	if user.Password == GetMD5Hash("") {
-		user.Password = savedUser.Password
+	if user.Email == "" {
+		user.Email = savedUser.Email
+	}
+	if !validEmail(user.Email) {
+		http.Error(w, "invalid email", http.StatusBadRequest)
+		return
+	}
+	// users created at their first OIDC login have no password to compare with
+	passwordChanged := user.Password != "" && savedUser.Password == ""
+	if user.Password != "" && !passwordChanged {
+		samePassword, err := passhash.Verify(savedUser.Password, user.Password)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		passwordChanged = !samePassword
 	}
 
-	if savedUser.Name == user.Name && savedUser.Password == user.Password {
+	if savedUser.Name == user.Name && savedUser.Email == user.Email && !passwordChanged {
 		_, _ = w.Write([]byte("no changes were made"))
 		return
 	}
 
-	savedUser.Name = user.Name
-	savedUser.Password = user.Password
-
-	// save this update in db
-	userBytes, err := json.Marshal(savedUser)
+	newHash := ""
+	if passwordChanged {
+		newHash, err = passhash.Hash(user.Password)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// only the profile is written, so loans or a role
+	// given to the user in the meantime are kept
+	_, err = db.Users().Update(username, func(savedUser *config.UserCredentials) error {
+		savedUser.Name = user.Name
+		savedUser.Email = user.Email
+		if passwordChanged {
+			savedUser.Password = newHash
+		}
+		return nil
+	})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	_ = db.SetJsonValues(userKey, userBytes)
+	// whoever got hold of the old password must not stay logged in
+	if passwordChanged {
+		if err := db.Tokens().RevokeAll(username); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("profile updated, login again with your new password"))
+		return
+	}
 	_, _ = w.Write([]byte("profile updated"))
 }
 
-func getUserByKey(userKey string) (config.UserCredentials, error) {
-	userBytes, err := db.GetByteValues(strings.ToLower(userKey))
-	if err != nil {
-		log.Println("could not find user by key")
-		return config.UserCredentials{}, err
-	}
-	user := config.UserCredentials{}
-	if err := json.Unmarshal(userBytes, &user); err != nil {
-		log.Println("could not find user by key")
-		return config.UserCredentials{}, err
+// validEmail tells if email is empty, it being optional, or a plain address
+func validEmail(email string) bool {
+	if email == "" {
+		return true
 	}
-	return user, nil
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
 }
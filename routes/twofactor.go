@@ -0,0 +1,279 @@
+package routes
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"evl-book-server/auth"
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"evl-book-server/totp"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TwoFactorCodeHeader carries the TOTP code, or a recovery
+// code, of a login to an account with two-factor login
+const TwoFactorCodeHeader = "X-TOTP-Code"
+
+const recoveryCodeCount = 10
+
+var (
+	errTwoFactorEnrolled    = errors.New("two-factor login is already on")
+	errTwoFactorNotEnrolled = errors.New("two-factor login is not set up, enrol first")
+	errTwoFactorRequired    = errors.New("your role has to use two-factor login")
+	errWrongCode            = errors.New("code is not valid")
+)
+
+// twoFactorEnrolment is what a user adds to their authenticator app
+type twoFactorEnrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// twoFactorCode is a TOTP code sent to confirm, change or turn off two-factor login
+type twoFactorCode struct {
+	Code string `json:"code"`
+}
+
+// recoveryCodes are shown once, each one works instead of a TOTP code once
+type recoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// EnrolTwoFactorHandler starts turning on two-factor login for this user.
+// It returns a new secret, which takes effect once it is confirmed
+func EnrolTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	user, err := db.Users().Update(auth.PrincipalOf(r).Username, func(user *config.UserCredentials) error {
+		if user.HasTwoFactor() {
+			return errTwoFactorEnrolled
+		}
+		user.TwoFactor = &config.TwoFactor{Secret: secret}
+		return nil
+	})
+	if err != nil {
+		twoFactorErrorResponse(err, w)
+		return
+	}
+
+	JsonResponse(twoFactorEnrolment{
+		Secret: secret,
+		URI:    totp.URI(config.Auth().TwoFactorIssuer, user.Username, secret),
+	}, w)
+}
+
+// ConfirmTwoFactorHandler turns on two-factor login for this user, given
+// a code of the enrolled secret. It returns the recovery codes
+func ConfirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	code, ok := decodeTwoFactorCode(w, r)
+	if !ok {
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	user, err := db.Users().Update(auth.PrincipalOf(r).Username, func(user *config.UserCredentials) error {
+		if user.TwoFactor == nil {
+			return errTwoFactorNotEnrolled
+		}
+		if user.HasTwoFactor() {
+			return errTwoFactorEnrolled
+		}
+		if err := useTOTPCode(user.TwoFactor, code); err != nil {
+			return err
+		}
+		user.TwoFactor.Confirmed = true
+		user.TwoFactor.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		twoFactorErrorResponse(err, w)
+		return
+	}
+
+	audit(config.AuditEntry{Kind: config.AuditTwoFactorEnabled, Username: user.Username, Actor: user.Username})
+	JsonResponse(recoveryCodes{RecoveryCodes: codes}, w)
+}
+
+// RegenerateRecoveryCodesHandler replaces the recovery codes of this user,
+// given a TOTP code. The old ones stop working
+func RegenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	code, ok := decodeTwoFactorCode(w, r)
+	if !ok {
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Users().Update(auth.PrincipalOf(r).Username, func(user *config.UserCredentials) error {
+		if !user.HasTwoFactor() {
+			return errTwoFactorNotEnrolled
+		}
+		if err := useTOTPCode(user.TwoFactor, code); err != nil {
+			return err
+		}
+		user.TwoFactor.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		twoFactorErrorResponse(err, w)
+		return
+	}
+	JsonResponse(recoveryCodes{RecoveryCodes: codes}, w)
+}
+
+// DisableTwoFactorHandler turns off two-factor login for this user,
+// given a TOTP code, unless their role has to use it
+func DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	code, ok := decodeTwoFactorCode(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := db.Users().Update(auth.PrincipalOf(r).Username, func(user *config.UserCredentials) error {
+		if !user.HasTwoFactor() {
+			return errTwoFactorNotEnrolled
+		}
+		if config.Auth().RequiresTwoFactor(user.Role()) {
+			return errTwoFactorRequired
+		}
+		if err := useTOTPCode(user.TwoFactor, code); err != nil {
+			return err
+		}
+		user.TwoFactor = nil
+		return nil
+	})
+	if err != nil {
+		twoFactorErrorResponse(err, w)
+		return
+	}
+
+	audit(config.AuditEntry{Kind: config.AuditTwoFactorDisabled, Username: user.Username, Actor: user.Username})
+	_, _ = w.Write([]byte("two-factor login turned off"))
+}
+
+// ResetTwoFactorHandler is used by the admin to turn off two-factor login
+// for a user who lost both their authenticator and their recovery codes
+func ResetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := updateOtherUser(r, func(user *config.UserCredentials) error {
+		user.TwoFactor = nil
+		return nil
+	})
+	if err != nil {
+		userErrorResponse(err, w)
+		return
+	}
+
+	audit(config.AuditEntry{
+		Kind:     config.AuditTwoFactorReset,
+		Username: user.Username,
+		Actor:    auth.PrincipalOf(r).Username,
+	})
+	JsonResponse(newUserView(user), w)
+}
+
+// verifySecondFactor checks the code of a login to the account of user,
+// a TOTP code or a recovery code, and uses it up
+func verifySecondFactor(user config.UserCredentials, code string) (bool, error) {
+	_, err := db.Users().Update(user.Username, func(user *config.UserCredentials) error {
+		if !user.HasTwoFactor() {
+			return nil
+		}
+		if err := useTOTPCode(user.TwoFactor, code); err != errWrongCode {
+			return err
+		}
+		return useRecoveryCode(user.TwoFactor, code)
+	})
+	if err == errWrongCode {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// useTOTPCode checks code against the secret of twoFactor,
+// and remembers its time step so that it can't be used again
+func useTOTPCode(twoFactor *config.TwoFactor, code string) error {
+	step, ok, err := totp.Validate(twoFactor.Secret, code, time.Now(), twoFactor.LastStep)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errWrongCode
+	}
+	twoFactor.LastStep = step
+	return nil
+}
+
+// useRecoveryCode crosses code off the recovery codes of twoFactor
+func useRecoveryCode(twoFactor *config.TwoFactor, code string) error {
+	hash := hashRecoveryCode(code)
+	for i, recoveryCode := range twoFactor.RecoveryCodes {
+		if recoveryCode == hash {
+			twoFactor.RecoveryCodes = append(twoFactor.RecoveryCodes[:i], twoFactor.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return errWrongCode
+}
+
+// newRecoveryCodes returns new recovery codes, formatted like
+// abcde-fghij, along with the hashes to save
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		secret := make([]byte, 7)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(secret))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes code, ignoring case, dashes and spaces.
+// Recovery codes are random enough not to need a password hash
+func hashRecoveryCode(code string) string {
+	normalized := strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func decodeTwoFactorCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	body := twoFactorCode{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Code == "" {
+		http.Error(w, "code is missing", http.StatusBadRequest)
+		return "", false
+	}
+	return body.Code, true
+}
+
+func twoFactorErrorResponse(err error, w http.ResponseWriter) {
+	switch err {
+	case db.ErrNotFound:
+		http.Error(w, "user doesn't exist", http.StatusNotFound)
+	case errTwoFactorEnrolled, errTwoFactorNotEnrolled:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errTwoFactorRequired, errWrongCode:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -1,8 +1,8 @@
 package routes
 
 import (
-	"encoding/json"
 	"evl-book-server/auth"
+	"evl-book-server/config"
 	"evl-book-server/db"
 	"fmt"
 	"io/ioutil"
@@ -14,34 +14,31 @@ import (
 // machine using /upload/finalize endpoint. This is more of
 // a helper endpoint, and won't work on a remote host.
 func ImageUploadHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("uploading image")
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		log.Println("token not received")
-	}
+	username := auth.PrincipalOf(r).Username
+	log.Println("uploading image of", username)
 
 	// Parse our multipart form, 10 << 20 specifies a maximum
 	// upload of 10 MB files.
-	r.ParseMultipartForm(10 << 20)
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "image is not a valid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 	// FormFile returns the first file for the given key
 	// it also returns the FileHeader so we can get the Filename,
 	// the Header and the size of the file
 	file, _, err := r.FormFile(FileID)
 	if err != nil {
-		fmt.Println("error Retrieving the File")
-		fmt.Println(err)
+		http.Error(w, "image is missing: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
 	// Create a temporary file within our server directory that follows
 	// a particular naming pattern
-
-	username := r.Header.Get(auth.UsernameKey)
 	tempFile, err := ioutil.TempFile("image-server", fmt.Sprintf("%s_*.png", username))
 	if err != nil {
-		fmt.Fprintf(w, "%s\n", err.Error())
-		fmt.Println(err)
+		log.Println("could not create the image file of", username, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	defer tempFile.Close()
@@ -50,34 +47,25 @@ func ImageUploadHandler(w http.ResponseWriter, r *http.Request) {
 	// byte array
 	fileBytes, err := ioutil.ReadAll(file)
 	if err != nil {
-		fmt.Println(err)
-		fmt.Fprintf(w, "%s\n", err.Error())
+		http.Error(w, "could not read the image: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 	// write this byte array to our temporary file
-	_, err = tempFile.Write(fileBytes)
-	if err != nil {
-		fmt.Println(err)
-		fmt.Fprintf(w, "%s\n", err.Error())
-		return
-	}
-	// save the link to users profile
-	userKey := UserPrefix + username
-	user, err := getUserByKey(userKey)
-	if err != nil {
+	if _, err := tempFile.Write(fileBytes); err != nil {
+		log.Println("could not write the image file of", username, err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%s\n", err.Error())
 		return
 	}
-
-	user.UserData.ProfilePicURL = tempFile.Name()
-	userBytes, err := json.Marshal(user)
+	// save the link to users profile
+	_, err = db.Users().Update(username, func(user *config.UserCredentials) error {
+		user.UserData.ProfilePicURL = tempFile.Name()
+		return nil
+	})
 	if err != nil {
+		log.Println("could not save the image of", username, err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = fmt.Fprintf(w, "%s\n", err.Error())
 		return
 	}
-	_ = db.SetJsonValues(userKey, userBytes)
 
-	fmt.Fprintf(w, "successfully Uploaded image\n")
+	_, _ = fmt.Fprintf(w, "successfully Uploaded image\n")
 }
@@ -0,0 +1,265 @@
+package routes
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"evl-book-server/auth"
+	"evl-book-server/config"
+	"evl-book-server/db"
+	"evl-book-server/passhash"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errOwnAccount = errors.New("you can't do this to your own account")
+
+// userView is a user account as shown to admin, without the password hash
+type userView struct {
+	Username      string `json:"username"`
+	Name          string `json:"name"`
+	Email         string `json:"email,omitempty"`
+	Role          string `json:"role"`
+	Disabled      bool   `json:"disabled"`
+	TwoFactor     bool   `json:"two_factor"`
+	ProfilePicURL string `json:"profile_pic_url,omitempty"`
+	LoanIDs       []int  `json:"loan_ids"`
+	// LockedUntil is set while failed logins lock the user out
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+func newUserView(user config.UserCredentials) userView {
+	loanIDs := user.LoanIDArray
+	if loanIDs == nil {
+		loanIDs = []int{}
+	}
+	return userView{
+		Username:      user.Username,
+		Name:          user.Name,
+		Email:         user.Email,
+		Role:          user.Role(),
+		Disabled:      user.UserData.Disabled,
+		TwoFactor:     user.HasTwoFactor(),
+		ProfilePicURL: user.UserData.ProfilePicURL,
+		LoanIDs:       loanIDs,
+	}
+}
+
+// passwordReset is the new password of a user. Admin can leave it
+// empty to get a random one, which is then returned once
+type passwordReset struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+}
+
+// GetUsersHandler returns to admin the user accounts sorted by username.
+// The q query parameter keeps those whose username, name or email contains it
+func GetUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := db.Users().All()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	query := strings.ToLower(r.URL.Query().Get("q"))
+	views := []userView{}
+	for _, user := range users {
+		if query != "" && !strings.Contains(strings.ToLower(user.Username), query) &&
+			!strings.Contains(strings.ToLower(user.Name), query) && !strings.Contains(strings.ToLower(user.Email), query) {
+			continue
+		}
+		views = append(views, newUserView(user))
+	}
+	if len(views) == 0 {
+		_, _ = w.Write([]byte("no users found"))
+		return
+	}
+
+	sort.Slice(views, func(i, j int) bool { return views[i].Username < views[j].Username })
+	JsonResponse(views, w)
+}
+
+// GetUserHandler returns to admin a user account by username
+func GetUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := db.Users().Get(mux.Vars(r)["username"])
+	if err != nil {
+		userErrorResponse(err, w)
+		return
+	}
+	attempts, err := db.UserLoginAttempts().Get(user.Username, config.Lockout().FailureWindow)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	view := newUserView(user)
+	if attempts.IsLocked(config.Lockout().Now()) {
+		view.LockedUntil = attempts.LockedUntil
+	}
+	JsonResponse(view, w)
+}
+
+// DisableUserHandler is used by the admin to lock a user out.
+// Every token of the user is revoked
+func DisableUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := updateOtherUser(r, func(user *config.UserCredentials) error {
+		user.UserData.Disabled = true
+		return nil
+	})
+	if err == nil {
+		err = db.Tokens().RevokeAll(user.Username)
+	}
+	if err != nil {
+		userErrorResponse(err, w)
+		return
+	}
+	JsonResponse(newUserView(user), w)
+}
+
+// EnableUserHandler is used by the admin to let a disabled user login again
+func EnableUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := updateOtherUser(r, func(user *config.UserCredentials) error {
+		user.UserData.Disabled = false
+		return nil
+	})
+	if err != nil {
+		userErrorResponse(err, w)
+		return
+	}
+	JsonResponse(newUserView(user), w)
+}
+
+// UnlockUserHandler is used by the admin to lift the lockout of a user
+// who failed to login too many times, and forget their failed logins
+func UnlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := db.Users().Get(mux.Vars(r)["username"])
+	if err != nil {
+		userErrorResponse(err, w)
+		return
+	}
+	if err := db.UserLoginAttempts().Clear(user.Username); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	audit(config.AuditEntry{
+		Kind:     config.AuditAccountUnlocked,
+		Username: user.Username,
+		Actor:    auth.PrincipalOf(r).Username,
+	})
+	JsonResponse(newUserView(user), w)
+}
+
+// ResetPasswordHandler is used by the admin to set a new password for
+// a user who forgot theirs. Every token of the user is revoked
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	reset := passwordReset{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&reset); err != nil {
+			http.Error(w, "invalid password reset", http.StatusBadRequest)
+			return
+		}
+	}
+	generated := reset.Password == ""
+	if generated {
+		var err error
+		if reset.Password, err = randomPassword(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	hash, err := passhash.Hash(reset.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	user, err := updateOtherUser(r, func(user *config.UserCredentials) error {
+		user.Password = hash
+		return nil
+	})
+	if err == nil {
+		err = db.Tokens().RevokeAll(user.Username)
+	}
+	if err != nil {
+		userErrorResponse(err, w)
+		return
+	}
+
+	reset.Username = user.Username
+	if !generated {
+		// admin already knows it
+		reset.Password = ""
+	}
+	JsonResponse(reset, w)
+}
+
+// PromoteUserHandler is used by the admin to make a user admin
+func PromoteUserHandler(w http.ResponseWriter, r *http.Request) {
+	setRole(mux.Vars(r)["username"], config.RoleAdmin, w, r)
+}
+
+// DeleteUserHandler is used by the admin to remove a user account that has
+// no open loans. Its holds are dropped, its loan history and fines are kept
+func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	if strings.EqualFold(username, auth.PrincipalOf(r).Username) {
+		userErrorResponse(errOwnAccount, w)
+		return
+	}
+	if err := db.Users().Delete(username); err != nil {
+		userErrorResponse(err, w)
+		return
+	}
+
+	if err := db.Tokens().RevokeAll(username); err != nil {
+		log.Println("could not revoke the tokens of", username, err.Error())
+	}
+	bookIDs, err := db.Holds().BooksHeldBy(username)
+	if err != nil {
+		log.Println("could not drop the holds of", username, err.Error())
+	}
+	for _, bookID := range bookIDs {
+		if err := db.Holds().Cancel(bookID, username); err != nil && err != db.ErrHoldNotFound {
+			log.Println("could not drop the hold of", username, "on book", bookID, err.Error())
+		}
+	}
+	_, _ = w.Write([]byte("user deleted successfully"))
+}
+
+// updateOtherUser applies change to the user in the path, who has to
+// be someone else than the user making the request
+func updateOtherUser(r *http.Request, change func(user *config.UserCredentials) error) (config.UserCredentials, error) {
+	return db.Users().Update(mux.Vars(r)["username"], func(user *config.UserCredentials) error {
+		if strings.EqualFold(user.Username, auth.PrincipalOf(r).Username) {
+			return errOwnAccount
+		}
+		return change(user)
+	})
+}
+
+func userErrorResponse(err error, w http.ResponseWriter) {
+	switch err {
+	case db.ErrNotFound:
+		http.Error(w, "user doesn't exist", http.StatusNotFound)
+	case errOwnAccount:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case db.ErrUserHasLoans:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func randomPassword() (string, error) {
+	secret := make([]byte, 12)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
@@ -28,7 +28,6 @@ var (
 func ValidateUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := strings.TrimSpace(strings.ToLower(vars[auth.UsernameKey]))
-	userKey := UserPrefix + username
 	//validate user credentials
 	for _, word := range ReservedWords {
 		if username == word {
@@ -46,18 +45,18 @@ func ValidateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.GetSingleValue(userKey)
+	ok, err := db.Users().Exists(username)
 	if err != nil {
-		if err.Error() == db.RedisNilErr {
-			w.Header().Set(ValidUserName, TrueString)
-			_, _ = w.Write([]byte(TrueString))
-			return
-		}
 		w.Header().Set(ValidUserName, FalseString)
 		w.Header().Set(ErrorLogKey, "db err "+err.Error())
 		_, _ = w.Write([]byte(FalseString))
 		return
 	}
+	if !ok {
+		w.Header().Set(ValidUserName, TrueString)
+		_, _ = w.Write([]byte(TrueString))
+		return
+	}
 
 	w.Header().Set(ValidUserName, FalseString)
 	_, _ = w.Write([]byte(FalseString))
@@ -0,0 +1,88 @@
+// Package search splits text into terms for the full-text index,
+// and ranks the records that match a query
+package search
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Tokenize splits text into lower case words of letters and digits
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Terms adds the words of text to terms, each with weight.
+// A word that appears more than once counts every time
+func Terms(terms map[string]int, text string, weight int) map[string]int {
+	if terms == nil {
+		terms = map[string]int{}
+	}
+	for _, word := range Tokenize(text) {
+		terms[word] += weight
+	}
+	return terms
+}
+
+// Postings are the weights of the records a term is indexed for, by record key
+type Postings map[string]int
+
+// Hit is a record that matches a query, and how well it does
+type Hit struct {
+	Key   string
+	Score float64
+}
+
+// Rank returns the records that match every word of query, the best first.
+// Each word matches the terms it is a prefix of, lookup returns their postings.
+// A record scores the weight of its best term for each word, scaled down by
+// how much longer than the word the term is, so that whole words rank first
+func Rank(query string, lookup func(prefix string) (map[string]Postings, error)) ([]Hit, error) {
+	words := Tokenize(query)
+	if len(words) == 0 {
+		return []Hit{}, nil
+	}
+
+	var scores map[string]float64
+	for _, word := range words {
+		terms, err := lookup(word)
+		if err != nil {
+			return nil, err
+		}
+		best := map[string]float64{}
+		for term, postings := range terms {
+			closeness := float64(len(word)) / float64(len(term))
+			for key, weight := range postings {
+				if score := float64(weight) * closeness; score > best[key] {
+					best[key] = score
+				}
+			}
+		}
+		if scores == nil {
+			scores = best
+			continue
+		}
+		for key, score := range scores {
+			if wordScore, ok := best[key]; ok {
+				scores[key] = score + wordScore
+			} else {
+				delete(scores, key)
+			}
+		}
+	}
+
+	hits := []Hit{}
+	for key, score := range scores {
+		hits = append(hits, Hit{Key: key, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Key < hits[j].Key
+	})
+	return hits, nil
+}
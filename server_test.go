@@ -2,38 +2,99 @@ package main
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
+	"evl-book-server/auth"
+	"evl-book-server/cmd"
 	"evl-book-server/config"
 	"evl-book-server/db"
+	"evl-book-server/notify"
+	"evl-book-server/oidc"
 	"evl-book-server/routes"
+	"evl-book-server/totp"
 	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const (
 	username          = "test"
 	password          = "test"
+	otherUsername     = "reader"
 	admin             = "admin"
-	bookID            = 1
 	bookName          = "A Book"
-	authorID          = 1
 	authorName        = "An Author"
-	loanOne           = 1
-	loanTwo           = 2
 	numberOfIteration = 1000
+	contestedCopies   = 3
+	contestedRequests = 10
+	overdueLoanID     = 900000
+	finedLoanID       = 900001
 )
 
 var (
+	// baseURL is where TestMain serves the server
+	baseURL    = ""
 	token      = ""
+	otherToken = ""
 	adminToken = ""
+	// IDs are assigned by the server as the records get created
+	bookID        = 0
+	authorID      = 0
+	loanOne       = 0
+	loanTwo       = 0
+	stressBookIDs []int
 	//interval   = time.Millisecond
 )
 
+// TestMain serves the server from the test process, on a free port.
+// The tests use the memory backend, so that they need neither redis nor
+// a running server, unless TEST_BACKEND selects another one
+func TestMain(m *testing.M) {
+	backend := os.Getenv("TEST_BACKEND")
+	if backend == "" {
+		backend = config.MemoryBackend
+	}
+	viper.Set("storage.backend", backend)
+	config.LoadStorage()
+	// a back-off no slow password check outlasts, the lockout
+	// tests skip it with config.SkipLockoutTime instead of waiting
+	viper.Set("lockout.backoff_seconds", 60)
+	viper.Set("lockout.max_backoff_seconds", 600)
+	config.LoadLockout()
+
+	db.InitStore()
+	if !db.IsStoreUp() {
+		log.Fatalln("the", backend, "storage backend is down")
+	}
+	notify.Init()
+	db.AddDefaultAdmin()
+	if err := auth.LoadKeys(); err != nil {
+		log.Fatalln("failed to load the signing keys:", err)
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		log.Fatalln("failed to listen for the tests:", err)
+	}
+	baseURL = "http://" + listener.Addr().String()
+	go func() { _ = http.Serve(listener, cmd.NewRouter()) }()
+	os.Exit(m.Run())
+}
+
 func TestUserSignUP(t *testing.T) {
 	user := config.UserCredentials{
 		Username:    username,
@@ -44,7 +105,7 @@ func TestUserSignUP(t *testing.T) {
 	}
 	buf := new(bytes.Buffer)
 	_ = json.NewEncoder(buf).Encode(user)
-	req, err := http.NewRequest(http.MethodPost, "http://localhost:3000/api/signup", buf)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/signup", buf)
 	if err != nil {
 		t.Error(err.Error())
 		return
@@ -53,32 +114,772 @@ func TestUserSignUP(t *testing.T) {
 }
 
 func TestAdminLogin(t *testing.T) {
-	req, err := http.NewRequest(http.MethodPost, "http://localhost:3000/api/login", nil)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/login", nil)
 	if err != nil {
 		t.Error(err.Error())
 		return
 	}
 	req.Header.Set("Authorization", "Base "+base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", admin, admin))))
-	adminToken = getSingleOKResponse(t, req)
+	adminToken = getTokens(t, req).AccessToken
 }
 
 func TestUserLogin(t *testing.T) {
-	req, err := http.NewRequest(http.MethodPost, "http://localhost:3000/api/login", nil)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/login", nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Base "+base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password))))
+	token = getTokens(t, req).AccessToken
+	otherToken = signUpAndLogin(t, otherUsername)
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/login", nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Base "+base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password))))
+	tokens := getTokens(t, req)
+
+	refresh := func(refreshToken string) *http.Request {
+		body := fmt.Sprintf(`{"refresh_token": %q}`, refreshToken)
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/token/refresh", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return req
+	}
+	refreshed := getTokens(t, refresh(tokens.RefreshToken))
+
+	// a refresh token works once, and can't be used as an access token
+	getMultiPleResponse(t, []*http.Request{
+		refresh(tokens.RefreshToken),
+		refresh(refreshed.AccessToken),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans", refreshed.RefreshToken),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans", tokens.AccessToken),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans", refreshed.AccessToken),
+	}, []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusOK, http.StatusOK})
+
+	body := fmt.Sprintf(`{"refresh_token": %q}`, refreshed.RefreshToken)
+	req, err = http.NewRequest(http.MethodPost, baseURL+"/api/logout", strings.NewReader(body))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+refreshed.AccessToken)
+	getSingleOKResponse(t, req)
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans", refreshed.AccessToken),
+		refresh(refreshed.RefreshToken),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans", tokens.AccessToken),
+	}, []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusOK})
+}
+
+func TestRefreshConcurrently(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/login", nil)
 	if err != nil {
 		t.Error(err.Error())
 		return
 	}
 	req.Header.Set("Authorization", "Base "+base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password))))
-	token = getSingleOKResponse(t, req)
+	tokens := getTokens(t, req)
+
+	// the same refresh token is sent many times at once, only one gets new tokens
+	var refreshed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"refresh_token": %q}`, tokens.RefreshToken)
+			res, err := http.Post(baseURL+"/api/token/refresh", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			_ = res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				atomic.AddInt32(&refreshed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if refreshed != 1 {
+		t.Error("expected 1 refresh, got", refreshed)
+	}
+}
+
+func TestPasswordChangeRevokesTokens(t *testing.T) {
+	const name = "forgetful"
+	oldToken := signUpAndLogin(t, name)
+	changePassword := func(token, newPassword string) *http.Request {
+		body := fmt.Sprintf(`{"password": %q}`, newPassword)
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/update-profile", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	getSingleOKResponse(t, changePassword(oldToken, "changed"))
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans", oldToken),
+	}, []int{http.StatusUnauthorized})
+
+	// change it back, so that the user can login the same way next time
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/login", nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Base "+base64.StdEncoding.EncodeToString([]byte(name+":changed")))
+	getSingleOKResponse(t, changePassword(getTokens(t, req).AccessToken, name))
+}
+
+func TestForgotPassword(t *testing.T) {
+	const name, email = "absentminded", "absentminded@example.com"
+	oldToken := signUpAndLogin(t, name)
+	req := newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/update-profile", oldToken)
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"email": "` + email + `"}`))
+	getSingleOKResponse(t, req)
+
+	forgot := func(username string) *http.Request {
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/password/forgot",
+			strings.NewReader(`{"username": "`+username+`"}`))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return req
+	}
+	reset := func(token, password string) *http.Request {
+		body := fmt.Sprintf(`{"token": %q, "password": %q}`, token, password)
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/password/reset", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return req
+	}
+	// the file notifier appends the messages to the outbox,
+	// the token is the last line of the last one sent to email
+	lastResetToken := func() string {
+		outbox, err := ioutil.ReadFile(config.Notify().File)
+		if os.IsNotExist(err) {
+			return ""
+		} else if err != nil {
+			t.Fatal(err.Error())
+		}
+		messages := strings.Split(string(outbox), "To: "+email+"\r\n")
+		lines := strings.Split(strings.TrimSpace(messages[len(messages)-1]), "\r\n")
+		return lines[len(lines)-1]
+	}
+	// the message is sent after the answer, wait for a token other than previous
+	nextResetToken := func(previous string) string {
+		for i := 0; i < 100; i++ {
+			if token := lastResetToken(); token != previous {
+				return token
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("no password reset token was sent to", email)
+		return ""
+	}
+
+	// the answer doesn't tell who exists
+	nobody := fmt.Sprintf("nobody-%d", time.Now().UnixNano())
+	previous := lastResetToken()
+	if getSingleOKResponse(t, forgot(name)) != getSingleOKResponse(t, forgot(nobody)) {
+		t.Error("expected the same answer for users who exist and who don't")
+	}
+	resetToken := nextResetToken(previous)
+	getMultiPleResponse(t, []*http.Request{
+		reset(oldToken, "reset"),
+		reset(resetToken, "reset"),
+		reset(resetToken, "again"),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans", oldToken),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans", resetToken),
+		newLoginRequest(t, name, name),
+	}, []int{http.StatusUnauthorized, http.StatusOK, http.StatusUnauthorized, http.StatusUnauthorized,
+		http.StatusUnauthorized, http.StatusUnauthorized})
+	getTokens(t, newLoginRequest(t, name, "reset"))
+
+	// reset it back, so that the user can login the same way next time
+	getSingleOKResponse(t, forgot(name))
+	getSingleOKResponse(t, reset(nextResetToken(resetToken), name))
+	getTokens(t, newLoginRequest(t, name, name))
+
+	// nobody can flood the inbox of a user
+	for i := 1; i < config.Lockout().MaxUserResets; i++ {
+		getSingleOKResponse(t, forgot(nobody))
+	}
+	getMultiPleResponse(t, []*http.Request{forgot(nobody)}, []int{http.StatusTooManyRequests})
+}
+
+func TestJWKS(t *testing.T) {
+	if len(config.Auth().Keys) == 0 {
+		t.Skip("no signing keys are configured")
+	}
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/.well-known/jwks.json", nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	var jwks struct {
+		Keys []auth.JWK `json:"keys"`
+	}
+	getJSONResponse(t, req, &jwks)
+
+	// the token must verify with the published key of its kid alone
+	_, err = jwt.Parse(adminToken, func(token *jwt.Token) (interface{}, error) {
+		for _, key := range jwks.Keys {
+			if key.KeyID != token.Header["kid"] || key.Algorithm != token.Method.Alg() {
+				continue
+			}
+			switch key.KeyType {
+			case "OKP":
+				x, err := base64.RawURLEncoding.DecodeString(key.X)
+				return ed25519.PublicKey(x), err
+			case "RSA":
+				n, err := base64.RawURLEncoding.DecodeString(key.N)
+				if err != nil {
+					return nil, err
+				}
+				e, err := base64.RawURLEncoding.DecodeString(key.E)
+				return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, err
+			}
+		}
+		return nil, fmt.Errorf("kid %v is not published", token.Header["kid"])
+	})
+	if err != nil {
+		t.Error("token doesn't verify with the published keys:", err.Error())
+	}
+
+	// once keys are set up, the shared secret can't sign tokens anymore
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		auth.UsernameKey:   admin,
+		auth.AdminKey:      true,
+		auth.TokenTypeKey:  auth.AccessToken,
+		auth.TokenIDKey:    "forged",
+		auth.ExpirationKey: time.Now().Add(time.Minute).Unix(),
+	}).SignedString([]byte(config.App().Key))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans", forged),
+	}, []int{http.StatusUnauthorized})
+}
+
+func TestRoles(t *testing.T) {
+	assignRole := func(token, name, role string) *http.Request {
+		body := fmt.Sprintf(`{"role": %q}`, role)
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/admin/users/"+name+"/role", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	librarianToken := signUpAndLogin(t, "librarian")
+	cataloguerToken := signUpAndLogin(t, "cataloguer")
+	getMultiPleResponse(t, []*http.Request{
+		assignRole(adminToken, "librarian", config.RoleLibrarian),
+		assignRole(adminToken, "cataloguer", config.RoleCataloguer),
+		assignRole(adminToken, "cataloguer", "janitor"),
+		assignRole(adminToken, admin, config.RolePatron),
+		assignRole(adminToken, "nobody", config.RolePatron),
+		assignRole(token, username, config.RoleAdmin),
+		assignRole(librarianToken, username, config.RoleLibrarian),
+	}, []int{http.StatusOK, http.StatusOK, http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound,
+		http.StatusUnauthorized, http.StatusUnauthorized})
+
+	// the new roles apply to the tokens the users already have
+	bookBytes, err := json.Marshal(&config.Book{BookName: bookName})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	createBook := func(token string) *http.Request {
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/admin/book/create", bytes.NewBuffer(bookBytes))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans/pending", librarianToken),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans/pending", cataloguerToken),
+		createBook(librarianToken),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/books", librarianToken),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/roles", librarianToken),
+	}, []int{http.StatusOK, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusOK, http.StatusUnauthorized})
+
+	book := config.Book{}
+	getJSONResponse(t, createBook(cataloguerToken), &book)
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", book.ID), cataloguerToken))
+
+	var roles map[string][]string
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/roles", adminToken), &roles)
+	if len(roles) != 5 || len(roles[config.RoleAdmin]) <= len(roles[config.RolePatron]) {
+		t.Error("unexpected permission map", roles)
+	}
+}
+
+func TestUserManagement(t *testing.T) {
+	const name = "managed"
+	userToken := signUpAndLogin(t, name)
+	userURL := baseURL + "/api/admin/users/" + name
+	login := func(password string) *http.Request {
+		return newLoginRequest(t, name, password)
+	}
+
+	var users []map[string]interface{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/users?q=MANAGED", adminToken), &users)
+	if len(users) != 1 || users[0]["username"] != name || users[0]["password"] != nil {
+		t.Error("expected to find the user, without its password, got", users)
+	}
+
+	// a disabled user is turned away until enabled again
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, userURL+"/disable", adminToken))
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans", userToken),
+		login(name),
+		newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/admin/users/"+admin+"/disable", adminToken),
+		newAuthorizedRequest(t, http.MethodPost, userURL+"/disable", token),
+	}, []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusForbidden, http.StatusUnauthorized})
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, userURL+"/enable", adminToken))
+
+	reset := struct {
+		Password string `json:"password"`
+	}{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodPost, userURL+"/reset-password", adminToken), &reset)
+	userToken = getTokens(t, login(reset.Password)).AccessToken
+	req, err := http.NewRequest(http.MethodPost, userURL+"/reset-password", strings.NewReader(`{"password": "managed"}`))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	getSingleOKResponse(t, req)
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans", userToken),
+		login(reset.Password),
+	}, []int{http.StatusUnauthorized, http.StatusUnauthorized})
+	userToken = getTokens(t, login(name)).AccessToken
+
+	view := map[string]interface{}{}
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, userURL+"/promote", adminToken))
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, userURL, adminToken), &view)
+	if view["role"] != config.RoleAdmin {
+		t.Error("expected the user to be promoted, got", view)
+	}
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/users/"+otherUsername, userToken))
+	body := fmt.Sprintf(`{"role": %q}`, config.RolePatron)
+	req, err = http.NewRequest(http.MethodPost, userURL+"/role", strings.NewReader(body))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	getSingleOKResponse(t, req)
+
+	// users with open loans can't be deleted
+	bookBytes, err := json.Marshal(&config.Book{BookName: bookName})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req, err = http.NewRequest(http.MethodPost, baseURL+"/api/admin/book/create", bytes.NewBuffer(bookBytes))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	book := config.Book{}
+	getJSONResponse(t, req, &book)
+	loan := config.Loan{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/loan/request/"+strconv.Itoa(book.ID), userToken), &loan)
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodPost, userURL+"/delete", adminToken),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loan/cancel/"+strconv.Itoa(loan.ID), userToken),
+		newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", book.ID), adminToken),
+		newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/admin/users/"+admin+"/delete", adminToken),
+		newAuthorizedRequest(t, http.MethodPost, userURL+"/delete", adminToken),
+		newAuthorizedRequest(t, http.MethodGet, userURL, adminToken),
+		login(name),
+	}, []int{http.StatusConflict, http.StatusOK, http.StatusOK, http.StatusForbidden, http.StatusOK, http.StatusNotFound, http.StatusUnauthorized})
+}
+
+func TestLoginLockout(t *testing.T) {
+	const name = "guesser"
+	userToken := signUpAndLogin(t, name)
+	wrong := func() *http.Request { return newLoginRequest(t, name, "not-"+name) }
+
+	lockout := config.Lockout()
+
+	// after backoff_after failed logins, the next one has to wait
+	for i := 0; i < lockout.BackoffAfter; i++ {
+		getMultiPleResponse(t, []*http.Request{wrong()}, []int{http.StatusUnauthorized})
+	}
+	res, err := http.DefaultClient.Do(newLoginRequest(t, name, name))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = res.Body.Close()
+	wait, _ := strconv.Atoi(res.Header.Get("Retry-After"))
+	if res.StatusCode != http.StatusTooManyRequests || wait <= 0 || time.Duration(wait)*time.Second > lockout.Backoff {
+		t.Error("expected to wait up to", lockout.Backoff, "before the next login, got", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+
+	// the wait doubles after every further failed login, until the
+	// account is locked, even for the right password
+	backoff := lockout.Backoff
+	for i := lockout.BackoffAfter; i < lockout.MaxUserFailures; i++ {
+		getMultiPleResponse(t, []*http.Request{wrong()}, []int{http.StatusTooManyRequests})
+		config.SkipLockoutTime(backoff)
+		getMultiPleResponse(t, []*http.Request{wrong()}, []int{http.StatusUnauthorized})
+		backoff *= 2
+	}
+	config.SkipLockoutTime(lockout.MaxBackoff)
+	getMultiPleResponse(t, []*http.Request{
+		newLoginRequest(t, name, name),
+		newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/admin/users/"+name+"/unlock", userToken),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/audit", userToken),
+	}, []int{http.StatusTooManyRequests, http.StatusUnauthorized, http.StatusUnauthorized})
+
+	view := map[string]interface{}{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/users/"+name, adminToken), &view)
+	if view["locked_until"] == nil {
+		t.Error("expected the user to be locked, got", view)
+	}
+
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/admin/users/"+name+"/unlock", adminToken))
+	getTokens(t, newLoginRequest(t, name, name))
+
+	entries := []config.AuditEntry{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/audit?username="+name, adminToken), &entries)
+	if n := len(entries); n < 2 || entries[n-2].Kind != config.AuditAccountLocked ||
+		entries[n-1].Kind != config.AuditAccountUnlocked || entries[n-1].Actor != admin {
+		t.Error("expected the lockout and the unlock in the audit log, got", entries)
+	}
+}
+
+func TestLoginLockoutConcurrently(t *testing.T) {
+	const name = "burstguesser"
+	signUpAndLogin(t, name)
+
+	// guesses sent all at once are counted before their passwords are
+	// checked, so no more than backoff_after of them get checked
+	var checked, refused int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := http.DefaultClient.Do(newLoginRequest(t, name, fmt.Sprintf("guess-%d", i)))
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			_ = res.Body.Close()
+			switch res.StatusCode {
+			case http.StatusUnauthorized:
+				atomic.AddInt32(&checked, 1)
+			case http.StatusTooManyRequests:
+				atomic.AddInt32(&refused, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if checked > int32(config.Lockout().BackoffAfter) || checked+refused != 20 {
+		t.Error("expected at most", config.Lockout().BackoffAfter, "guesses checked and the rest refused, got", checked, "and", refused)
+	}
+	getMultiPleResponse(t, []*http.Request{newLoginRequest(t, name, name)}, []int{http.StatusTooManyRequests})
+
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/admin/users/"+name+"/unlock", adminToken))
+	getTokens(t, newLoginRequest(t, name, name))
+}
+
+func TestTwoFactor(t *testing.T) {
+	const name = "twofactor"
+	userToken := signUpAndLogin(t, name)
+	// codes of the previous, current and next time steps are accepted,
+	// so the test doesn't start right before the step changes
+	if untilNext := totp.Period - time.Duration(time.Now().UnixNano())%totp.Period; untilNext < 3*time.Second {
+		time.Sleep(untilNext)
+	}
+	withCode := func(password, code string) *http.Request {
+		req := newLoginRequest(t, name, password)
+		req.Header.Set(routes.TwoFactorCodeHeader, code)
+		return req
+	}
+	withBody := func(url, body string) *http.Request {
+		req := newAuthorizedRequest(t, http.MethodPost, url, userToken)
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		return req
+	}
+
+	enrolment := struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/2fa/enrol", userToken), &enrolment)
+	if !strings.HasPrefix(enrolment.URI, "otpauth://totp/") || !strings.Contains(enrolment.URI, "secret="+enrolment.Secret) {
+		t.Error("expected an otpauth URI of the secret, got", enrolment.URI)
+	}
+	step := totp.Step(time.Now())
+	code := func(step int64) string {
+		code, err := totp.Code(enrolment.Secret, step)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return code
+	}
+	codeBody := func(step int64) string {
+		return fmt.Sprintf(`{"code": %q}`, code(step))
+	}
+
+	// until confirmed, login doesn't ask for a code
+	getTokens(t, newLoginRequest(t, name, name))
+	getMultiPleResponse(t, []*http.Request{
+		withBody(baseURL+"/api/2fa/confirm", codeBody(step-10)),
+	}, []int{http.StatusForbidden})
+	codes := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{}
+	getJSONResponse(t, withBody(baseURL+"/api/2fa/confirm", codeBody(step-1)), &codes)
+	if len(codes.RecoveryCodes) != 10 {
+		t.Fatal("expected 10 recovery codes, got", codes.RecoveryCodes)
+	}
+
+	res, err := http.DefaultClient.Do(newLoginRequest(t, name, name))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized || res.Header.Get(routes.TwoFactorCodeHeader) != "required" {
+		t.Error("expected login to ask for a code, got", res.StatusCode)
+	}
+	// codes and recovery codes work once
+	getMultiPleResponse(t, []*http.Request{
+		withCode(name, code(step-1)),
+		withCode(name, codes.RecoveryCodes[0]),
+		withCode(name, codes.RecoveryCodes[0]),
+		withCode(name, code(step)),
+		withCode("not-"+name, code(step+1)),
+		withBody(baseURL+"/api/2fa/enrol", ""),
+		withBody(baseURL+"/api/2fa/disable", codeBody(step)),
+	}, []int{http.StatusUnauthorized, http.StatusOK, http.StatusUnauthorized, http.StatusOK, http.StatusUnauthorized,
+		http.StatusConflict, http.StatusForbidden})
+
+	// new recovery codes replace the old ones
+	getJSONResponse(t, withBody(baseURL+"/api/2fa/recovery-codes", codeBody(step+1)), &codes)
+	getMultiPleResponse(t, []*http.Request{withCode(name, strings.ToUpper(codes.RecoveryCodes[1]))}, []int{http.StatusOK})
+
+	// admin can turn two-factor login off for users who lost their codes
+	view := map[string]interface{}{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/users/"+name, adminToken), &view)
+	if view["two_factor"] != true {
+		t.Error("expected the user to have two-factor login, got", view)
+	}
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/admin/users/"+name+"/reset-2fa", adminToken))
+	getTokens(t, newLoginRequest(t, name, name))
+}
+
+func TestAPIKeys(t *testing.T) {
+	create := func(token, body string) *http.Request {
+		req := newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/admin/apikeys/create", token)
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		return req
+	}
+	withKey := func(method, url, apiKey string) *http.Request {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set(auth.APIKeyHeader, apiKey)
+		return req
+	}
+
+	created := struct {
+		config.APIKey
+		Key string `json:"api_key"`
+	}{}
+	getJSONResponse(t, create(adminToken, `{"name": "kiosk", "permissions": ["catalogue:read", "loans:read"], "expires_in_days": 30}`), &created)
+	if created.Key == "" || created.Hash != "" || created.CreatedBy != admin || created.ExpiresAt == nil {
+		t.Fatal("expected a new api key without its hash, got", created)
+	}
+	getMultiPleResponse(t, []*http.Request{
+		create(adminToken, `{"name": "kiosk", "permissions": ["loans:borrow"]}`),
+		create(adminToken, `{"name": "kiosk", "permissions": ["everything"]}`),
+		create(adminToken, `{"permissions": ["catalogue:read"]}`),
+		create(token, `{"name": "kiosk", "permissions": ["catalogue:read"]}`),
+	}, []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusUnauthorized})
+
+	// the key is allowed its permissions only
+	getMultiPleResponse(t, []*http.Request{
+		withKey(http.MethodGet, baseURL+"/api/books", created.Key),
+		withKey(http.MethodGet, baseURL+"/api/admin/loans", created.Key),
+		withKey(http.MethodPost, baseURL+"/api/admin/author/create", created.Key),
+		withKey(http.MethodGet, baseURL+"/api/loans", created.Key),
+		withKey(http.MethodGet, baseURL+"/api/books", created.Key+"x"),
+		withKey(http.MethodGet, baseURL+"/api/books", "evl_"+created.ID),
+	}, []int{http.StatusOK, http.StatusOK, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized,
+		http.StatusUnauthorized})
+
+	keys := []config.APIKey{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/apikeys", adminToken), &keys)
+	found := false
+	for _, key := range keys {
+		if key.ID == created.ID {
+			found = key.LastUsedAt != nil && key.Hash == ""
+		}
+	}
+	if !found {
+		t.Error("expected the key to be listed with its last use, got", keys)
+	}
+
+	// expired keys stop working
+	expired, err := db.APIKeys().Get(created.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expiredAt := time.Now().Add(-time.Minute)
+	expired.ExpiresAt = &expiredAt
+	if err := db.APIKeys().Save(expired); err != nil {
+		t.Fatal(err.Error())
+	}
+	getMultiPleResponse(t, []*http.Request{
+		withKey(http.MethodGet, baseURL+"/api/books", created.Key),
+		newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/admin/apikeys/"+created.ID+"/revoke", adminToken),
+		newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/admin/apikeys/"+created.ID+"/revoke", adminToken),
+	}, []int{http.StatusUnauthorized, http.StatusOK, http.StatusNotFound})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	oidcCfg := config.OIDC()
+	if !oidcCfg.Enabled {
+		t.Skip("oidc is not enabled in config.toml")
+	}
+	provider, err := oidc.NewMockProvider(oidcCfg.Issuer, oidcCfg.ClientID, oidcCfg.ClientSecret)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	issuer, err := url.Parse(oidcCfg.Issuer)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	listener, err := net.Listen("tcp", issuer.Host)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mockServer := &http.Server{Handler: provider}
+	go func() { _ = mockServer.Serve(listener) }()
+	defer func() { _ = mockServer.Close() }()
+
+	// redirects are followed by hand, to check where they go
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	redirect := func(url string) (string, []*http.Cookie) {
+		res, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusFound {
+			t.Fatal("expected a redirect from", url, "got", res.StatusCode)
+		}
+		return res.Header.Get("Location"), res.Cookies()
+	}
+	// login goes to the provider, which sends the user back to the callback
+	login := func(claims map[string]interface{}) *http.Request {
+		provider.SetClaims(claims)
+		authURL, cookies := redirect(baseURL + "/api/oidc/login")
+		if !strings.HasPrefix(authURL, oidcCfg.Issuer+"/authorize?") || len(cookies) != 1 {
+			t.Fatal("expected to be sent to the provider with a state cookie, got", authURL, cookies)
+		}
+		callbackURL, _ := redirect(authURL)
+		// redirect_url names the served server, the tests serve it at baseURL
+		callback, err := url.Parse(callbackURL)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		callback.Host = strings.TrimPrefix(baseURL, "http://")
+		req, err := http.NewRequest(http.MethodGet, callback.String(), nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.AddCookie(cookies[0])
+		return req
+	}
+
+	const name = "oidc-staff"
+	callback := login(map[string]interface{}{"preferred_username": name, "groups": []string{"Library-Staff"}})
+	staffToken := getTokens(t, callback).AccessToken
+	noCookie := login(map[string]interface{}{"preferred_username": name})
+	noCookie.Header.Del("Cookie")
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans", staffToken),
+		callback,
+		noCookie,
+		login(map[string]interface{}{"preferred_username": otherUsername}),
+		login(map[string]interface{}{"sub": "nameless"}),
+		newLoginRequest(t, name, ""),
+	}, []int{http.StatusOK, http.StatusBadRequest, http.StatusBadRequest, http.StatusConflict, http.StatusUnauthorized,
+		http.StatusBadRequest})
+
+	// the role follows the groups on every login
+	patronToken := getTokens(t, login(map[string]interface{}{"preferred_username": name, "email": name + "@example.com"})).AccessToken
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans", patronToken),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans", patronToken),
+	}, []int{http.StatusUnauthorized, http.StatusOK})
+	view := map[string]interface{}{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/users/"+name, adminToken), &view)
+	if view["role"] != config.RolePatron || view["email"] != name+"@example.com" {
+		t.Error("expected the user to follow the claims of the provider, got", view)
+	}
+}
+
+func TestSpoofedIdentityHeaders(t *testing.T) {
+	spoof := func(req *http.Request) *http.Request {
+		req.Header.Set(auth.UsernameKey, otherUsername)
+		req.Header.Set(auth.AdminKey, "true")
+		req.Header.Set(auth.RoleKey, config.RoleAdmin)
+		return req
+	}
+
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if body := getSingleOKResponse(t, spoof(req)); !strings.Contains(body, "User :  \n") || !strings.Contains(body, "Admin : false") {
+		t.Error("expected an anonymous visitor, got", body)
+	}
+	if body := getSingleOKResponse(t, spoof(newAuthorizedRequest(t, http.MethodGet, baseURL+"/", adminToken))); !strings.Contains(body, "User : "+admin) || !strings.Contains(body, "Admin : true") {
+		t.Error("expected the admin, got", body)
+	}
+
+	// handlers act for the user of the token, whatever the headers say
+	if body := getSingleOKResponse(t, spoof(newAuthorizedRequest(t, http.MethodGet, baseURL+"/", token))); !strings.Contains(body, "User : "+username) || !strings.Contains(body, "Admin : false") {
+		t.Error("expected", username, "got", body)
+	}
+	getMultiPleResponse(t, []*http.Request{
+		spoof(newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans", token)),
+		spoof(newAuthorizedRequest(t, http.MethodGet, baseURL+"/", "not-a-token")),
+	}, []int{http.StatusUnauthorized, http.StatusUnauthorized})
 }
 
 func TestCreateAuthor(t *testing.T) {
 	author := &config.Author{
-		ID:         bookID,
 		AuthorName: authorName,
 	}
 	authorBytes, err := json.Marshal(author)
-	url := "http://localhost:3000/api/admin/author/create"
+	url := baseURL + "/api/admin/author/create"
 
 	if err != nil {
 		t.Error(err.Error())
@@ -91,6 +892,9 @@ func TestCreateAuthor(t *testing.T) {
 		return
 	}
 	req1.Header.Set("Authorization", "Bearer "+adminToken)
+	createdAuthor := config.Author{}
+	getJSONResponse(t, req1, &createdAuthor)
+	authorID = createdAuthor.ID
 
 	req2, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(authorBytes))
 	if err != nil {
@@ -98,13 +902,13 @@ func TestCreateAuthor(t *testing.T) {
 		return
 	}
 	req2.Header.Set("Authorization", "Bearer "+token)
-	requests := []*http.Request{req1, req2}
-	statusOutArr := []int{http.StatusOK, http.StatusUnauthorized}
+	requests := []*http.Request{req2}
+	statusOutArr := []int{http.StatusUnauthorized}
 	getMultiPleResponse(t, requests, statusOutArr)
 }
 
 func TestGetAuthor(t *testing.T) {
-	url := "http://localhost:3000/api/author"
+	url := baseURL + "/api/author"
 	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%d", url, authorID), nil)
 	if err != nil {
 		t.Error(err.Error())
@@ -117,7 +921,7 @@ func TestGetAuthor(t *testing.T) {
 }
 
 func TestGetAllAuthors(t *testing.T) {
-	url := "http://localhost:3000/api/authors"
+	url := baseURL + "/api/authors"
 	req1, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		t.Error(err.Error())
@@ -134,7 +938,7 @@ func TestGetAllAuthors(t *testing.T) {
 
 	req2.Header.Set("Authorization", "Bearer "+token)
 
-	req3, err := http.NewRequest(http.MethodGet, "http://localhost:3000/api/author", nil)
+	req3, err := http.NewRequest(http.MethodGet, baseURL+"/api/author", nil)
 	if err != nil {
 		t.Error(err.Error())
 		return
@@ -147,7 +951,6 @@ func TestGetAllAuthors(t *testing.T) {
 
 func TestCreateBook(t *testing.T) {
 	book := &config.Book{
-		ID:       bookID,
 		BookName: bookName,
 		AuthorID: authorID,
 	}
@@ -158,7 +961,7 @@ func TestCreateBook(t *testing.T) {
 		return
 
 	}
-	url := "http://localhost:3000/api/admin/book/create"
+	url := baseURL + "/api/admin/book/create"
 
 	req1, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(bookBytes))
 	if err != nil {
@@ -166,6 +969,9 @@ func TestCreateBook(t *testing.T) {
 		return
 	}
 	req1.Header.Set("Authorization", "Bearer "+adminToken)
+	createdBook := config.Book{}
+	getJSONResponse(t, req1, &createdBook)
+	bookID = createdBook.ID
 
 	req2, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(bookBytes))
 	if err != nil {
@@ -173,37 +979,52 @@ func TestCreateBook(t *testing.T) {
 		return
 	}
 	req2.Header.Set("Authorization", "Bearer "+token)
-	requests := []*http.Request{req1, req2}
-	statusOutArr := []int{http.StatusOK, http.StatusUnauthorized}
+	requests := []*http.Request{req2}
+	statusOutArr := []int{http.StatusUnauthorized}
 	getMultiPleResponse(t, requests, statusOutArr)
 }
 
 func TestCreateLoan(t *testing.T) {
-	url := "http://localhost:3000/api/loan/request/"
+	url := baseURL + "/api/loan/request/"
 
-	req1, err := http.NewRequest(http.MethodPost, url+strconv.Itoa(loanOne), nil)
+	req1, err := http.NewRequest(http.MethodPost, url+strconv.Itoa(bookID), nil)
 	if err != nil {
 		t.Error(err.Error())
 		return
 	}
 	req1.Header.Set("Authorization", "Bearer "+token)
+	loan := config.Loan{}
+	getJSONResponse(t, req1, &loan)
+	loanOne = loan.ID
 
-	req2, err := http.NewRequest(http.MethodPost, url+strconv.Itoa(loanTwo), nil)
+	// a user can't request the same book twice, another user can
+	req2, err := http.NewRequest(http.MethodPost, url+strconv.Itoa(bookID), nil)
 	if err != nil {
 		t.Error(err.Error())
 		return
 	}
 	req2.Header.Set("Authorization", "Bearer "+token)
+	getMultiPleResponse(t, []*http.Request{req2}, []int{http.StatusConflict})
 
-	requests := []*http.Request{req1, req2}
-	statusOutArr := []int{http.StatusOK, http.StatusOK}
-	getMultiPleResponse(t, requests, statusOutArr)
+	req3, err := http.NewRequest(http.MethodPost, url+strconv.Itoa(bookID), nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req3.Header.Set("Authorization", "Bearer "+otherToken)
+	loan = config.Loan{}
+	getJSONResponse(t, req3, &loan)
+	loanTwo = loan.ID
+
+	if loanOne == 0 || loanOne == loanTwo {
+		t.Error("expected two distinct loan IDs, got", loanOne, loanTwo)
+	}
 }
 
 func TestGetAllAndUserSpecificPendingLoans(t *testing.T) {
-	allUrl := "http://localhost:3000/api/admin/loans"
-	pendingUrl := "http://localhost:3000/api/admin/loans/pending"
-	pendingUserUrl := "http://localhost:3000/api/loans/pending"
+	allUrl := baseURL + "/api/admin/loans"
+	pendingUrl := baseURL + "/api/admin/loans/pending"
+	pendingUserUrl := baseURL + "/api/loans/pending"
 	req1, err := http.NewRequest(http.MethodGet, allUrl, nil)
 	if err != nil {
 		t.Error(err.Error())
@@ -228,7 +1049,7 @@ func TestGetAllAndUserSpecificPendingLoans(t *testing.T) {
 
 	req2u.Header.Set("Authorization", "Bearer "+token)
 
-	url := "http://localhost:3000/api/admin/loans/approve/" + strconv.Itoa(loanOne)
+	url := baseURL + "/api/admin/loans/approve/" + strconv.Itoa(loanOne)
 	req3, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		t.Error(err.Error())
@@ -241,7 +1062,7 @@ func TestGetAllAndUserSpecificPendingLoans(t *testing.T) {
 }
 
 func TestAcceptLoan(t *testing.T) {
-	url := "http://localhost:3000/api/admin/loans/approve/" + strconv.Itoa(loanOne)
+	url := baseURL + "/api/admin/loans/approve/" + strconv.Itoa(loanOne)
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		t.Error(err.Error())
@@ -253,21 +1074,40 @@ func TestAcceptLoan(t *testing.T) {
 	getSingleOKResponse(t, req)
 }
 
-func TestRejectLoan(t *testing.T) {
-	url := "http://localhost:3000/api/admin/loans/decline/" + strconv.Itoa(loanTwo)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// dueLoanResponse is an active loan as listed to its user
+type dueLoanResponse struct {
+	config.Loan
+	DaysRemaining int  `json:"days_remaining"`
+	Overdue       bool `json:"overdue"`
+}
+
+func TestActiveLoanDaysRemaining(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/api/loans/active", nil)
 	if err != nil {
 		t.Error(err.Error())
 		return
 	}
+	req.Header.Set("Authorization", "Bearer "+token)
 
-	req.Header.Set("Authorization", "Bearer "+adminToken)
-
-	getSingleOKResponse(t, req)
+	var activeLoans []dueLoanResponse
+	getJSONResponse(t, req, &activeLoans)
+	for _, loan := range activeLoans {
+		if loan.ID != loanOne {
+			continue
+		}
+		if loan.DueAt == nil || loan.ApprovedAt == nil {
+			t.Error("approved loan has no due date")
+		}
+		if loan.DaysRemaining != config.Lending().LoanPeriodDays() || loan.Overdue {
+			t.Error("expected a loan due in", config.Lending().LoanPeriodDays(), "days, got", loan.DaysRemaining)
+		}
+		return
+	}
+	t.Error("approved loan is not active")
 }
 
-func TestReturnedLoan(t *testing.T) {
-	url := "http://localhost:3000/api/admin/loans/returned/" + strconv.Itoa(loanOne)
+func TestRejectLoan(t *testing.T) {
+	url := baseURL + "/api/admin/loans/decline/" + strconv.Itoa(loanTwo)
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		t.Error(err.Error())
@@ -279,9 +1119,9 @@ func TestReturnedLoan(t *testing.T) {
 	getSingleOKResponse(t, req)
 }
 
-func TestGetBook(t *testing.T) {
-	url := "http://localhost:3000/api/book"
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%d", url, bookID), nil)
+func TestReturnedLoan(t *testing.T) {
+	url := baseURL + "/api/admin/loans/returned/" + strconv.Itoa(loanOne)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		t.Error(err.Error())
 		return
@@ -292,50 +1132,1105 @@ func TestGetBook(t *testing.T) {
 	getSingleOKResponse(t, req)
 }
 
-func TestGetAllBooks(t *testing.T) {
-	req1, err := http.NewRequest(http.MethodGet, "http://localhost:3000/api/books", nil)
+func TestLoanHistory(t *testing.T) {
+	req1, err := http.NewRequest(http.MethodGet, baseURL+"/api/loans/history", nil)
 	if err != nil {
 		t.Error(err.Error())
 		return
 	}
+	req1.Header.Set("Authorization", "Bearer "+token)
+	var userHistory []config.Loan
+	getJSONResponse(t, req1, &userHistory)
 
-	req1.Header.Set("Authorization", "Bearer "+adminToken)
+	statuses := map[int]string{}
+	for _, loan := range userHistory {
+		statuses[loan.ID] = loan.Status
+	}
+	if statuses[loanOne] != config.LoanReturned {
+		t.Error("expected the returned loan in the history, got", statuses)
+	}
 
-	req2, err := http.NewRequest(http.MethodGet, "http://localhost:3000/api/books", nil)
+	url := fmt.Sprintf(baseURL+"/api/admin/book/%d/history", bookID)
+	req2, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		t.Error(err.Error())
 		return
 	}
+	req2.Header.Set("Authorization", "Bearer "+adminToken)
+	var bookHistory []config.Loan
+	getJSONResponse(t, req2, &bookHistory)
+	// loanOne was returned after loanTwo got declined, so it comes first
+	if len(bookHistory) != 2 || bookHistory[0].ID != loanOne || bookHistory[0].Username != username {
+		t.Error("expected the returned loan to be the latest in the book history, got", bookHistory)
+	} else if bookHistory[1].Status != config.LoanDeclined || bookHistory[1].Username != otherUsername {
+		t.Error("expected the declined loan of", otherUsername, "in the book history, got", bookHistory[1])
+	}
 
-	req2.Header.Set("Authorization", "Bearer "+token)
-
-	req3, err := http.NewRequest(http.MethodGet, "http://localhost:3000/api/book", nil)
+	req3, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		t.Error(err.Error())
 		return
-
 	}
 	req3.Header.Set("Authorization", "Bearer "+token)
-	requests := []*http.Request{req1, req2, req3}
-	statusOutArr := []int{http.StatusOK, http.StatusOK, http.StatusNotFound}
-	getMultiPleResponse(t, requests, statusOutArr)
+	getMultiPleResponse(t, []*http.Request{req3}, []int{http.StatusUnauthorized})
 }
 
-func TestDeleteBook(t *testing.T) {
-	url := fmt.Sprintf("http://localhost:3000/api/admin/book/delete/%d", bookID)
-	req1, err := http.NewRequest(http.MethodPost, url, nil)
+func TestApproveLoansConcurrently(t *testing.T) {
+	book := &config.Book{
+		BookName: bookName,
+		AddCount: contestedCopies,
+	}
+	bookBytes, err := json.Marshal(book)
 	if err != nil {
 		t.Error(err.Error())
 		return
 	}
-	req1.Header.Set("Authorization", "Bearer "+token)
-
-	req2, err := http.NewRequest(http.MethodPost, url, nil)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/admin/book/create", bytes.NewBuffer(bookBytes))
 	if err != nil {
 		t.Error(err.Error())
 		return
 	}
-	req2.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	contestedBook := config.Book{}
+	getJSONResponse(t, req, &contestedBook)
+
+	// every request comes from another user, as nobody can request a book twice
+	var loanIDs []int
+	for i := 0; i < contestedRequests; i++ {
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/loan/request/"+strconv.Itoa(contestedBook.ID), nil)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+signUpAndLogin(t, fmt.Sprintf("contender%d", i)))
+		loan := config.Loan{}
+		getJSONResponse(t, req, &loan)
+		loanIDs = append(loanIDs, loan.ID)
+	}
+
+	// every loan is approved twice at the same time, as if by two admins
+	var approved int32
+	var wg sync.WaitGroup
+	for _, loanID := range append(loanIDs, loanIDs...) {
+		wg.Add(1)
+		go func(loanID int) {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodGet, baseURL+"/api/admin/loans/approve/"+strconv.Itoa(loanID), nil)
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			_ = res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				atomic.AddInt32(&approved, 1)
+			}
+		}(loanID)
+	}
+	wg.Wait()
+
+	if approved != contestedCopies {
+		t.Error("expected", contestedCopies, "approvals, got", approved)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, fmt.Sprintf(baseURL+"/api/book/%d", contestedBook.ID), nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	savedBook := config.Book{}
+	getJSONResponse(t, req, &savedBook)
+	if savedBook.OnLoanCount != contestedCopies {
+		t.Error("expected", contestedCopies, "copies on loan, got", savedBook.OnLoanCount)
+	}
+
+	// clean up, returning the approved loans and declining the rest
+	for _, loanID := range loanIDs {
+		req, err := http.NewRequest(http.MethodGet, baseURL+"/api/admin/loans/returned/"+strconv.Itoa(loanID), nil)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		_ = res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			continue
+		}
+
+		req, err = http.NewRequest(http.MethodGet, baseURL+"/api/admin/loans/decline/"+strconv.Itoa(loanID), nil)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		getSingleOKResponse(t, req)
+	}
+
+	req, err = http.NewRequest(http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", contestedBook.ID), nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	getSingleOKResponse(t, req)
+}
+
+func TestHoldQueue(t *testing.T) {
+	bookBytes, err := json.Marshal(&config.Book{BookName: bookName})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/admin/book/create", bytes.NewBuffer(bookBytes))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	book := config.Book{}
+	getJSONResponse(t, req, &book)
+
+	// put the only copy on loan
+	req, err = http.NewRequest(http.MethodPost, baseURL+"/api/loan/request/"+strconv.Itoa(book.ID), nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	loan := config.Loan{}
+	getJSONResponse(t, req, &loan)
+
+	req, err = http.NewRequest(http.MethodGet, baseURL+"/api/admin/loans/approve/"+strconv.Itoa(loan.ID), nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	getSingleOKResponse(t, req)
+
+	holdURL := baseURL + "/api/hold/request/" + strconv.Itoa(book.ID)
+	cancelURL := baseURL + "/api/hold/cancel/" + strconv.Itoa(book.ID)
+	var requests []*http.Request
+	for _, url := range []string{holdURL, holdURL, cancelURL, cancelURL, holdURL} {
+		req, err := http.NewRequest(http.MethodPost, url, nil)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		requests = append(requests, req)
+	}
+	statusOutArr := []int{http.StatusOK, http.StatusBadRequest, http.StatusOK, http.StatusNotFound, http.StatusOK}
+	getMultiPleResponse(t, requests, statusOutArr)
+
+	req, err = http.NewRequest(http.MethodGet, baseURL+"/api/admin/holds/"+strconv.Itoa(book.ID), nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	var queue []config.Hold
+	getJSONResponse(t, req, &queue)
+	if len(queue) != 1 || queue[0].Username != username {
+		t.Error("expected the user to be alone in the queue, got", queue)
+	}
+
+	// the user finds their hold whatever the casing it was placed with
+	if err := db.Holds().Cancel(book.ID, username); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := db.Holds().Place(book.ID, strings.ToUpper(username)); err != nil {
+		t.Fatal(err.Error())
+	}
+	var held []struct {
+		BookID   int `json:"book_id"`
+		Position int `json:"position"`
+	}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/holds", token), &held)
+	found := false
+	for _, hold := range held {
+		found = found || hold.BookID == book.ID && hold.Position == 1
+	}
+	if !found {
+		t.Error("expected the hold placed as", strings.ToUpper(username), "among the holds, got", held)
+	}
+	if err := db.Holds().Cancel(book.ID, username); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := db.Holds().Place(book.ID, username); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// returning the copy turns the hold into a loan request
+	req, err = http.NewRequest(http.MethodGet, baseURL+"/api/admin/loans/returned/"+strconv.Itoa(loan.ID), nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	getSingleOKResponse(t, req)
+
+	req, err = http.NewRequest(http.MethodGet, baseURL+"/api/loans/pending", nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var pendingLoans []config.Loan
+	getJSONResponse(t, req, &pendingLoans)
+	promotedLoanID := 0
+	for _, pendingLoan := range pendingLoans {
+		if pendingLoan.BookID == book.ID {
+			promotedLoanID = pendingLoan.ID
+		}
+	}
+	if promotedLoanID == 0 {
+		t.Error("hold was not promoted to a loan request")
+	} else {
+		req, err = http.NewRequest(http.MethodGet, baseURL+"/api/admin/loans/decline/"+strconv.Itoa(promotedLoanID), nil)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		getSingleOKResponse(t, req)
+	}
+
+	req, err = http.NewRequest(http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", book.ID), nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	getSingleOKResponse(t, req)
+}
+
+func TestHoldQueuePolicy(t *testing.T) {
+	limit := config.LoanPolicy().LimitsFor(config.RolePatron).MaxPendingRequests
+	newBook := func() config.Book {
+		bookBytes, err := json.Marshal(&config.Book{BookName: bookName})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/admin/book/create", bytes.NewBuffer(bookBytes))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		book := config.Book{}
+		getJSONResponse(t, req, &book)
+		return book
+	}
+	requestLoan := func(bookID int, userToken string) config.Loan {
+		loan := config.Loan{}
+		getJSONResponse(t, newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/loan/request/"+strconv.Itoa(bookID), userToken), &loan)
+		return loan
+	}
+	book := newBook()
+	loan := requestLoan(book.ID, token)
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans/approve/"+strconv.Itoa(loan.ID), adminToken))
+
+	// the first in the queue has as many pending requests as the policy allows
+	busy := signUpAndLogin(t, "busyholder")
+	var busyLoans []config.Loan
+	for i := 0; i < limit; i++ {
+		other := newBook()
+		defer getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", other.ID), adminToken))
+		busyLoans = append(busyLoans, requestLoan(other.ID, busy))
+	}
+	patient := signUpAndLogin(t, "patientholder")
+	holdURL := baseURL + "/api/hold/request/" + strconv.Itoa(book.ID)
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, holdURL, busy))
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, holdURL, patient))
+
+	// returning the copy passes the busy holder over, who stays in the queue
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans/returned/"+strconv.Itoa(loan.ID), adminToken))
+	var queue []config.Hold
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/holds/"+strconv.Itoa(book.ID), adminToken), &queue)
+	if len(queue) != 1 || queue[0].Username != "busyholder" {
+		t.Error("expected the busy holder alone in the queue, got", queue)
+	}
+	var pendingLoans []config.Loan
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loans/pending", patient), &pendingLoans)
+	if len(pendingLoans) != 1 || pendingLoans[0].BookID != book.ID {
+		t.Error("expected the hold of the patient holder to be promoted, got", pendingLoans)
+	} else {
+		getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans/decline/"+strconv.Itoa(pendingLoans[0].ID), adminToken))
+	}
+
+	for _, busyLoan := range busyLoans {
+		getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loan/cancel/"+strconv.Itoa(busyLoan.ID), busy))
+	}
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/hold/cancel/"+strconv.Itoa(book.ID), busy))
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", book.ID), adminToken))
+}
+
+func TestLoanPolicy(t *testing.T) {
+	limit := config.LoanPolicy().LimitsFor(config.RolePatron).MaxPendingRequests
+	var bookIDs []int
+	for i := 0; i <= limit; i++ {
+		bookBytes, err := json.Marshal(&config.Book{BookName: bookName})
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/admin/book/create", bytes.NewBuffer(bookBytes))
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		book := config.Book{}
+		getJSONResponse(t, req, &book)
+		bookIDs = append(bookIDs, book.ID)
+		defer getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", book.ID), adminToken))
+	}
+
+	var loanIDs []int
+	for _, id := range bookIDs[:limit] {
+		loan := config.Loan{}
+		getJSONResponse(t, newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/loan/request/"+strconv.Itoa(id), token), &loan)
+		loanIDs = append(loanIDs, loan.ID)
+	}
+
+	rejections := map[string]*http.Request{
+		routes.RejectMaxPending:       newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/loan/request/"+strconv.Itoa(bookIDs[limit]), token),
+		routes.RejectDuplicateRequest: newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/loan/request/"+strconv.Itoa(bookIDs[0]), token),
+		routes.RejectBookNotFound:     newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/loan/request/999999999", token),
+	}
+	for reason, req := range rejections {
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err.Error())
+			continue
+		}
+		rejection := routes.LoanRejection{}
+		err = json.NewDecoder(res.Body).Decode(&rejection)
+		_ = res.Body.Close()
+		if err != nil || res.StatusCode == http.StatusOK || rejection.Reason != reason {
+			t.Error("expected the request to be rejected for", reason, "got", res.StatusCode, rejection.Reason)
+		}
+	}
+
+	for _, loanID := range loanIDs {
+		getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loan/cancel/"+strconv.Itoa(loanID), token))
+	}
+}
+
+func TestLoanPolicyConcurrently(t *testing.T) {
+	limit := config.LoanPolicy().LimitsFor(config.RolePatron).MaxPendingRequests
+	borrower := signUpAndLogin(t, "eagerborrower")
+	var bookIDs []int
+	for i := 0; i < limit+2; i++ {
+		book := config.Book{}
+		bookBytes, err := json.Marshal(&config.Book{BookName: bookName})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/admin/book/create", bytes.NewBuffer(bookBytes))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		getJSONResponse(t, req, &book)
+		bookIDs = append(bookIDs, book.ID)
+		defer getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", book.ID), adminToken))
+	}
+
+	// every book is requested twice at once, the policy still lets
+	// only one request of a book, and no more than the limit, through
+	var mu sync.Mutex
+	var loans []config.Loan
+	var wg sync.WaitGroup
+	for _, bookID := range append(bookIDs, bookIDs...) {
+		wg.Add(1)
+		go func(bookID int) {
+			defer wg.Done()
+			res, err := http.DefaultClient.Do(newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/loan/request/"+strconv.Itoa(bookID), borrower))
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return
+			}
+			loan := config.Loan{}
+			if err := json.NewDecoder(res.Body).Decode(&loan); err != nil {
+				t.Error(err.Error())
+				return
+			}
+			mu.Lock()
+			loans = append(loans, loan)
+			mu.Unlock()
+		}(bookID)
+	}
+	wg.Wait()
+
+	requested := map[int]bool{}
+	for _, loan := range loans {
+		requested[loan.BookID] = true
+		getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loan/cancel/"+strconv.Itoa(loan.ID), borrower))
+	}
+	if len(loans) != limit || len(requested) != limit {
+		t.Error("expected", limit, "requests of different books, got", len(loans), "of", len(requested), "books")
+	}
+}
+
+func TestLoanStateMachine(t *testing.T) {
+	bookBytes, err := json.Marshal(&config.Book{BookName: bookName})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/admin/book/create", bytes.NewBuffer(bookBytes))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	book := config.Book{}
+	getJSONResponse(t, req, &book)
+	requestURL := baseURL + "/api/loan/request/" + strconv.Itoa(book.ID)
+
+	// a pending request can be cancelled by its user only,
+	// after that it is closed and moved to the loan history
+	cancelled := config.Loan{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodPost, requestURL, token), &cancelled)
+	cancelURL := baseURL + "/api/loan/cancel/" + strconv.Itoa(cancelled.ID)
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, cancelURL, adminToken),
+		newAuthorizedRequest(t, http.MethodGet, cancelURL, token),
+		newAuthorizedRequest(t, http.MethodGet, cancelURL, token),
+	}, []int{http.StatusNotFound, http.StatusOK, http.StatusNotFound})
+
+	loan := config.Loan{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodPost, requestURL, token), &loan)
+	loanURL := func(action string) string {
+		return fmt.Sprintf(baseURL+"/api/admin/loans/%s/%d", action, loan.ID)
+	}
+	renewURL := baseURL + "/api/loan/renew/" + strconv.Itoa(loan.ID)
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, loanURL("checkout"), adminToken),
+		newAuthorizedRequest(t, http.MethodGet, loanURL("approve"), adminToken),
+		newAuthorizedRequest(t, http.MethodGet, loanURL("decline"), adminToken),
+		newAuthorizedRequest(t, http.MethodGet, renewURL, token),
+		newAuthorizedRequest(t, http.MethodGet, loanURL("checkout"), adminToken),
+	}, []int{http.StatusConflict, http.StatusOK, http.StatusConflict, http.StatusConflict, http.StatusOK})
+
+	renewed := dueLoanResponse{}
+	for i := 1; i <= config.Lending().MaxRenewals; i++ {
+		getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, renewURL, token), &renewed)
+		if renewed.Status != config.LoanRenewed || renewed.Renewals != i {
+			t.Error("expected loan renewed", i, "times, got", renewed.Status, renewed.Renewals)
+		}
+	}
+	if renewed.DaysRemaining != (config.Lending().MaxRenewals+1)*config.Lending().LoanPeriodDays() {
+		t.Error("renewing did not extend the due date, days remaining", renewed.DaysRemaining)
+	}
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, renewURL, token),
+		newAuthorizedRequest(t, http.MethodGet, loanURL("lost"), adminToken),
+		newAuthorizedRequest(t, http.MethodGet, loanURL("returned"), adminToken),
+	}, []int{http.StatusForbidden, http.StatusOK, http.StatusNotFound})
+
+	// the lost copy no longer belongs to the book
+	savedBook := config.Book{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/book/%d", book.ID), token), &savedBook)
+	if savedBook.TotalCount != 0 || savedBook.OnLoanCount != 0 {
+		t.Error("expected no copies left, got", savedBook.TotalCount, "total and", savedBook.OnLoanCount, "on loan")
+	}
+
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", book.ID), adminToken))
+}
+
+func TestGetBook(t *testing.T) {
+	url := baseURL + "/api/book"
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%d", url, bookID), nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	getSingleOKResponse(t, req)
+}
+
+func TestGetAllBooks(t *testing.T) {
+	req1, err := http.NewRequest(http.MethodGet, baseURL+"/api/books", nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	req1.Header.Set("Authorization", "Bearer "+adminToken)
+
+	req2, err := http.NewRequest(http.MethodGet, baseURL+"/api/books", nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	req2.Header.Set("Authorization", "Bearer "+token)
+
+	req3, err := http.NewRequest(http.MethodGet, baseURL+"/api/book", nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+
+	}
+	req3.Header.Set("Authorization", "Bearer "+token)
+	requests := []*http.Request{req1, req2, req3}
+	statusOutArr := []int{http.StatusOK, http.StatusOK, http.StatusNotFound}
+	getMultiPleResponse(t, requests, statusOutArr)
+}
+
+func TestCatalogueQuery(t *testing.T) {
+	post := func(url string, v interface{}, out interface{}) {
+		body, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		getJSONResponse(t, req, out)
+	}
+	// a new author each run keeps the books of earlier runs out of the way
+	author := config.Author{}
+	post(baseURL+"/api/admin/author/create", config.Author{AuthorName: "Catalogue Author"}, &author)
+	titles := []string{"Catalogue Cherry", "catalogue apple", "Catalogue Banana", "Unrelated"}
+	books := make([]config.Book, len(titles))
+	for i, title := range titles {
+		post(baseURL+"/api/admin/book/create", config.Book{BookName: title, AuthorID: author.ID, AddCount: i + 1}, &books[i])
+	}
+
+	// the single copy of the cherry book goes out on loan
+	borrowerToken := signUpAndLogin(t, "browser")
+	loan := config.Loan{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/loan/request/"+strconv.Itoa(books[0].ID), borrowerToken), &loan)
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans/approve/"+strconv.Itoa(loan.ID), adminToken))
+	defer getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans/returned/"+strconv.Itoa(loan.ID), adminToken))
+
+	type page struct {
+		Books      []config.Book `json:"books"`
+		Total      int           `json:"total"`
+		NextCursor string        `json:"next_cursor"`
+	}
+	query := func(params string) page {
+		p := page{}
+		getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/books?author_id=%d&%s", author.ID, params), token), &p)
+		return p
+	}
+	names := func(p page) string {
+		names := []string{}
+		for _, book := range p.Books {
+			names = append(names, book.BookName)
+		}
+		return strings.Join(names, ",")
+	}
+
+	if p := query(""); p.Total != 4 || names(p) != "Catalogue Cherry,catalogue apple,Catalogue Banana,Unrelated" || p.NextCursor != "" {
+		t.Error("expected the books of the author by ID, got", p.Total, names(p), p.NextCursor)
+	}
+	if p := query("title=CATALOGUE&sort=title"); p.Total != 3 || names(p) != "catalogue apple,Catalogue Banana,Catalogue Cherry" {
+		t.Error("expected the catalogue books by title, got", p.Total, names(p))
+	}
+	if p := query("title=catalogue&available=true&sort=available&order=desc"); p.Total != 2 || names(p) != "Catalogue Banana,catalogue apple" {
+		t.Error("expected the available catalogue books, most copies first, got", p.Total, names(p))
+	}
+	if p := query("title=nothing"); p.Total != 0 || p.Books == nil || len(p.Books) != 0 {
+		t.Error("expected an empty page, got", p.Total, p.Books)
+	}
+
+	// paging through the books two at a time visits every book once
+	first := query("sort=title&order=desc&limit=2")
+	if first.Total != 4 || names(first) != "Unrelated,Catalogue Cherry" || first.NextCursor == "" {
+		t.Error("expected the first page, got", first.Total, names(first), first.NextCursor)
+	}
+	second := query("sort=title&order=desc&limit=2&cursor=" + first.NextCursor)
+	if second.Total != 4 || names(second) != "Catalogue Banana,catalogue apple" || second.NextCursor != "" {
+		t.Error("expected the last page, got", second.Total, names(second), second.NextCursor)
+	}
+
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/books?author_id=x", token),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/books?available=maybe", token),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/books?sort=price", token),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/books?order=up", token),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/books?limit=0", token),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/books?limit=1000", token),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/books?cursor=nonsense", token),
+	}, []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest,
+		http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest})
+}
+
+func TestSearch(t *testing.T) {
+	post := func(url string, v interface{}, out interface{}) {
+		body, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		if out == nil {
+			getSingleOKResponse(t, req)
+			return
+		}
+		getJSONResponse(t, req, out)
+	}
+	// a word of its own keeps the records of earlier runs out of the results
+	tag := fmt.Sprintf("t%d", time.Now().UnixNano())
+	author := config.Author{}
+	post(baseURL+"/api/admin/author/create", config.Author{AuthorName: "Wren " + tag}, &author)
+	keeping, tales := config.Book{}, config.Book{}
+	post(baseURL+"/api/admin/book/create", config.Book{BookName: tag + " Lighthouse Keeping", AuthorID: author.ID}, &keeping)
+	post(baseURL+"/api/admin/book/create", config.Book{BookName: tag + ": Lighthousekeeper's Tales"}, &tales)
+
+	type result struct {
+		Type string `json:"type"`
+		ID   int    `json:"id"`
+	}
+	search := func(q string) string {
+		results := []result{}
+		getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/search?q="+url.QueryEscape(q), token), &results)
+		found := []string{}
+		for _, r := range results {
+			found = append(found, fmt.Sprintf("%s %d", r.Type, r.ID))
+		}
+		return strings.Join(found, ",")
+	}
+	expect := func(q string, want ...string) {
+		if got := search(q); got != strings.Join(want, ",") {
+			t.Errorf("searching %q: expected %v, got %v", q, want, got)
+		}
+	}
+	book := func(b config.Book) string { return fmt.Sprintf("book %d", b.ID) }
+	authorResult := func(a config.Author) string { return fmt.Sprintf("author %d", a.ID) }
+
+	// every word has to match the start of a word, whole words rank higher
+	expect(tag+" light", book(keeping), book(tales))
+	expect(tag+" LIGHTHOUSEKEEPER", book(tales))
+	expect(strings.ToUpper(tag)+" wren", authorResult(author), book(keeping))
+	expect(tag + " ighthouse")
+
+	// renaming the author renames the books too
+	author.AuthorName = "Kestrel " + tag
+	post(baseURL+"/api/admin/author/update", author, nil)
+	expect(tag + " wren")
+	expect(tag+" kestrel", authorResult(author), book(keeping))
+
+	post(fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", keeping.ID), nil, nil)
+	expect(tag+" light", book(tales))
+	tales.BookName = tag + " Harbour"
+	post(baseURL+"/api/admin/book/update", tales, nil)
+	expect(tag + " tales")
+	expect("harb "+tag, book(tales))
+
+	post(fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", tales.ID), nil, nil)
+	post(fmt.Sprintf(baseURL+"/api/admin/author/delete/%d", author.ID), nil, nil)
+	expect(tag)
+
+	// books that share words are indexed at the same time without losing any
+	const together = 30
+	shared := make([]config.Book, together)
+	wg := sync.WaitGroup{}
+	for i := range shared {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			post(baseURL+"/api/admin/book/create", config.Book{BookName: tag + " A Shared Title"}, &shared[i])
+		}(i)
+	}
+	wg.Wait()
+	results := []result{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/search?limit=100&q="+tag+"+shared", token), &results)
+	if len(results) != together {
+		t.Errorf("expected the %d books to be found, got %v", together, results)
+	}
+	for _, b := range shared {
+		wg.Add(1)
+		go func(b config.Book) {
+			defer wg.Done()
+			post(fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", b.ID), nil, nil)
+		}(b)
+	}
+	wg.Wait()
+	expect(tag)
+
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/search", token),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/search?q=x&limit=0", token),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/search?q=x", ""),
+	}, []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusUnauthorized})
+}
+
+func TestBookMetadata(t *testing.T) {
+	post := func(url string, book config.Book) *http.Request {
+		body, err := json.Marshal(book)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		return req
+	}
+	metadata := config.BookMetadata{
+		ISBN:            " 0-306-40615-2 ",
+		Publisher:       "Plenum Press ",
+		PublicationYear: 1979,
+		Edition:         "2nd",
+		Language:        "EN-gb",
+		PageCount:       432,
+		Subjects:        []string{"Physics", " physics", "", "Measurement"},
+		Description:     "A book about measuring things.",
+		CoverURL:        "https://covers.example.org/0306406152.jpg",
+	}
+	created := config.Book{}
+	getJSONResponse(t, post(baseURL+"/api/admin/book/create", config.Book{BookName: bookName, BookMetadata: metadata}), &created)
+
+	saved := config.Book{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/book/%d", created.ID), token), &saved)
+	if saved.ISBN != "9780306406157" || saved.Publisher != "Plenum Press" || saved.PublicationYear != 1979 ||
+		saved.Edition != "2nd" || saved.Language != "en-GB" || saved.PageCount != 432 ||
+		strings.Join(saved.Subjects, ",") != "Physics,Measurement" || saved.Description != metadata.Description ||
+		saved.CoverURL != metadata.CoverURL {
+		t.Errorf("expected the cleaned up metadata, got %+v", saved.BookMetadata)
+	}
+
+	// an update replaces the record, an ISBN-13 is kept as it is
+	saved.BookMetadata = config.BookMetadata{ISBN: "978-3-16-148410-0", Language: "zh-hant-tw"}
+	getSingleOKResponse(t, post(baseURL+"/api/admin/book/update", saved))
+	updated := config.Book{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/book/%d", created.ID), token), &updated)
+	if updated.ISBN != "9783161484100" || updated.Language != "zh-Hant-TW" || updated.Publisher != "" || updated.Subjects != nil {
+		t.Errorf("expected the new metadata, got %+v", updated.BookMetadata)
+	}
+
+	invalid := []config.BookMetadata{
+		{ISBN: "0-306-40615-3"},
+		{ISBN: "978-3-16-148410-1"},
+		{ISBN: "977-3-16-148410-0"},
+		{ISBN: "12345"},
+		{PublicationYear: 3000},
+		{PageCount: -1},
+		{Language: "english"},
+		{CoverURL: "ftp://covers.example.org/cover.jpg"},
+		{CoverURL: "/cover.jpg"},
+		{Publisher: strings.Repeat("p", 201)},
+	}
+	requests := []*http.Request{}
+	statuses := []int{}
+	for _, m := range invalid {
+		requests = append(requests, post(baseURL+"/api/admin/book/create", config.Book{BookName: bookName, BookMetadata: m}))
+		requests = append(requests, post(baseURL+"/api/admin/book/update", config.Book{ID: created.ID, BookName: bookName, BookMetadata: m}))
+		statuses = append(statuses, http.StatusBadRequest, http.StatusBadRequest)
+	}
+	getMultiPleResponse(t, requests, statuses)
+
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", created.ID), adminToken))
+}
+
+func TestContributors(t *testing.T) {
+	post := func(url string, v interface{}, out interface{}) *http.Request {
+		body, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		if out != nil {
+			getJSONResponse(t, req, out)
+		}
+		return req
+	}
+	newAuthor := func(name string) config.Author {
+		author := config.Author{}
+		post(baseURL+"/api/admin/author/create", config.Author{AuthorName: name}, &author)
+		return author
+	}
+	getBook := func(id int) config.Book {
+		book := config.Book{}
+		getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/book/%d", id), token), &book)
+		return book
+	}
+	getAuthor := func(id int) config.Author {
+		author := config.Author{}
+		getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/author/%d", id), token), &author)
+		return author
+	}
+	works := func(authorID int, role string) string {
+		views := []struct {
+			Role string      `json:"role"`
+			Book config.Book `json:"book"`
+		}{}
+		getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/author/%d/works?role=%s", authorID, role), token), &views)
+		found := []string{}
+		for _, view := range views {
+			found = append(found, fmt.Sprintf("%s %d", view.Role, view.Book.ID))
+		}
+		return strings.Join(found, ",")
+	}
+	credit := func(author config.Author, role string) config.Contribution {
+		return config.Contribution{AuthorID: author.ID, Role: role}
+	}
+	writer, translator, editor := newAuthor("A Writer"), newAuthor("A Translator"), newAuthor("An Editor")
+
+	novel := config.Book{}
+	post(baseURL+"/api/admin/book/create", config.Book{BookName: "A Novel", Contributors: []config.Contribution{
+		credit(writer, ""), credit(translator, config.ContributorTranslator),
+		credit(translator, config.ContributorIllustrator), credit(writer, config.ContributorAuthor),
+	}}, &novel)
+	if novel.AuthorID != writer.ID || len(novel.Contributors) != 3 {
+		t.Errorf("expected the writer as author of 3 contributors, got %d of %v", novel.AuthorID, novel.Contributors)
+	}
+	// author_id alone still makes a single author
+	memoir := config.Book{}
+	post(baseURL+"/api/admin/book/create", config.Book{BookName: "A Memoir", AuthorID: translator.ID}, &memoir)
+
+	if got, want := works(translator.ID, ""), fmt.Sprintf("author %d,translator %d,illustrator %d", memoir.ID, novel.ID, novel.ID); got != want {
+		t.Errorf("expected the works %s, got %s", want, got)
+	}
+	if got, want := works(translator.ID, config.ContributorTranslator), fmt.Sprintf("translator %d", novel.ID); got != want {
+		t.Errorf("expected the translations %s, got %s", want, got)
+	}
+
+	// an update moves the works between contributors
+	novel.SetContributors([]config.Contribution{credit(editor, config.ContributorAuthor), credit(writer, config.ContributorEditor)})
+	getSingleOKResponse(t, post(baseURL+"/api/admin/book/update", novel, nil))
+	if book := getBook(novel.ID); book.AuthorID != editor.ID || len(book.Contributors) != 2 {
+		t.Errorf("expected the editor as author of 2 contributors, got %d of %v", book.AuthorID, book.Contributors)
+	}
+	if got, want := works(writer.ID, ""), fmt.Sprintf("editor %d", novel.ID); got != want {
+		t.Errorf("expected the works %s, got %s", want, got)
+	}
+	if got, want := works(translator.ID, ""), fmt.Sprintf("author %d", memoir.ID); got != want {
+		t.Errorf("expected the works %s, got %s", want, got)
+	}
+	if author := getAuthor(editor.ID); len(author.AuthoredBookIDs) != 1 || author.AuthoredBookIDs[0] != novel.ID {
+		t.Error("expected the editor to have authored", novel.ID, "got", author.AuthoredBookIDs)
+	}
+	if author := getAuthor(writer.ID); len(author.AuthoredBookIDs) != 0 {
+		t.Error("expected the writer to have authored nothing, got", author.AuthoredBookIDs)
+	}
+
+	// the works of an author can't be updated by hand
+	writer.AuthorName = "A Famous Writer"
+	writer.AuthoredBookIDs = []int{memoir.ID}
+	getSingleOKResponse(t, post(baseURL+"/api/admin/author/update", writer, nil))
+	if author := getAuthor(writer.ID); author.AuthorName != writer.AuthorName || len(author.AuthoredBookIDs) != 0 || len(author.Works) != 1 {
+		t.Errorf("expected only the name to change, got %+v", author)
+	}
+
+	getMultiPleResponse(t, []*http.Request{
+		post(baseURL+"/api/admin/book/create", config.Book{BookName: "A Book", Contributors: []config.Contribution{credit(writer, "narrator")}}, nil),
+		post(baseURL+"/api/admin/book/create", config.Book{BookName: "A Book", Contributors: []config.Contribution{{Role: config.ContributorEditor}}}, nil),
+		post(baseURL+"/api/admin/book/create", config.Book{BookName: "A Book", Contributors: []config.Contribution{{AuthorID: 99999999}}}, nil),
+		post(baseURL+"/api/admin/book/update", config.Book{ID: novel.ID, BookName: "A Novel", AuthorID: 99999999}, nil),
+		newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/author/%d/works?role=narrator", writer.ID), token),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/author/99999999/works", token),
+	}, []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest,
+		http.StatusBadRequest, http.StatusNotFound})
+
+	// deleting an author takes them off their books, deleting a book takes it off its contributors
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/author/delete/%d", editor.ID), adminToken))
+	if book := getBook(novel.ID); book.AuthorID != 0 || len(book.Contributors) != 1 || book.Contributors[0] != credit(writer, config.ContributorEditor) {
+		t.Errorf("expected the writer as the only contributor, got %d of %v", book.AuthorID, book.Contributors)
+	}
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", novel.ID), adminToken))
+	if got := works(writer.ID, ""); got != "" {
+		t.Error("expected no works left, got", got)
+	}
+
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", memoir.ID), adminToken))
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/author/delete/%d", writer.ID), adminToken))
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/author/delete/%d", translator.ID), adminToken))
+}
+
+func TestItems(t *testing.T) {
+	post := func(url string, v interface{}, out interface{}) *http.Request {
+		body, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		if out != nil {
+			getJSONResponse(t, req, out)
+		}
+		return req
+	}
+	getBook := func(id int) config.Book {
+		book := config.Book{}
+		getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/book/%d", id), token), &book)
+		return book
+	}
+	getItems := func(id int) []config.Item {
+		items := []config.Item{}
+		getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/book/%d/items", id), token), &items)
+		return items
+	}
+	itemURL := func(item config.Item, action string) string {
+		return fmt.Sprintf(baseURL+"/api/admin/items/%d/%s", item.ID, action)
+	}
+
+	// a new book gets a copy with a barcode made up for each of add_count
+	book := config.Book{}
+	post(baseURL+"/api/admin/book/create", config.Book{BookName: "A Shelved Book", AddCount: 2}, &book)
+	items := getItems(book.ID)
+	if len(items) != 2 || book.TotalCount != 2 || book.LendableCount != 2 {
+		t.Fatalf("expected 2 lendable copies, got %d items and %+v", len(items), book)
+	}
+	for _, item := range items {
+		if !strings.HasPrefix(item.Barcode, "EVL") || item.Status != config.ItemAvailable || item.Condition != config.ConditionGood {
+			t.Errorf("expected an available copy in good condition, got %+v", item)
+		}
+	}
+
+	// older clients set TotalCount, which is taken for add_count on create only
+	counted := config.Book{}
+	post(baseURL+"/api/admin/book/create", map[string]interface{}{"book_name": "A Counted Book", "TotalCount": 3}, &counted)
+	if counted.TotalCount != 3 || len(getItems(counted.ID)) != 3 {
+		t.Errorf("expected 3 copies of the counted book, got %+v", counted)
+	}
+	recounted := counted
+	recounted.TotalCount = 5
+	getMultiPleResponse(t, []*http.Request{
+		post(baseURL+"/api/admin/book/create", map[string]interface{}{"book_name": "A Counted Book", "TotalCount": 3, "add_count": 2}, nil),
+		post(baseURL+"/api/admin/book/update", recounted, nil),
+		post(baseURL+"/api/admin/book/update", counted, nil),
+		newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", counted.ID), adminToken),
+	}, []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusOK, http.StatusOK})
+
+	barcode := fmt.Sprintf("T-%d", time.Now().UnixNano())
+	added := config.Item{}
+	post(fmt.Sprintf(baseURL+"/api/admin/book/%d/items/add", book.ID),
+		map[string]string{"barcode": barcode, "location": "Stack 4, shelf B", "condition": config.ConditionNew}, &added)
+	if added.Barcode != barcode || added.BookID != book.ID || added.Location != "Stack 4, shelf B" {
+		t.Errorf("expected the copy %s on stack 4, got %+v", barcode, added)
+	}
+	found := config.Item{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/item/"+barcode, token), &found)
+	if found.ID != added.ID {
+		t.Errorf("expected item %d by barcode, got %d", added.ID, found.ID)
+	}
+	addURL := fmt.Sprintf(baseURL+"/api/admin/book/%d/items/add", book.ID)
+	getMultiPleResponse(t, []*http.Request{
+		post(addURL, map[string]string{"barcode": barcode}, nil),
+		post(addURL, map[string]string{"barcode": "no spaces"}, nil),
+		post(addURL, map[string]string{"condition": "mint"}, nil),
+		post(baseURL+"/api/admin/book/99999999/items/add", map[string]string{}, nil),
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/item/NO-SUCH-BARCODE", token),
+		newAuthorizedRequest(t, http.MethodPost, addURL, token),
+	}, []int{http.StatusConflict, http.StatusBadRequest, http.StatusBadRequest, http.StatusNotFound, http.StatusNotFound,
+		http.StatusUnauthorized})
+
+	relocated := config.Item{}
+	post(itemURL(items[0], "relocate"), map[string]string{"location": "Returns trolley"}, &relocated)
+	if relocated.Location != "Returns trolley" {
+		t.Error("expected the copy on the returns trolley, got", relocated.Location)
+	}
+	// a damaged copy stays in the collection, but is not lent
+	getSingleOKResponse(t, post(itemURL(items[1], "condition"), map[string]string{"condition": config.ConditionDamaged}, nil))
+	if saved := getBook(book.ID); saved.TotalCount != 3 || saved.LendableCount != 2 || saved.Available() != 2 {
+		t.Errorf("expected 2 of 3 copies lendable, got %+v", saved)
+	}
+
+	// the loan is lent the copy with the barcode given
+	reader := signUpAndLogin(t, "itemreader")
+	loan := config.Loan{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/loan/request/%d", book.ID), reader), &loan)
+	approveURL := fmt.Sprintf(baseURL+"/api/admin/loans/approve/%d?barcode=", loan.ID)
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, approveURL+items[1].Barcode, adminToken),
+		newAuthorizedRequest(t, http.MethodGet, approveURL+"NO-SUCH-BARCODE", adminToken),
+		newAuthorizedRequest(t, http.MethodGet, approveURL+barcode, adminToken),
+	}, []int{http.StatusForbidden, http.StatusForbidden, http.StatusOK})
+	approved := config.Loan{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/admin/loan/%d", loan.ID), adminToken), &approved)
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/item/"+barcode, token), &found)
+	if approved.ItemID != added.ID || found.Status != config.ItemOnLoan || found.LoanID != loan.ID {
+		t.Errorf("expected item %d on loan %d, got item %d and %+v", added.ID, loan.ID, approved.ItemID, found)
+	}
+	deleteURL := fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", book.ID)
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodPost, itemURL(added, "retire"), adminToken),
+		newAuthorizedRequest(t, http.MethodPost, deleteURL, adminToken),
+		newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/admin/loans/returned/%d", loan.ID), adminToken),
+		newAuthorizedRequest(t, http.MethodPost, itemURL(items[0], "retire"), adminToken),
+		newAuthorizedRequest(t, http.MethodPost, itemURL(items[0], "retire"), adminToken),
+		post(itemURL(items[0], "relocate"), map[string]string{"location": "Stack 1"}, nil),
+		newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/admin/items/99999999/retire", adminToken),
+	}, []int{http.StatusConflict, http.StatusConflict, http.StatusOK, http.StatusOK, http.StatusConflict, http.StatusConflict,
+		http.StatusNotFound})
+
+	returned := config.Item{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/item/"+barcode, token), &returned)
+	if returned.Status != config.ItemAvailable || returned.LoanID != 0 {
+		t.Errorf("expected the returned copy back on the shelf, got %+v", returned)
+	}
+	if saved := getBook(book.ID); saved.TotalCount != 2 || saved.OnLoanCount != 0 || saved.LendableCount != 1 {
+		t.Errorf("expected 1 of 2 copies lendable, got %+v", saved)
+	}
+	if items := getItems(book.ID); len(items) != 3 || items[0].Status != config.ItemRetired || items[0].RetiredAt == nil {
+		t.Errorf("expected the retired copy to be listed, got %+v", items)
+	}
+
+	// a book with a loan request open can't be deleted either
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/loan/request/%d", book.ID), reader), &loan)
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodPost, deleteURL, adminToken),
+		newAuthorizedRequest(t, http.MethodGet, fmt.Sprintf(baseURL+"/api/loan/cancel/%d", loan.ID), reader),
+	}, []int{http.StatusConflict, http.StatusOK})
+
+	// the copies go along with the book
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, deleteURL, adminToken))
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/item/"+barcode, token),
+	}, []int{http.StatusNotFound})
+}
+
+func TestDeleteBook(t *testing.T) {
+	url := fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", bookID)
+	req1, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req1.Header.Set("Authorization", "Bearer "+token)
+
+	req2, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req2.Header.Set("Authorization", "Bearer "+adminToken)
 	requests := []*http.Request{req1, req2}
 	statusOutArr := []int{http.StatusUnauthorized, http.StatusOK}
 	getMultiPleResponse(t, requests, statusOutArr)
@@ -345,7 +2240,6 @@ func TestCreateBookWithStress(t *testing.T) {
 	for i := 1; i < numberOfIteration; i++ {
 
 		book := &config.Book{
-			ID:       i,
 			BookName: bookName,
 			AuthorID: authorID,
 		}
@@ -355,7 +2249,7 @@ func TestCreateBookWithStress(t *testing.T) {
 			t.Error(err.Error())
 			return
 		}
-		url := "http://localhost:3000/api/admin/book/create"
+		url := baseURL + "/api/admin/book/create"
 
 		req1, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(bookBytes))
 		if err != nil {
@@ -363,14 +2257,16 @@ func TestCreateBookWithStress(t *testing.T) {
 			return
 		}
 		req1.Header.Set("Authorization", "Bearer "+adminToken)
-		getSingleOKResponse(t, req1)
+		createdBook := config.Book{}
+		getJSONResponse(t, req1, &createdBook)
+		stressBookIDs = append(stressBookIDs, createdBook.ID)
 		//time.Sleep(interval)
 	}
 }
 
 func TestDeleteBookWithStress(t *testing.T) {
-	for i := 1; i < numberOfIteration; i++ {
-		url := fmt.Sprintf("http://localhost:3000/api/admin/book/delete/%d", i)
+	for _, i := range stressBookIDs {
+		url := fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", i)
 		req1, err := http.NewRequest(http.MethodPost, url, nil)
 		if err != nil {
 			t.Error(err.Error())
@@ -383,7 +2279,7 @@ func TestDeleteBookWithStress(t *testing.T) {
 }
 
 func TestDeleteAuthor(t *testing.T) {
-	url := fmt.Sprintf("http://localhost:3000/api/admin/author/delete/%d", bookID)
+	url := fmt.Sprintf(baseURL+"/api/admin/author/delete/%d", authorID)
 	req1, err := http.NewRequest(http.MethodPost, url, nil)
 	if err != nil {
 		t.Error(err.Error())
@@ -402,7 +2298,195 @@ func TestDeleteAuthor(t *testing.T) {
 	getMultiPleResponse(t, requests, statusOutArr)
 }
 
+func TestOverdueLoans(t *testing.T) {
+	dueAt := time.Now().Add(-71 * time.Hour)
+	overdue := config.Loan{
+		ID:       overdueLoanID,
+		BookID:   bookID,
+		Username: username,
+		Approved: true,
+		Status:   config.LoanCheckedOut,
+		DueAt:    &dueAt,
+	}
+	if err := db.Loans().Save(overdue); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer func() { _ = db.Loans().Delete(overdueLoanID) }()
+
+	url := baseURL + "/api/admin/loans/overdue"
+	req1, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req1.Header.Set("Authorization", "Bearer "+token)
+	getMultiPleResponse(t, []*http.Request{req1}, []int{http.StatusUnauthorized})
+
+	req2, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req2.Header.Set("Authorization", "Bearer "+adminToken)
+	var report []struct {
+		config.Loan
+		DaysOverdue int `json:"days_overdue"`
+	}
+	getJSONResponse(t, req2, &report)
+	for _, entry := range report {
+		if entry.ID == overdueLoanID {
+			if entry.DaysOverdue != 3 {
+				t.Error("expected 3 days overdue, got", entry.DaysOverdue)
+			}
+			return
+		}
+	}
+	t.Error("overdue loan is missing from the report")
+}
+
+func TestFines(t *testing.T) {
+	credit := func(kind string, amount int) *http.Request {
+		body := fmt.Sprintf(`{"amount": %d, "note": "at the desk"}`, amount)
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/admin/fines/"+username+"/"+kind, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		return req
+	}
+	// the ledger is kept, what earlier tests charged is waived
+	// and only what this test adds to it is checked
+	before, err := db.Fines().Ledger(username)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if balance := config.LedgerBalance(before); balance > 0 {
+		getSingleOKResponse(t, credit("waiver", balance))
+		before, _ = db.Fines().Ledger(username)
+	}
+
+	// returned a day short of 30 days late
+	dueAt := time.Now().Add(-(30*24 - 1) * time.Hour)
+	fined := config.Loan{
+		ID:       finedLoanID,
+		BookID:   bookID,
+		Username: username,
+		Approved: true,
+		Status:   config.LoanCheckedOut,
+		DueAt:    &dueAt,
+	}
+	if err := db.Loans().Save(fined); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/loans/returned/"+strconv.Itoa(finedLoanID), adminToken))
+
+	fines := config.Fines()
+	owed := 30 * fines.DailyRate
+	if owed > fines.MaxOverdueFine {
+		owed = fines.MaxOverdueFine
+	}
+	var statement struct {
+		Balance int                  `json:"balance"`
+		Entries []config.LedgerEntry `json:"entries"`
+	}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/fines", token), &statement)
+	if statement.Balance != owed || len(statement.Entries) != len(before)+1 ||
+		statement.Entries[len(before)].LoanID != finedLoanID {
+		t.Fatal("expected a fine of", owed, "for the late loan, got", statement.Balance, statement.Entries)
+	}
+
+	bookBytes, err := json.Marshal(&config.Book{BookName: bookName})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/admin/book/create", bytes.NewBuffer(bookBytes))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	book := config.Book{}
+	getJSONResponse(t, req, &book)
+	defer getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodPost, fmt.Sprintf(baseURL+"/api/admin/book/delete/%d", book.ID), adminToken))
+	requestURL := baseURL + "/api/loan/request/" + strconv.Itoa(book.ID)
+
+	// users owing more than the threshold can't request loans until they pay
+	getMultiPleResponse(t, []*http.Request{
+		newAuthorizedRequest(t, http.MethodPost, requestURL, token),
+		credit("payment", owed+1),
+		credit("payment", 0),
+		credit("waiver", owed-fines.BlockLoansOver),
+	}, []int{http.StatusForbidden, http.StatusBadRequest, http.StatusBadRequest, http.StatusOK})
+
+	loan := config.Loan{}
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodPost, requestURL, token), &loan)
+	getSingleOKResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/loan/cancel/"+strconv.Itoa(loan.ID), token))
+
+	getSingleOKResponse(t, credit("payment", fines.BlockLoansOver))
+	getJSONResponse(t, newAuthorizedRequest(t, http.MethodGet, baseURL+"/api/admin/fines/"+username, adminToken), &statement)
+	if statement.Balance != 0 || len(statement.Entries) != len(before)+3 {
+		t.Error("expected the fine to be paid off, got", statement.Balance, statement.Entries)
+	}
+}
+
+func TestLegacyPasswordMigration(t *testing.T) {
+	legacyUser := config.UserCredentials{
+		Username: "legacy",
+		// unsalted md5 of "legacy", as stored by older versions
+		Password: "228c70bfc5589c58c044e03fff0e17eb",
+	}
+	if err := db.Users().Save(legacyUser); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer func() { _ = db.Users().Delete(legacyUser.Username) }()
+
+	// the first login verifies the md5 hash and replaces it, the second uses the new hash
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/api/login", nil)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		req.Header.Set("Authorization", "Base "+base64.StdEncoding.EncodeToString([]byte("legacy:legacy")))
+		getSingleOKResponse(t, req)
+	}
+
+	migratedUser, err := db.Users().Get(legacyUser.Username)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if !strings.HasPrefix(migratedUser.Password, "$2") {
+		t.Error("password was not rehashed, got", migratedUser.Password)
+	}
+}
+
+func TestLoginWithoutPassword(t *testing.T) {
+	// as created at the first OIDC login
+	oidcUser := config.UserCredentials{Username: "nopassword"}
+	if err := db.Users().Save(oidcUser); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() { _ = db.Users().Delete(oidcUser.Username) }()
+
+	getMultiPleResponse(t, []*http.Request{newLoginRequest(t, oidcUser.Username, "anything")},
+		[]int{http.StatusUnauthorized})
+}
+
+func TestImageUploadWithoutFile(t *testing.T) {
+	req := newAuthorizedRequest(t, http.MethodPost, baseURL+"/api/upload/finalize", token)
+	getMultiPleResponse(t, []*http.Request{req}, []int{http.StatusBadRequest})
+}
+
 func TestRedis(t *testing.T) {
+	if config.Storage().Backend != config.RedisBackend {
+		t.Skip("the storage backend is not redis")
+	}
 	db.InitRedis()
 	redis := db.GetClient()
 	result, err := redis.Ping().Result()
@@ -436,6 +2520,28 @@ func getSingleOKResponse(t *testing.T, req *http.Request) string {
 	return strings.ReplaceAll(string(bodyBytes), "\"", "")
 }
 
+func getJSONResponse(t *testing.T, req *http.Request, v interface{}) {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer res.Body.Close()
+
+	if http.StatusOK != res.StatusCode {
+		t.Error("Handler returned wrong status code: got ", res.StatusCode, "want ", http.StatusOK)
+		return
+	}
+	bodyBytes, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if err := json.Unmarshal(bodyBytes, v); err != nil {
+		t.Error(err.Error())
+	}
+}
+
 func getMultiPleResponse(t *testing.T, requests []*http.Request, statusOutArr []int) {
 
 	for i, req := range requests {
@@ -454,3 +2560,47 @@ func getMultiPleResponse(t *testing.T, requests []*http.Request, statusOutArr []
 	}
 
 }
+
+// newAuthorizedRequest builds a request authorized by token
+func newAuthorizedRequest(t *testing.T, method, url, token string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+// signUpAndLogin signs name up, unless it already exists, and returns its token.
+// The password of the user is its name.
+func signUpAndLogin(t *testing.T, name string) string {
+	buf := new(bytes.Buffer)
+	_ = json.NewEncoder(buf).Encode(config.UserCredentials{Username: name, Password: name})
+	res, err := http.Post(baseURL+"/api/signup", "application/json", buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = res.Body.Close()
+
+	return getTokens(t, newLoginRequest(t, name, name)).AccessToken
+}
+
+// newLoginRequest builds a login request with the credentials of username
+func newLoginRequest(t *testing.T, username, password string) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/login", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Header.Set("Authorization", "Base "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	return req
+}
+
+// getTokens returns the tokens handed out by a login or refresh request
+func getTokens(t *testing.T, req *http.Request) auth.Tokens {
+	tokens := auth.Tokens{}
+	getJSONResponse(t, req, &tokens)
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Error("expected an access token and a refresh token, got", tokens)
+	}
+	return tokens
+}